@@ -0,0 +1,175 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+// Allocator: allocates ids in process, without the http server.
+// It shares the counters with the idalloc servers and other allocators using the same redis, db and key prefix.
+type Allocator struct {
+	allocHandler      *service.AllocHandler
+	redisAllocHandler *service.RedisAllocHandler
+	serviceRegistry   *service.ServiceRegistry
+	// lock: the allocs hold it shared and Close exclusively, so that nothing is allocated after the handlers are shut down
+	lock   sync.RWMutex
+	closed bool
+}
+
+// New: the counters in redis are recovered from db before it returns. Close it when it is no longer used.
+func New(opts ...AllocatorOpt) (*Allocator, error) {
+	o := newOptions(opts...)
+	if err := checkConfig(&o.config); err != nil {
+		return nil, err
+	}
+
+	var metrics *service.Metrics
+	if o.registerer != nil {
+		metrics = service.NewMetrics(o.registerer, o.config.AppName)
+	}
+	ctx := context.Background()
+	if o.logger != nil {
+		ctx = log.WithLogger(ctx, o.logger)
+	}
+	store := repository.NewStore(o.config.Redis, o.config.DB, o.config.RedisKeyPrefix)
+	redisAllocHandler := service.NewRedisAllocHandler(ctx, &o.config, store, metrics)
+	serviceRegistry := service.NewServiceRegistry(ctx, &o.config, store)
+	allocHandler := service.NewAllocHandler(ctx, &o.config, store, redisAllocHandler, serviceRegistry, metrics)
+
+	redisAllocHandler.Start()
+	if err := serviceRegistry.Start(); err != nil {
+		serviceRegistry.Shutdown()
+		redisAllocHandler.Shutdown()
+		return nil, err
+	}
+	if err := allocHandler.Start(); err != nil {
+		allocHandler.Shutdown()
+		serviceRegistry.Shutdown()
+		redisAllocHandler.Shutdown()
+		return nil, err
+	}
+	return &Allocator{
+		allocHandler:      allocHandler,
+		redisAllocHandler: redisAllocHandler,
+		serviceRegistry:   serviceRegistry,
+	}, nil
+}
+
+// Alloc: allocate n ids of the service, n is 1~MAX_USER_BATCH_ALLOC_NUM.
+// The uint64 services are refused, their ids exceed int64, see AllocUint64.
+func (a *Allocator) Alloc(ctx context.Context, serviceName string, n int64) ([]int64, error) {
+	serviceName, err := checkAllocParam(serviceName, n)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.closed {
+		return nil, errAllocatorClosed()
+	}
+	// checked before allocating, so that the ids are not wasted
+	idType, err := a.allocHandler.GetIdType(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	} else if idType == entity.ID_TYPE_UINT64 {
+		return nil, e.NewParamError(e.WithMsg("service is uint64, use AllocUint64. service_name: " + serviceName))
+	}
+	ids, _, err := a.allocHandler.Alloc(ctx, serviceName, n)
+	return ids, err
+}
+
+// AllocUint64: allocate n ids of the service as uint64, for the uint64 services and the int64 ones alike
+func (a *Allocator) AllocUint64(ctx context.Context, serviceName string, n int64) ([]uint64, error) {
+	serviceName, err := checkAllocParam(serviceName, n)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.closed {
+		return nil, errAllocatorClosed()
+	}
+	ids, idType, err := a.allocHandler.Alloc(ctx, serviceName, n)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		if idType == entity.ID_TYPE_UINT64 {
+			result = append(result, entity.ToUint64(id))
+		} else {
+			result = append(result, uint64(id))
+		}
+	}
+	return result, nil
+}
+
+// checkAllocParam: returns the normalized service name
+func checkAllocParam(serviceName string, n int64) (string, error) {
+	serviceName = strings.ToLower(strings.TrimSpace(serviceName))
+	if len(serviceName) == 0 || len(serviceName) > def.MAX_SERVICE_NAME_LENGTH {
+		return "", e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+	} else if n <= 0 || n > def.MAX_USER_BATCH_ALLOC_NUM {
+		errMsg := fmt.Sprintf("count is invalid. min: %d max: %d input:%d", 1, def.MAX_USER_BATCH_ALLOC_NUM, n)
+		return "", e.NewParamError(e.WithMsg(errMsg))
+	}
+	return serviceName, nil
+}
+
+func errAllocatorClosed() error {
+	return e.NewServerError(e.WithMsg("AllocatorClosed"))
+}
+
+// Close: the ids left in the segments are dropped, and the pending syncs to db are finished before it returns.
+// It waits for the allocs in progress, the later ones fail.
+func (a *Allocator) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return
+	}
+	a.closed = true
+	// the order is important, the alloc handler uses the others
+	a.allocHandler.Shutdown()
+	a.serviceRegistry.Shutdown()
+	a.redisAllocHandler.Shutdown()
+}
+
+func checkConfig(config *def.Config) error {
+	if config.Redis == nil {
+		return e.NewParamError(e.WithMsg("config invalid. redis is nil"))
+	} else if config.DB == nil {
+		return e.NewParamError(e.WithMsg("config invalid. db is nil"))
+	} else if config.RedisKeyPrefix == "" {
+		return e.NewParamError(e.WithMsg("config invalid. key prefix is empty"))
+	} else if config.RedisBatchAllocNum < def.MAX_USER_BATCH_ALLOC_NUM {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("config invalid. batch size min: %d input:%d", def.MAX_USER_BATCH_ALLOC_NUM, config.RedisBatchAllocNum)))
+	} else if config.SyncRedisAndDBChanSize <= 0 || config.SyncRedisAndDBThreadNum <= 0 {
+		return e.NewParamError(e.WithMsg("config invalid. sync chan size and thread num must be positive"))
+	} else if config.WriteDBEveryNVersion <= 0 || config.RecoverRedisEveryNVersion <= 0 {
+		return e.NewParamError(e.WithMsg("config invalid. sync every n version must be positive"))
+	}
+	switch config.WarmupMode {
+	case def.WARMUP_MODE_EAGER, def.WARMUP_MODE_LAZY, def.WARMUP_MODE_HOT:
+	default:
+		return e.NewParamError(e.WithMsg("config invalid. unknown warmup mode: " + config.WarmupMode))
+	}
+	if config.Ledger.Enable && config.InstanceId == "" {
+		return e.NewParamError(e.WithMsg("config invalid. instance id is empty, it is required by the ledger"))
+	}
+	for _, threshold := range config.ExhaustionForecast.WarnThresholds {
+		if threshold <= 0 {
+			return e.NewParamError(e.WithMsg(fmt.Sprintf("config invalid. exhaustion warn threshold must be positive, input:%s", threshold)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemon-coder/idalloc/repository"
+	goRedis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// emptyDriver: a db with empty tables, the queries return no rows and the writes affect a row
+type emptyDriver struct{}
+
+func (emptyDriver) Open(name string) (driver.Conn, error) { return emptyConn{}, nil }
+
+type emptyConn struct{}
+
+func (emptyConn) Prepare(query string) (driver.Stmt, error) { return emptyStmt{}, nil }
+func (emptyConn) Close() error                              { return nil }
+func (emptyConn) Begin() (driver.Tx, error)                 { return emptyTx{}, nil }
+
+type emptyTx struct{}
+
+func (emptyTx) Commit() error   { return nil }
+func (emptyTx) Rollback() error { return nil }
+
+type emptyStmt struct{}
+
+func (emptyStmt) Close() error                                    { return nil }
+func (emptyStmt) NumInput() int                                   { return -1 }
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(1), nil }
+func (emptyStmt) Query(args []driver.Value) (driver.Rows, error)  { return emptyRows{}, nil }
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("idalloc_empty", emptyDriver{})
+}
+
+// incrRedis: keeps the counters in memory and answers RedisIncrCmd, the other commands fail.
+// It is a hook of the client, so nothing is dialed.
+type incrRedis struct {
+	sync.Mutex
+	values map[string]int64
+}
+
+func (r *incrRedis) DialHook(next goRedis.DialHook) goRedis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, context.Canceled
+	}
+}
+
+func (r *incrRedis) ProcessHook(next goRedis.ProcessHook) goRedis.ProcessHook {
+	return func(ctx context.Context, cmd goRedis.Cmder) error {
+		args := cmd.Args()
+		if len(args) < 10 || cmd.Name() != "evalsha" || args[1] != repository.RedisIncrCmd.Hash() {
+			cmd.SetErr(goRedis.Nil)
+			return goRedis.Nil
+		}
+		// evalsha sha 5 key valueField versionField idTypeField epochField increment idType
+		key, _ := args[3].(string)
+		increment, _ := args[8].(int64)
+		r.Lock()
+		defer r.Unlock()
+		r.values[key] += increment
+		version := r.values[key] / increment
+		cmd.(*goRedis.Cmd).SetVal([]interface{}{int64(1), strconv.FormatInt(r.values[key], 10), version, "", int64(0)})
+		return nil
+	}
+}
+
+func (r *incrRedis) ProcessPipelineHook(next goRedis.ProcessPipelineHook) goRedis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goRedis.Cmder) error {
+		for _, cmd := range cmds {
+			cmd.SetErr(goRedis.Nil)
+		}
+		return goRedis.Nil
+	}
+}
+
+func newTestAllocator(t *testing.T) *Allocator {
+	t.Helper()
+	redis := goRedis.NewClient(&goRedis.Options{Addr: "fake:6379"})
+	redis.AddHook(&incrRedis{values: make(map[string]int64)})
+	db, err := sql.Open("idalloc_empty", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every fetch is synced to db, so a fetch after Close sends on the closed sync chan
+	allocator, err := New(WithRedis(redis), WithDB(db), WithBatchSize(100), WithSyncEveryNVersion(1, 1), WithLogger(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return allocator
+}
+
+func TestAllocatorAllocConcurrentWithClose(t *testing.T) {
+	allocator := newTestAllocator(t)
+	ctx := context.Background()
+
+	wg := &sync.WaitGroup{}
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// a new service for every alloc, so that every alloc fetches a segment itself
+				allocator.Alloc(ctx, "order"+strconv.Itoa(i)+"_"+strconv.Itoa(j), 1)
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	allocator.Close()
+	// the allocs after Close fail instead of fetching
+	if ids, err := allocator.Alloc(ctx, "order0", 1); err == nil {
+		t.Errorf("Alloc after Close: got %v, want an error", ids)
+	}
+	if ids, err := allocator.AllocUint64(ctx, "order0", 1); err == nil {
+		t.Errorf("AllocUint64 after Close: got %v, want an error", ids)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	// closed twice
+	allocator.Close()
+}
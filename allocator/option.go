@@ -0,0 +1,150 @@
+package allocator
+
+import (
+	"database/sql"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/prometheus/client_golang/prometheus"
+	goRedis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+type options struct {
+	config def.Config
+	// registerer: the metrics are not recorded if it is nil
+	registerer prometheus.Registerer
+	// logger: the default logger is used if it is nil
+	logger *zap.Logger
+}
+
+type AllocatorOpt func(*options)
+
+func newOptions(opts ...AllocatorOpt) *options {
+	o := &options{
+		config: def.Config{
+			AppName:                        def.DEFAULT_APP_NAME,
+			RedisKeyPrefix:                 def.DEFAULT_REDIS_KEY_PREFIX,
+			SyncRedisAndDBChanSize:         def.DEFAULT_SYNC_REDIS_AND_DB_CHAN_SIZE,
+			SyncRedisAndDBThreadNum:        def.DEFAULT_SYNC_REDIS_AND_DB_THREAD_NUM,
+			RedisBatchAllocNum:             def.DEFAULT_REDIS_BATCH_ALLOC_NUM,
+			WriteDBEveryNVersion:           def.DEFAULT_WRITE_DB_EVERY_N_VERSION,
+			RecoverRedisEveryNVersion:      def.DEFAULT_RECOVER_REDIS_EVERY_N_VERSION,
+			IdempotentKeyExpire:            def.DEFAULT_IDEMPOTENT_KEY_EXPIRE,
+			ServiceRegistryRefreshInterval: def.DEFAULT_SERVICE_REGISTRY_REFRESH,
+			WarmupMode:                     def.WARMUP_MODE_LAZY,
+			WarmupConcurrency:              def.DEFAULT_WARMUP_CONCURRENCY,
+			ExhaustionForecast: def.ExhaustionForecast{
+				Window:         def.DEFAULT_EXHAUSTION_FORECAST_WINDOW,
+				WarnThresholds: def.DEFAULT_EXHAUSTION_FORECAST_WARN_THRESHOLDS,
+			},
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRedis: required, the counters are allocated from it
+func WithRedis(client *goRedis.Client) AllocatorOpt {
+	return func(o *options) {
+		o.config.Redis = client
+	}
+}
+
+// WithDB: required, the counters are backed up to it
+func WithDB(db *sql.DB) AllocatorOpt {
+	return func(o *options) {
+		o.config.DB = db
+	}
+}
+
+// WithKeyPrefix: must be the same as the other allocators and servers sharing the counters
+func WithKeyPrefix(keyPrefix string) AllocatorOpt {
+	return func(o *options) {
+		o.config.RedisKeyPrefix = keyPrefix
+	}
+}
+
+// WithBatchSize: how many ids are fetched from redis at a time
+func WithBatchSize(batchSize int64) AllocatorOpt {
+	return func(o *options) {
+		o.config.RedisBatchAllocNum = batchSize
+	}
+}
+
+// WithSync: the queue size and the goroutine number syncing redis and db
+func WithSync(chanSize, threadNum int) AllocatorOpt {
+	return func(o *options) {
+		o.config.SyncRedisAndDBChanSize = chanSize
+		o.config.SyncRedisAndDBThreadNum = threadNum
+	}
+}
+
+// WithSyncEveryNVersion: write redis to db every writeDB versions, and recover redis from db every recoverRedis versions
+func WithSyncEveryNVersion(writeDB, recoverRedis int64) AllocatorOpt {
+	return func(o *options) {
+		o.config.WriteDBEveryNVersion = writeDB
+		o.config.RecoverRedisEveryNVersion = recoverRedis
+	}
+}
+
+// WithRejectUnknownService: only the services created in advance can be allocated
+func WithRejectUnknownService(reject bool) AllocatorOpt {
+	return func(o *options) {
+		o.config.RejectUnknownService = reject
+	}
+}
+
+// WithWarmup: the services whose segments are fetched on New, lazy by default
+func WithWarmup(mode string, serviceNames ...string) AllocatorOpt {
+	return func(o *options) {
+		o.config.WarmupMode = mode
+		o.config.WarmupServiceNames = serviceNames
+	}
+}
+
+// WithServiceHandlerLimit: drop the service handlers idle for idleTimeout, and keep at most maxNum of them. 0 means unlimited.
+func WithServiceHandlerLimit(idleTimeout time.Duration, maxNum int) AllocatorOpt {
+	return func(o *options) {
+		o.config.ServiceHandlerIdleTimeout = idleTimeout
+		o.config.MaxServiceHandlerNum = maxNum
+	}
+}
+
+// WithMetrics: register the metrics to registerer, labeled with appName
+func WithMetrics(registerer prometheus.Registerer, appName string) AllocatorOpt {
+	return func(o *options) {
+		o.registerer = registerer
+		o.config.AppName = appName
+	}
+}
+
+// WithLedger: record every segment fetched in the db as instanceId, and prune the records older than retention.
+// 0 retention means they are kept forever.
+func WithLedger(instanceId string, retention time.Duration) AllocatorOpt {
+	return func(o *options) {
+		o.config.Ledger = def.Ledger{Enable: true, Retention: retention}
+		o.config.InstanceId = instanceId
+	}
+}
+
+// WithExhaustionForecast: export the forecasts and log the warnings every checkInterval. The counters are forecast
+// against maxValues by service, the max of the id type for the others. The default thresholds are used if none is
+// given.
+func WithExhaustionForecast(checkInterval time.Duration, maxValues map[string]uint64, warnThresholds ...time.Duration) AllocatorOpt {
+	return func(o *options) {
+		o.config.ExhaustionForecast.CheckInterval = checkInterval
+		o.config.ExhaustionForecast.MaxValues = maxValues
+		if len(warnThresholds) > 0 {
+			o.config.ExhaustionForecast.WarnThresholds = warnThresholds
+		}
+	}
+}
+
+func WithLogger(logger *zap.Logger) AllocatorOpt {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
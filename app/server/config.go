@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"time"
 
 	def "github.com/daemon-coder/idalloc/definition"
@@ -39,8 +41,8 @@ func CheckConfig(config *def.Config) {
 		e.Panic(e.NewCriticalError(e.WithMsg("config invalid. db ping failed")))
 	}
 
-	if config.RedisKeyPrefix != "" {
-		def.RedisKeyPrefix = config.RedisKeyPrefix
+	if config.RedisKeyPrefix == "" {
+		config.RedisKeyPrefix = def.DEFAULT_REDIS_KEY_PREFIX
 	}
 
 	if config.SyncRedisAndDBChanSize <= 0 {
@@ -54,7 +56,6 @@ func CheckConfig(config *def.Config) {
 	if config.RedisBatchAllocNum < def.MAX_USER_BATCH_ALLOC_NUM {
 		config.RedisBatchAllocNum = def.DEFAULT_REDIS_BATCH_ALLOC_NUM
 	}
-	def.RedisBatchAllocNum = config.RedisBatchAllocNum
 
 	if config.WriteDBEveryNVersion <= 0 {
 		config.WriteDBEveryNVersion = def.DEFAULT_WRITE_DB_EVERY_N_VERSION
@@ -63,4 +64,70 @@ func CheckConfig(config *def.Config) {
 	if config.RecoverRedisEveryNVersion <= 0 {
 		config.RecoverRedisEveryNVersion = def.DEFAULT_RECOVER_REDIS_EVERY_N_VERSION
 	}
+
+	if config.IdempotentKeyExpire <= 0 {
+		config.IdempotentKeyExpire = def.DEFAULT_IDEMPOTENT_KEY_EXPIRE
+	}
+
+	switch config.WarmupMode {
+	case "":
+		config.WarmupMode = def.DEFAULT_WARMUP_MODE
+	case def.WARMUP_MODE_EAGER, def.WARMUP_MODE_LAZY, def.WARMUP_MODE_HOT:
+	default:
+		e.Panic(e.NewCriticalError(e.WithMsg("config invalid. unknown warmup mode: " + config.WarmupMode)))
+	}
+
+	if config.WarmupConcurrency <= 0 {
+		config.WarmupConcurrency = def.DEFAULT_WARMUP_CONCURRENCY
+	}
+
+	if config.Tracing.Enable {
+		if config.Tracing.Exporter == "" {
+			config.Tracing.Exporter = def.DEFAULT_TRACING_EXPORTER
+		}
+		if config.Tracing.Exporter == def.TRACING_EXPORTER_OTLP && config.Tracing.OtlpEndpoint == "" {
+			e.Panic(e.NewCriticalError(e.WithMsg("config invalid. tracing otlp endpoint is empty")))
+		}
+		if config.Tracing.SampleRatio <= 0 {
+			config.Tracing.SampleRatio = def.DEFAULT_TRACING_SAMPLE_RATIO
+		}
+	}
+
+	if config.ServiceRegistryRefreshInterval <= 0 {
+		config.ServiceRegistryRefreshInterval = def.DEFAULT_SERVICE_REGISTRY_REFRESH
+	}
+
+	if config.InstanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		config.InstanceId = fmt.Sprintf("%s:%d", hostname, config.ServerPort)
+	}
+
+	if config.ExhaustionForecast.Window <= 0 {
+		config.ExhaustionForecast.Window = def.DEFAULT_EXHAUSTION_FORECAST_WINDOW
+	}
+	if config.ExhaustionForecast.WarnThresholds == nil {
+		config.ExhaustionForecast.WarnThresholds = def.DEFAULT_EXHAUSTION_FORECAST_WARN_THRESHOLDS
+	}
+
+	if config.SegmentJournal.Dir != "" {
+		if config.SegmentJournal.MaxFileSize <= 0 {
+			config.SegmentJournal.MaxFileSize = def.DEFAULT_SEGMENT_JOURNAL_MAX_FILE_SIZE
+		}
+		if config.SegmentJournal.MaxFileNum <= 0 {
+			config.SegmentJournal.MaxFileNum = def.DEFAULT_SEGMENT_JOURNAL_MAX_FILE_NUM
+		}
+		switch config.SegmentJournal.FsyncPolicy {
+		case "":
+			config.SegmentJournal.FsyncPolicy = def.DEFAULT_SEGMENT_JOURNAL_FSYNC_POLICY
+		case def.SEGMENT_JOURNAL_FSYNC_ALWAYS, def.SEGMENT_JOURNAL_FSYNC_INTERVAL, def.SEGMENT_JOURNAL_FSYNC_NEVER:
+		default:
+			e.Panic(e.NewCriticalError(e.WithMsg("config invalid. unknown segment journal fsync policy: " + config.SegmentJournal.FsyncPolicy)))
+		}
+		if config.SegmentJournal.FsyncInterval <= 0 {
+			config.SegmentJournal.FsyncInterval = def.DEFAULT_SEGMENT_JOURNAL_FSYNC_INTERVAL
+		}
+	}
 }
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+// ConfigLoader: loads the config again for a reload, the stores of the config returned are not used
+type ConfigLoader func() (*definition.Config, error)
+
+// Reload: load the config by ConfigLoader, apply the settings safe to change while serving,
+// and keep the old values of the others, which are reported as rejected. Nothing is applied if an error is returned.
+func (s *Server) Reload(ctx context.Context) (*dto.ReloadConfigRespDto, error) {
+	if s.ConfigLoader == nil {
+		return nil, e.NewBusinessError(e.WithMsg("config reload is not supported, the server has no config loader"))
+	}
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	newConfig, err := s.ConfigLoader()
+	if err != nil {
+		return nil, err
+	}
+	if err = checkReloadConfig(newConfig); err != nil {
+		return nil, err
+	}
+
+	result := &dto.ReloadConfigRespDto{
+		Applied:  make([]*dto.ConfigChangeDto, 0),
+		Rejected: make([]*dto.ConfigChangeDto, 0),
+	}
+	old := s.Config
+	applied := func(setting string, from, to interface{}) bool {
+		change := newConfigChangeDto(setting, from, to)
+		if change != nil {
+			result.Applied = append(result.Applied, change)
+		}
+		return change != nil
+	}
+	rejected := func(setting string, from, to interface{}) {
+		if change := newConfigChangeDto(setting, from, to); change != nil {
+			result.Rejected = append(result.Rejected, change)
+		}
+	}
+
+	rateLimitEnableChanged := applied("rate_limit.enable", old.RateLimit.Enable, newConfig.RateLimit.Enable)
+	rateLimitQpsChanged := applied("rate_limit.qps", old.RateLimit.Qps, newConfig.RateLimit.Qps)
+	if rateLimitEnableChanged || rateLimitQpsChanged {
+		s.IrisApp.RateLimiter.Update(newConfig.RateLimit)
+		old.RateLimit = newConfig.RateLimit
+	}
+	if applied("log_level", old.LogLevel, newConfig.LogLevel) {
+		s.LogLevel.SetLevel(log.NewLogLevel(newConfig.LogLevel).Level())
+		old.LogLevel = newConfig.LogLevel
+	}
+	if !maps.Equal(old.AdminTokens, newConfig.AdminTokens) {
+		// only the operators are reported, a changed token of the same operators is marked
+		from, to := adminOperators(old.AdminTokens), adminOperators(newConfig.AdminTokens)
+		if from == to {
+			to += " (tokens changed)"
+		}
+		applied("admin_tokens", from, to)
+		s.IrisApp.AdminAuth.Update(newConfig.AdminTokens)
+		old.AdminTokens = newConfig.AdminTokens
+	}
+	if applied("redis_batch_alloc_num", old.RedisBatchAllocNum, newConfig.RedisBatchAllocNum) {
+		s.RedisAllocHandler.SetBatchAllocNum(newConfig.RedisBatchAllocNum)
+		old.RedisBatchAllocNum = newConfig.RedisBatchAllocNum
+	}
+	writeDBChanged := applied("write_db_every_n_version", old.WriteDBEveryNVersion, newConfig.WriteDBEveryNVersion)
+	recoverRedisChanged := applied("recover_redis_every_n_version", old.RecoverRedisEveryNVersion, newConfig.RecoverRedisEveryNVersion)
+	if writeDBChanged || recoverRedisChanged {
+		s.RedisAllocHandler.SetSyncEveryNVersion(newConfig.WriteDBEveryNVersion, newConfig.RecoverRedisEveryNVersion)
+		old.WriteDBEveryNVersion = newConfig.WriteDBEveryNVersion
+		old.RecoverRedisEveryNVersion = newConfig.RecoverRedisEveryNVersion
+	}
+
+	rejected("app_name", old.AppName, newConfig.AppName)
+	rejected("server_port", old.ServerPort, newConfig.ServerPort)
+	rejected("use_pprof", old.UsePprof, newConfig.UsePprof)
+	rejected("use_prometheus", old.UsePrometheus, newConfig.UsePrometheus)
+	rejected("tracing", old.Tracing, newConfig.Tracing)
+	rejected("redis_key_prefix", old.RedisKeyPrefix, newConfig.RedisKeyPrefix)
+	rejected("sync_redis_and_db_chan_size", old.SyncRedisAndDBChanSize, newConfig.SyncRedisAndDBChanSize)
+	rejected("sync_redis_and_db_thread_num", old.SyncRedisAndDBThreadNum, newConfig.SyncRedisAndDBThreadNum)
+	rejected("idempotent_key_expire", old.IdempotentKeyExpire, newConfig.IdempotentKeyExpire)
+	rejected("reject_unknown_service", old.RejectUnknownService, newConfig.RejectUnknownService)
+	rejected("service_registry_refresh_interval", old.ServiceRegistryRefreshInterval, newConfig.ServiceRegistryRefreshInterval)
+	rejected("warmup_mode", old.WarmupMode, newConfig.WarmupMode)
+	rejected("warmup_service_names", old.WarmupServiceNames, newConfig.WarmupServiceNames)
+	rejected("warmup_concurrency", old.WarmupConcurrency, newConfig.WarmupConcurrency)
+	rejected("warmup_qps", old.WarmupQps, newConfig.WarmupQps)
+	rejected("shutdown_readiness_delay", old.ShutdownReadinessDelay, newConfig.ShutdownReadinessDelay)
+	rejected("service_handler_idle_timeout", old.ServiceHandlerIdleTimeout, newConfig.ServiceHandlerIdleTimeout)
+	rejected("max_service_handler_num", old.MaxServiceHandlerNum, newConfig.MaxServiceHandlerNum)
+	rejected("consistency_check_interval", old.ConsistencyCheckInterval, newConfig.ConsistencyCheckInterval)
+	rejected("consistency_auto_repair", old.ConsistencyAutoRepair, newConfig.ConsistencyAutoRepair)
+	rejected("segment_journal", old.SegmentJournal, newConfig.SegmentJournal)
+	rejected("ledger", old.Ledger, newConfig.Ledger)
+	rejected("exhaustion_forecast", old.ExhaustionForecast, newConfig.ExhaustionForecast)
+
+	for _, change := range result.Applied {
+		log.WithContext(ctx).Infow("ReloadConfigApplied", "setting", change.Setting, "from", change.From, "to", change.To)
+	}
+	for _, change := range result.Rejected {
+		log.WithContext(ctx).Warnw("ReloadConfigRejected", "setting", change.Setting, "from", change.From, "to", change.To,
+			"reason", "restart required, the old value is kept")
+	}
+	return result, nil
+}
+
+// checkReloadConfig: the settings applied by a reload must be valid, they are not replaced by their defaults
+func checkReloadConfig(config *definition.Config) error {
+	if config.RateLimit.Enable && config.RateLimit.Qps <= 0 {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("config invalid. rate_limit.qps must be positive, input:%d", config.RateLimit.Qps)))
+	}
+	switch strings.ToUpper(config.LogLevel) {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+	default:
+		return e.NewParamError(e.WithMsg("config invalid. unknown log_level: " + config.LogLevel))
+	}
+	if config.RedisBatchAllocNum < definition.MAX_USER_BATCH_ALLOC_NUM {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf(
+			"config invalid. redis_batch_alloc_num min: %d input:%d", definition.MAX_USER_BATCH_ALLOC_NUM, config.RedisBatchAllocNum,
+		)))
+	}
+	if config.WriteDBEveryNVersion <= 0 || config.RecoverRedisEveryNVersion <= 0 {
+		return e.NewParamError(e.WithMsg("config invalid. write_db_every_n_version and recover_redis_every_n_version must be positive"))
+	}
+	return nil
+}
+
+// adminOperators: the operators of the admin tokens, the tokens are never reported
+func adminOperators(tokens map[string]string) string {
+	operators := make([]string, 0, len(tokens))
+	for operator := range tokens {
+		operators = append(operators, operator)
+	}
+	sort.Strings(operators)
+	return fmt.Sprintf("%v", operators)
+}
+
+// newConfigChangeDto: nil if the setting is not changed
+func newConfigChangeDto(setting string, from, to interface{}) *dto.ConfigChangeDto {
+	fromStr, toStr := fmt.Sprintf("%+v", from), fmt.Sprintf("%+v", to)
+	if fromStr == toStr {
+		return nil
+	}
+	return &dto.ConfigChangeDto{Setting: setting, From: fromStr, To: toStr}
+}
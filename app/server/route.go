@@ -2,9 +2,33 @@ package server
 
 import (
 	iris "github.com/daemon-coder/idalloc/infrastructure/iris_infra"
-	"github.com/daemon-coder/idalloc/transport"
 )
 
-func AddRoute(app *iris.IrisApp) {
-	app.Handle("POST", "/alloc", iris.JsonWrapper(transport.Alloc))
+func (s *Server) AddRoute(app *iris.IrisApp) {
+	app.Handle("POST", "/alloc", iris.JsonWrapper(s.Transport.Alloc))
+	app.Handle("POST", "/alloc/batch", iris.JsonWrapper(s.Transport.BatchAlloc))
+	app.Handle("POST", "/verify", iris.JsonWrapper(s.Transport.Verify))
+	app.Handle("GET", "/healthz", iris.JsonWrapper(s.Transport.Healthz))
+	app.Handle("GET", "/readyz", iris.JsonWrapper(s.Transport.Readyz))
+
+	s.AddAdminRoute(app)
+}
+
+func (s *Server) AddAdminRoute(app *iris.IrisApp) {
+	admin := app.Party("/admin", app.AdminAuth.Middleware())
+	admin.Handle("GET", "/services", iris.JsonWrapper(s.Transport.ListServices))
+	admin.Handle("POST", "/services", iris.JsonWrapper(s.Transport.CreateService))
+	admin.Handle("GET", "/services/{serviceName:string}", iris.JsonWrapper(s.Transport.GetServiceState))
+	admin.Handle("POST", "/services/{serviceName:string}/counter", iris.JsonWrapper(s.Transport.AdvanceCounter))
+	admin.Handle("POST", "/services/{serviceName:string}/recover", iris.JsonWrapper(s.Transport.RecoverService))
+	admin.Handle("GET", "/services/{serviceName:string}/ledger", iris.JsonWrapper(s.Transport.FindLedger))
+	admin.Handle("POST", "/services/{serviceName:string}/freeze", iris.JsonWrapper(s.Transport.FreezeService))
+	admin.Handle("POST", "/services/{serviceName:string}/activate", iris.JsonWrapper(s.Transport.ActivateService))
+	admin.Handle("POST", "/services/{serviceName:string}/retire", iris.JsonWrapper(s.Transport.RetireService))
+	admin.Handle("POST", "/consistency/check", iris.JsonWrapper(s.Transport.CheckConsistency))
+	admin.Handle("GET", "/consistency/report", iris.JsonWrapper(s.Transport.GetConsistencyReport))
+	admin.Handle("POST", "/config/reload", iris.JsonWrapper(s.Transport.ReloadConfig))
+	admin.Handle("GET", "/snapshot", iris.JsonWrapper(s.Transport.ExportSnapshot))
+	admin.Handle("POST", "/snapshot/import", iris.JsonWrapper(s.Transport.ImportSnapshot))
+	admin.Handle("GET", "/waste", iris.JsonWrapper(s.Transport.GetWasteReport))
 }
@@ -4,54 +4,133 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/daemon-coder/idalloc/definition"
-	db "github.com/daemon-coder/idalloc/infrastructure/db_infra"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/daemon-coder/idalloc/endpoint"
 	iris "github.com/daemon-coder/idalloc/infrastructure/iris_infra"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
-	redis "github.com/daemon-coder/idalloc/infrastructure/redis_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
+	"github.com/daemon-coder/idalloc/repository"
 	"github.com/daemon-coder/idalloc/service"
+	"github.com/daemon-coder/idalloc/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.uber.org/zap"
 )
 
+// Server: all the state of an idalloc instance, several servers can run in one process
 type Server struct {
-	Config  *definition.Config
+	Config *definition.Config
+	// Context: carries the logger of the server, it is canceled when a shutdown signal is received
 	Context context.Context
 	Cancel  context.CancelFunc
 	Stopped chan struct{}
+	// Registry: the prometheus registry of the server, exposed on /metrics if UsePrometheus is set
+	Registry *prometheus.Registry
+	Store    *repository.Store
+	Logger   *zap.Logger
+	LogLevel zap.AtomicLevel
 
-	IrisApp           *iris.IrisApp
-	AllocHandler      *service.AllocHandler
-	RedisAllocHandler *service.RedisAllocHandler
+	IrisApp            *iris.IrisApp
+	AllocHandler       *service.AllocHandler
+	RedisAllocHandler  *service.RedisAllocHandler
+	ServiceRegistry    *service.ServiceRegistry
+	HealthChecker      *service.HealthChecker
+	ConsistencyChecker *service.ConsistencyChecker
+	Transport          *transport.Transport
+
+	// ConfigLoader: used by Reload on SIGHUP or the admin api, reload is not supported if it is nil
+	ConfigLoader ConfigLoader
+	reloadLock   sync.Mutex
 }
 
 func NewServer(config *definition.Config) *Server {
 	CheckConfig(config)
-	definition.Cfg = config
-	db.DBClient = config.DB
-	redis.RedisClient = config.Redis
-
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Server{
-		Config:  config,
-		Context: ctx,
-		Cancel:  cancel,
-		Stopped: make(chan struct{}),
-
-		IrisApp:           iris.NewIrisApp(config, AddRoute),
-		AllocHandler:      service.InitAllocHandler(),
-		RedisAllocHandler: service.InitRedisAllocHandler(config),
+	logLevel := log.NewLogLevel(config.LogLevel)
+	logger, err := log.NewZapLogger(logLevel)
+	if err != nil {
+		e.FromStdError(err).Panic()
 	}
-}
+	// the handlers are not derived from Context, so that they keep serving until the shutdown drains them
+	baseCtx := log.WithLogger(context.Background(), logger)
+	store := repository.NewStore(config.Redis, config.DB, config.RedisKeyPrefix)
 
-func (s *Server) Run() {
-	s.RedisAllocHandler.Start()
-	s.AllocHandler.Start()
-	s.IrisApp.Start(s.Config)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	metrics := service.NewMetrics(registry, config.AppName)
+	traceInfra.InitTracerProvider(config)
+
+	redisAllocHandler := service.NewRedisAllocHandler(baseCtx, config, store, metrics)
+	serviceRegistry := service.NewServiceRegistry(baseCtx, config, store)
+	allocHandler := service.NewAllocHandler(baseCtx, config, store, redisAllocHandler, serviceRegistry, metrics)
+	healthChecker := service.NewHealthChecker(store, allocHandler, redisAllocHandler)
+	consistencyChecker := service.NewConsistencyChecker(baseCtx, config, store, allocHandler, metrics)
 
+	ctx, cancel := context.WithCancel(baseCtx)
+	s := &Server{
+		Config:   config,
+		Context:  ctx,
+		Cancel:   cancel,
+		Stopped:  make(chan struct{}),
+		Registry: registry,
+		Store:    store,
+		Logger:   logger,
+		LogLevel: logLevel,
+
+		AllocHandler:       allocHandler,
+		RedisAllocHandler:  redisAllocHandler,
+		ServiceRegistry:    serviceRegistry,
+		HealthChecker:      healthChecker,
+		ConsistencyChecker: consistencyChecker,
+	}
+	s.Transport = transport.NewTransport(endpoint.NewEndpoint(allocHandler, serviceRegistry, healthChecker, consistencyChecker, s.Reload))
+	s.IrisApp = iris.NewIrisApp(baseCtx, config, registry, s.AddRoute)
+	return s
+}
+
+// Run: start the server and block until it is shutdown by a signal
+func (s *Server) Run() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
 	s.HandleSignal()
 	s.ShutdownWait(20 * time.Second)
+	return nil
+}
+
+// Start: if a handler fails to start, the handlers started before are shutdown and the error is returned
+func (s *Server) Start() error {
+	if err := s.RedisAllocHandler.OpenJournal(s.Context); err != nil {
+		log.WithContext(s.Context).Errorw("OpenSegmentJournalFailed", "err", err)
+		traceInfra.Shutdown()
+		return err
+	}
+	s.RedisAllocHandler.Start()
+	if err := s.ServiceRegistry.Start(); err != nil {
+		log.WithContext(s.Context).Errorw("StartServiceRegistryFailed", "err", err)
+		s.ServiceRegistry.Shutdown()
+		s.RedisAllocHandler.Shutdown()
+		traceInfra.Shutdown()
+		return err
+	}
+	if err := s.AllocHandler.Start(); err != nil {
+		log.WithContext(s.Context).Errorw("StartAllocHandlerFailed", "err", err)
+		s.AllocHandler.Shutdown()
+		s.ServiceRegistry.Shutdown()
+		s.RedisAllocHandler.Shutdown()
+		traceInfra.Shutdown()
+		return err
+	}
+	s.ConsistencyChecker.Start()
+	s.IrisApp.Start(s.Config)
+	return nil
 }
 
 func (s *Server) ShutdownWait(wait time.Duration) {
@@ -66,11 +145,21 @@ func (s *Server) ShutdownWait(wait time.Duration) {
 }
 
 func (s *Server) Shutdown() {
+	// report not ready first, and keep serving for a while until the traffic is drained
+	s.HealthChecker.MarkShuttingDown()
+	if s.Config.ShutdownReadinessDelay > 0 {
+		log.WithContext(s.Context).Infow("ShutdownReadinessDelay", "delay", s.Config.ShutdownReadinessDelay.String())
+		time.Sleep(s.Config.ShutdownReadinessDelay)
+	}
+
 	// the order is important, the iris should be shutdown first
 	s.IrisApp.Shutdown()
 	<-s.IrisApp.Stopped
+	s.ConsistencyChecker.Shutdown()
 	s.AllocHandler.Shutdown()
+	s.ServiceRegistry.Shutdown()
 	s.RedisAllocHandler.Shutdown()
+	traceInfra.Shutdown()
 
 	close(s.Stopped)
 }
@@ -80,10 +169,14 @@ func (s *Server) HandleSignal() {
 	signal.Notify(signalChan, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 	for {
 		sig := <-signalChan
-		log.GetLogger().Infow("ReceiveSignal", "signal", sig.String())
+		log.WithContext(s.Context).Infow("ReceiveSignal", "signal", sig.String())
 		switch sig {
-		case syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2:
-			log.GetLogger().Infow("IgnoreSignal", "signal", sig.String())
+		case syscall.SIGHUP:
+			if _, err := s.Reload(s.Context); err != nil {
+				log.WithContext(s.Context).Errorw("ReloadConfigFailed", "err", err)
+			}
+		case syscall.SIGUSR1, syscall.SIGUSR2:
+			log.WithContext(s.Context).Infow("IgnoreSignal", "signal", sig.String())
 			continue
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
 			s.Cancel()
@@ -0,0 +1,100 @@
+// idalloc: runs an idalloc server configured by a config file, env vars and flags.
+//
+//	idalloc -config idalloc.yaml -server-port 8081
+//
+// Every setting of the config file can be overridden by an env var like IDALLOC_RATE_LIMIT_QPS,
+// and then by a flag like -rate-limit-qps. Run idalloc -h for the list.
+//
+// On SIGHUP or POST /admin/config/reload, the config is loaded again and the settings safe to change
+// while serving are applied: rate_limit, log_level, redis_batch_alloc_num, write_db_every_n_version
+// and recover_redis_every_n_version. The changes of the other settings are logged and take effect after a restart.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/daemon-coder/idalloc/app/server"
+	"github.com/daemon-coder/idalloc/definition"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	configInfra "github.com/daemon-coder/idalloc/infrastructure/config_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	source, err := configInfra.ParseFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		printError(err)
+		return 2
+	}
+	fileConfig, err := source.Load()
+	if err != nil {
+		printError(err)
+		return 2
+	}
+	if source.PrintConfig {
+		fmt.Print(fileConfig.Masked().Yaml())
+		if err = fileConfig.Validate(); err != nil {
+			printError(err)
+			return 2
+		}
+		return 0
+	}
+	if err = fileConfig.Validate(); err != nil {
+		printError(err)
+		return 2
+	}
+	log.GetLogger().Infow("EffectiveConfig", fileConfig.Masked().LogFields()...)
+
+	config, err := fileConfig.Open(context.Background())
+	if err != nil {
+		log.GetLogger().Errorw("OpenStoresFailed", "err", err)
+		return 1
+	}
+	defer config.DB.Close()
+	defer config.Redis.Close()
+
+	idallocServer := server.NewServer(config)
+	idallocServer.ConfigLoader = func() (*definition.Config, error) {
+		return reloadConfig(source, fileConfig)
+	}
+	if err = idallocServer.Run(); err != nil {
+		log.GetLogger().Errorw("RunServerFailed", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// reloadConfig: the stores are not reopened on a reload, a change of the DSNs only takes effect after a restart
+func reloadConfig(source *configInfra.Source, initial *configInfra.FileConfig) (*definition.Config, error) {
+	fileConfig, err := source.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err = fileConfig.Validate(); err != nil {
+		return nil, err
+	}
+	masked, initialMasked := fileConfig.Masked(), initial.Masked()
+	if fileConfig.RedisDSN != initial.RedisDSN {
+		log.GetLogger().Warnw("ReloadConfigRejected", "setting", "redis_dsn", "from", initialMasked.RedisDSN, "to", masked.RedisDSN,
+			"reason", "restart required, the old value is kept")
+	}
+	if fileConfig.MysqlDSN != initial.MysqlDSN {
+		log.GetLogger().Warnw("ReloadConfigRejected", "setting", "mysql_dsn", "from", initialMasked.MysqlDSN, "to", masked.MysqlDSN,
+			"reason", "restart required, the old value is kept")
+	}
+	return fileConfig.ToConfig(), nil
+}
+
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, e.FromStdError(err).Msg)
+}
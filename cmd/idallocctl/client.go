@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+)
+
+const HTTP_TIMEOUT = 30 * time.Second
+
+// Client: the operations of idallocctl, served by the admin api of a running server or by the stores directly
+type Client interface {
+	Alloc(ctx context.Context, param dto.AllocReqDto) (dto.AllocRespDto, error)
+	ListServices(ctx context.Context) (dto.ListServicesRespDto, error)
+	GetServiceState(ctx context.Context, param dto.GetServiceStateReqDto) (*dto.ServiceStateDto, error)
+	RecoverService(ctx context.Context, param dto.RecoverServiceReqDto) (*dto.ServiceStateDto, error)
+	FindLedger(ctx context.Context, param dto.FindLedgerReqDto) (dto.FindLedgerRespDto, error)
+	Verify(ctx context.Context, param dto.VerifyReqDto) (dto.VerifyRespDto, error)
+	AdvanceCounter(ctx context.Context, param dto.AdvanceCounterReqDto) (dto.AdvanceCounterRespDto, error)
+	CheckConsistency(ctx context.Context, param dto.CheckConsistencyReqDto) (*dto.ConsistencyReportDto, error)
+	ExportSnapshot(ctx context.Context) (*entity.Snapshot, error)
+	ImportSnapshot(ctx context.Context, param dto.ImportSnapshotReqDto) (*dto.ImportSnapshotRespDto, error)
+	Close()
+}
+
+// httpClient: talks to the api of a running server, the admin api takes the token of an operator
+type httpClient struct {
+	baseUrl string
+	token   string
+	client  *http.Client
+}
+
+func newHttpClient(baseUrl, token string) *httpClient {
+	return &httpClient{
+		baseUrl: strings.TrimRight(baseUrl, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: HTTP_TIMEOUT},
+	}
+}
+
+func (c *httpClient) Alloc(ctx context.Context, param dto.AllocReqDto) (result dto.AllocRespDto, err error) {
+	err = c.do(ctx, http.MethodPost, "/alloc", param, &result)
+	return
+}
+
+func (c *httpClient) ListServices(ctx context.Context) (result dto.ListServicesRespDto, err error) {
+	err = c.do(ctx, http.MethodGet, "/admin/services", nil, &result)
+	return
+}
+
+func (c *httpClient) GetServiceState(ctx context.Context, param dto.GetServiceStateReqDto) (*dto.ServiceStateDto, error) {
+	var result dto.ServiceStateDto
+	if err := c.do(ctx, http.MethodGet, "/admin/services/"+url.PathEscape(param.ServiceName), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *httpClient) RecoverService(ctx context.Context, param dto.RecoverServiceReqDto) (*dto.ServiceStateDto, error) {
+	var result dto.ServiceStateDto
+	if err := c.do(ctx, http.MethodPost, "/admin/services/"+url.PathEscape(param.ServiceName)+"/recover", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *httpClient) FindLedger(ctx context.Context, param dto.FindLedgerReqDto) (result dto.FindLedgerRespDto, err error) {
+	path := fmt.Sprintf("/admin/services/%s/ledger?id=%s", url.PathEscape(param.ServiceName), url.QueryEscape(param.Id.String()))
+	err = c.do(ctx, http.MethodGet, path, nil, &result)
+	return
+}
+
+func (c *httpClient) Verify(ctx context.Context, param dto.VerifyReqDto) (result dto.VerifyRespDto, err error) {
+	err = c.do(ctx, http.MethodPost, "/verify", param, &result)
+	return
+}
+
+func (c *httpClient) AdvanceCounter(ctx context.Context, param dto.AdvanceCounterReqDto) (result dto.AdvanceCounterRespDto, err error) {
+	err = c.do(ctx, http.MethodPost, "/admin/services/"+url.PathEscape(param.ServiceName)+"/counter", param, &result)
+	return
+}
+
+func (c *httpClient) CheckConsistency(ctx context.Context, param dto.CheckConsistencyReqDto) (*dto.ConsistencyReportDto, error) {
+	var result dto.ConsistencyReportDto
+	if err := c.do(ctx, http.MethodPost, "/admin/consistency/check", param, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *httpClient) ExportSnapshot(ctx context.Context) (*entity.Snapshot, error) {
+	var result entity.Snapshot
+	if err := c.do(ctx, http.MethodGet, "/admin/snapshot", nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *httpClient) ImportSnapshot(ctx context.Context, param dto.ImportSnapshotReqDto) (*dto.ImportSnapshotRespDto, error) {
+	var result dto.ImportSnapshotRespDto
+	if err := c.do(ctx, http.MethodPost, "/admin/snapshot/import", param, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *httpClient) Close() {
+	c.client.CloseIdleConnections()
+}
+
+// do: the error in the result is returned as a BaseError with the same code and msg
+func (c *httpClient) do(ctx context.Context, method, path string, reqDto interface{}, respDto interface{}) error {
+	var body io.Reader
+	if reqDto != nil {
+		content, err := json.Marshal(reqDto)
+		if err != nil {
+			return e.NewParamError(e.WithMsg(err.Error()))
+		}
+		body = bytes.NewReader(content)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, body)
+	if err != nil {
+		return e.NewParamError(e.WithMsg("server is invalid: " + err.Error()))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return e.NewServerError(e.WithMsg("request failed: " + err.Error()))
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return e.NewServerError(e.WithMsg("read response failed: " + err.Error()))
+	}
+
+	var result struct {
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(content, &result); err != nil {
+		return e.NewServerError(e.WithMsg(fmt.Sprintf("unexpected response. status:%d body:%s", resp.StatusCode, content)))
+	}
+	if result.Code != e.OK {
+		return e.New(
+			result.Code/1e3%1e3,
+			e.WithScope(result.Code/1e6),
+			e.WithCode(result.Code%1e3),
+			e.WithMsg(result.Msg),
+			e.WithData(result.Data),
+		)
+	}
+	if err = json.Unmarshal(result.Data, respDto); err != nil {
+		return e.NewServerError(e.WithMsg("unexpected response data: " + err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/endpoint"
+	configInfra "github.com/daemon-coder/idalloc/infrastructure/config_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+// directClient: works on redis and mysql with the handlers of a server, so the key layout and the
+// rules are the same. Unlike a server it does not recover all the counters or warm up on start.
+type directClient struct {
+	*endpoint.Endpoint
+	ctx                context.Context
+	config             *def.Config
+	consistencyChecker *service.ConsistencyChecker
+	allocHandler       *service.AllocHandler
+	serviceRegistry    *service.ServiceRegistry
+	redisAllocHandler  *service.RedisAllocHandler
+}
+
+// newDirectClient: the stores are given by the config of the servers, loaded from configPath and the IDALLOC_* env vars
+func newDirectClient(ctx context.Context, configPath string) (*directClient, error) {
+	fileConfig, err := (&configInfra.Source{Path: configPath}).Load()
+	if err != nil {
+		return nil, err
+	}
+	if err = fileConfig.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := fileConfig.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the ids left in the segment are dropped on exit, so fetch as few as possible
+	config.RedisBatchAllocNum = def.MAX_USER_BATCH_ALLOC_NUM
+	config.SyncRedisAndDBThreadNum = 1
+	// the segment journal belongs to the server on the host of the config
+	config.SegmentJournal.Dir = ""
+	hostname, _ := os.Hostname()
+	config.InstanceId = "idallocctl@" + hostname
+	// the ledger is pruned by the servers
+	config.Ledger.Retention = 0
+	// the forecasts are checked by the servers, which see the increments of the services
+	config.ExhaustionForecast.CheckInterval = 0
+
+	store := repository.NewStore(config.Redis, config.DB, config.RedisKeyPrefix)
+	redisAllocHandler := service.NewRedisAllocHandler(ctx, config, store, nil)
+	serviceRegistry := service.NewServiceRegistry(ctx, config, store)
+	allocHandler := service.NewAllocHandler(ctx, config, store, redisAllocHandler, serviceRegistry, nil)
+	// the checks are run on demand only
+	consistencyChecker := service.NewConsistencyChecker(ctx, config, store, allocHandler, nil)
+	client := &directClient{
+		Endpoint:           endpoint.NewEndpoint(allocHandler, serviceRegistry, nil, consistencyChecker, nil),
+		ctx:                ctx,
+		config:             config,
+		consistencyChecker: consistencyChecker,
+		allocHandler:       allocHandler,
+		serviceRegistry:    serviceRegistry,
+		redisAllocHandler:  redisAllocHandler,
+	}
+
+	// the sync goroutines write the counters of the new segments to db, they are drained on Close
+	redisAllocHandler.Start()
+	if err = serviceRegistry.Reload(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *directClient) Close() {
+	// the order is important, the alloc handler uses the others
+	c.consistencyChecker.Shutdown()
+	c.allocHandler.Shutdown()
+	c.serviceRegistry.Shutdown()
+	c.redisAllocHandler.Shutdown()
+	if err := c.config.DB.Close(); err != nil {
+		log.WithContext(c.ctx).Warnw("CloseDBFailed", "err", err)
+	}
+	if err := c.config.Redis.Close(); err != nil {
+		log.WithContext(c.ctx).Warnw("CloseRedisFailed", "err", err)
+	}
+}
@@ -0,0 +1,428 @@
+// idallocctl: the command line tool for the operators of idalloc.
+//
+//	idallocctl -server http://127.0.0.1:8080 services
+//	idallocctl -config idalloc.yaml state order
+//
+// With -server it talks to the api of a running server, the admin commands take the token of the operator from
+// IDALLOC_ADMIN_TOKEN. With -config it works on redis and mysql directly, using the config file and the IDALLOC_*
+// env vars of the servers. Run idallocctl -h for the commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+const USAGE = `Usage: idallocctl (-server URL | -config FILE) COMMAND [ARGS]
+
+Commands:
+  alloc SERVICE [COUNT]                     allocate COUNT ids, 1 by default
+  services                                  list the services with their counters in redis and db
+  state SERVICE                             show the counters of a service in redis and db
+  check [-repair -operator NAME] [SERVICE...]
+                                            check that redis is not behind db nor the segments held,
+                                            all services by default. -repair moves the counters forward
+  recover SERVICE                           recover the counter in redis from db if redis is behind
+  who SERVICE ID                            show which instances issued the id, from the ledger
+  verify SERVICE ID...                      check whether the ids have been issued, exits with 1 if any is not
+  bump [-force] -operator NAME [-reason TEXT] SERVICE LAST_ALLOC_VALUE
+                                            set the counter, the next id allocated is LAST_ALLOC_VALUE+1
+  export [FILE]                             write the counters and the status of all services to FILE,
+                                            stdout by default
+  import -operator NAME [-reason TEXT] FILE
+                                            move the counters forward to the ones in the exported FILE,
+                                            the unknown services are registered
+
+With -server the commands other than alloc and verify take the admin token of the operator from the
+IDALLOC_ADMIN_TOKEN env var, and -operator is the operator of the token.
+
+Options:
+`
+
+// exit codes: 1 if the command fails or check finds problems, 2 if the usage is wrong
+const (
+	EXIT_FAILED = 1
+	EXIT_USAGE  = 2
+)
+
+// ADMIN_TOKEN_ENV: the admin token is not taken by a flag, so that it is not seen in the process list
+const ADMIN_TOKEN_ENV = "IDALLOC_ADMIN_TOKEN"
+
+type command func(ctx context.Context, client Client, args []string, stdout io.Writer) (exitCode int, err error)
+
+var commands = map[string]command{
+	"alloc":    allocCommand,
+	"services": servicesCommand,
+	"state":    stateCommand,
+	"check":    checkCommand,
+	"recover":  recoverCommand,
+	"who":      whoCommand,
+	"verify":   verifyCommand,
+	"bump":     bumpCommand,
+	"export":   exportCommand,
+	"import":   importCommand,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flagSet := flag.NewFlagSet("idallocctl", flag.ContinueOnError)
+	flagSet.SetOutput(stderr)
+	server := flagSet.String("server", "", "base url of a running server, e.g. http://127.0.0.1:8080")
+	configPath := flagSet.String("config", "", "config file of the servers, to work on redis and mysql directly")
+	logLevel := flagSet.String("log-level", "WARN", "level of the logs written to stderr")
+	flagSet.Usage = func() {
+		fmt.Fprint(stderr, USAGE)
+		flagSet.PrintDefaults()
+	}
+	if err := flagSet.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		return EXIT_USAGE
+	}
+	if flagSet.NArg() == 0 {
+		flagSet.Usage()
+		return EXIT_USAGE
+	}
+	cmd, ok := commands[flagSet.Arg(0)]
+	if !ok {
+		fmt.Fprintln(stderr, "unknown command: "+flagSet.Arg(0))
+		flagSet.Usage()
+		return EXIT_USAGE
+	}
+
+	logger, err := log.NewZapLogger(log.NewLogLevel(*logLevel), "stderr")
+	if err != nil {
+		printError(stderr, err)
+		return EXIT_FAILED
+	}
+	defer logger.Sync()
+	ctx := log.WithLogger(context.Background(), logger)
+
+	var client Client
+	switch {
+	case *server != "" && *configPath != "":
+		fmt.Fprintln(stderr, "-server and -config can not be used together")
+		return EXIT_USAGE
+	case *server != "":
+		client = newHttpClient(*server, os.Getenv(ADMIN_TOKEN_ENV))
+	case *configPath != "":
+		if client, err = newDirectClient(ctx, *configPath); err != nil {
+			printError(stderr, err)
+			return EXIT_FAILED
+		}
+	default:
+		fmt.Fprintln(stderr, "either -server or -config is required")
+		return EXIT_USAGE
+	}
+	defer client.Close()
+
+	exitCode, err := cmd(ctx, client, flagSet.Args()[1:], stdout)
+	if err != nil {
+		printError(stderr, err)
+	}
+	return exitCode
+}
+
+func allocCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return EXIT_USAGE, usageError("alloc SERVICE [COUNT]")
+	}
+	count := int64(1)
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			return EXIT_USAGE, e.NewParamError(e.WithMsg("COUNT must be an integer, input:" + args[1]))
+		}
+	}
+	result, err := client.Alloc(ctx, dto.AllocReqDto{ServiceName: args[0], Count: count})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	for _, id := range result.Ids {
+		fmt.Fprintln(stdout, id)
+	}
+	return 0, nil
+}
+
+func servicesCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) != 0 {
+		return EXIT_USAGE, usageError("services")
+	}
+	result, err := client.ListServices(ctx)
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVICE\tSTATUS\tREDIS\tREDIS_VERSION\tDB\tDB_VERSION\tLOADED")
+	for _, state := range result.Services {
+		redisValue, redisVersion := formatAllocInfo(state.Redis, state.RedisError)
+		dbValue, dbVersion := formatAllocInfo(state.DB, "")
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			state.ServiceName, orDash(state.Status), redisValue, redisVersion, dbValue, dbVersion, state.Loaded)
+	}
+	return 0, writer.Flush()
+}
+
+func stateCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) != 1 {
+		return EXIT_USAGE, usageError("state SERVICE")
+	}
+	result, err := client.GetServiceState(ctx, dto.GetServiceStateReqDto{ServiceName: args[0]})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	return 0, printJson(stdout, result)
+}
+
+// checkCommand: prints a line for every problem found, and exits with EXIT_FAILED if any of them is not repaired
+func checkCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	flagSet := flag.NewFlagSet("check", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	repair := flagSet.Bool("repair", false, "repair the problems by moving the counters forward")
+	operator := flagSet.String("operator", "", "who does it, written to the audit log, required to repair")
+	if err := flagSet.Parse(args); err != nil {
+		return EXIT_USAGE, usageError("check [-repair -operator NAME] [SERVICE...]")
+	}
+	report, err := client.CheckConsistency(ctx, dto.CheckConsistencyReqDto{
+		ServiceNames: flagSet.Args(),
+		Repair:       *repair,
+		Operator:     *operator,
+	})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+
+	unrepairedNum := 0
+	for _, issue := range report.Issues {
+		result := ""
+		if issue.Repaired {
+			result = "\trepaired"
+		} else if report.Repair {
+			result = "\tnot repaired: " + issue.RepairError
+		}
+		if !issue.Repaired {
+			unrepairedNum++
+		}
+		fmt.Fprintf(stdout, "%s\t%s\t%s%s\n", issue.ServiceName, issue.Kind, issue.Detail, result)
+	}
+	fmt.Fprintf(stdout, "checked %d services, %d problems found, %d not repaired\n", report.ServiceNum, len(report.Issues), unrepairedNum)
+	if unrepairedNum > 0 {
+		return EXIT_FAILED, nil
+	}
+	return 0, nil
+}
+
+func recoverCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) != 1 {
+		return EXIT_USAGE, usageError("recover SERVICE")
+	}
+	result, err := client.RecoverService(ctx, dto.RecoverServiceReqDto{ServiceName: args[0]})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	return 0, printJson(stdout, result)
+}
+
+// whoCommand: exits with EXIT_FAILED if the id is not in the ledger
+func whoCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) != 2 {
+		return EXIT_USAGE, usageError("who SERVICE ID")
+	}
+	// the range depends on the id type of the service, it is checked by the server
+	if _, err := strconv.ParseUint(args[1], 10, 64); err != nil {
+		return EXIT_USAGE, e.NewParamError(e.WithMsg("ID must be a positive integer, input:" + args[1]))
+	}
+	result, err := client.FindLedger(ctx, dto.FindLedgerReqDto{ServiceName: args[0], Id: json.Number(args[1])})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	if len(result.Records) == 0 {
+		fmt.Fprintln(stdout, "not found in the ledger, it may be disabled or the records have been pruned")
+		return EXIT_FAILED, nil
+	}
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "INSTANCE\tSTART\tEND\tDATA_VERSION\tTIME")
+	for _, record := range result.Records {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\n", record.InstanceId, entity.FormatValue(record.IdType, record.StartValue),
+			entity.FormatValue(record.IdType, record.EndValue), record.DataVersion,
+			time.UnixMilli(record.CreateTime).Format(time.RFC3339Nano))
+	}
+	if err = writer.Flush(); err != nil {
+		return EXIT_FAILED, err
+	}
+	if len(result.Records) > 1 {
+		fmt.Fprintf(stdout, "the id has been issued %d times\n", len(result.Records))
+	}
+	return 0, nil
+}
+
+func verifyCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) < 2 {
+		return EXIT_USAGE, usageError("verify SERVICE ID...")
+	}
+	ids := make([]json.Number, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if _, err := strconv.ParseUint(arg, 10, 64); err != nil {
+			return EXIT_USAGE, e.NewParamError(e.WithMsg("ID must be a positive integer, input:" + arg))
+		}
+		ids = append(ids, json.Number(arg))
+	}
+	result, err := client.Verify(ctx, dto.VerifyReqDto{ServiceName: args[0], Ids: ids})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+
+	exitCode := 0
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATUS\tINSTANCE\tTIME")
+	for _, item := range result.Results {
+		instanceId, issuedAt := "-", "-"
+		if item.Segment != nil {
+			instanceId, issuedAt = item.Segment.InstanceId, time.UnixMilli(item.Segment.CreateTime).Format(time.RFC3339Nano)
+		} else {
+			exitCode = EXIT_FAILED
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", item.Id, item.Status, instanceId, issuedAt)
+	}
+	return exitCode, writer.Flush()
+}
+
+func bumpCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	flagSet := flag.NewFlagSet("bump", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	force := flagSet.Bool("force", false, "allow moving the counter backwards, which may issue duplicate ids")
+	operator := flagSet.String("operator", "", "who does it, written to the audit log")
+	reason := flagSet.String("reason", "", "why, written to the audit log")
+	usage := "bump [-force] -operator NAME [-reason TEXT] SERVICE LAST_ALLOC_VALUE"
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 2 {
+		return EXIT_USAGE, usageError(usage)
+	}
+	// the range depends on the id type of the service, it is checked by the server
+	if _, err := strconv.ParseUint(flagSet.Arg(1), 10, 64); err != nil {
+		return EXIT_USAGE, e.NewParamError(e.WithMsg("LAST_ALLOC_VALUE must be a non-negative integer, input:" + flagSet.Arg(1)))
+	}
+	result, err := client.AdvanceCounter(ctx, dto.AdvanceCounterReqDto{
+		ServiceName:    flagSet.Arg(0),
+		LastAllocValue: json.Number(flagSet.Arg(1)),
+		Force:          *force,
+		Operator:       *operator,
+		Reason:         *reason,
+	})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	return 0, printJson(stdout, result)
+}
+
+func exportCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	if len(args) > 1 {
+		return EXIT_USAGE, usageError("export [FILE]")
+	}
+	snapshot, err := client.ExportSnapshot(ctx)
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	if len(args) == 0 {
+		return 0, printJson(stdout, snapshot)
+	}
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+	if err = os.WriteFile(args[0], append(content, '\n'), 0644); err != nil {
+		return EXIT_FAILED, e.NewServerError(e.WithMsg("write snapshot failed: " + err.Error()))
+	}
+	fmt.Fprintf(stdout, "exported %d services to %s\n", len(snapshot.Services), args[0])
+	return 0, nil
+}
+
+// importCommand: prints a line for every service not skipped, and exits with EXIT_FAILED if any of them failed
+func importCommand(ctx context.Context, client Client, args []string, stdout io.Writer) (int, error) {
+	flagSet := flag.NewFlagSet("import", flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	operator := flagSet.String("operator", "", "who does it, written to the audit log")
+	reason := flagSet.String("reason", "", "why, written to the audit log")
+	if err := flagSet.Parse(args); err != nil || flagSet.NArg() != 1 {
+		return EXIT_USAGE, usageError("import -operator NAME [-reason TEXT] FILE")
+	}
+	content, err := os.ReadFile(flagSet.Arg(0))
+	if err != nil {
+		return EXIT_FAILED, e.NewParamError(e.WithMsg("read snapshot failed: " + err.Error()))
+	}
+	var snapshot entity.Snapshot
+	if err = json.Unmarshal(content, &snapshot); err != nil {
+		return EXIT_FAILED, e.NewParamError(e.WithMsg("snapshot is invalid: " + err.Error()))
+	}
+	result, err := client.ImportSnapshot(ctx, dto.ImportSnapshotReqDto{
+		Snapshot: &snapshot,
+		Operator: *operator,
+		Reason:   *reason,
+	})
+	if err != nil {
+		return EXIT_FAILED, err
+	}
+
+	for _, item := range result.Results {
+		if item.Result == service.SNAPSHOT_SKIPPED && !item.ServiceCreated {
+			continue
+		}
+		value, version := formatAllocInfo(item.After, "")
+		fmt.Fprintf(stdout, "%s\t%s\t%s\t%s\t%s\n", item.ServiceName, item.Result, value, version, orDash(item.Msg))
+	}
+	fmt.Fprintf(stdout, "%d imported, %d skipped, %d failed\n", result.ImportedNum, result.SkippedNum, result.FailedNum)
+	if result.FailedNum > 0 {
+		return EXIT_FAILED, nil
+	}
+	return 0, nil
+}
+
+func formatAllocInfo(allocInfo *entity.AllocInfo, errMsg string) (string, string) {
+	if errMsg != "" {
+		return "invalid", "invalid"
+	} else if allocInfo == nil || allocInfo.LastAllocValue == nil || allocInfo.DataVersion == nil {
+		return "-", "-"
+	}
+	return entity.FormatValue(allocInfo.IdType, *allocInfo.LastAllocValue), strconv.FormatInt(*allocInfo.DataVersion, 10)
+}
+
+func orDash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
+
+func printJson(stdout io.Writer, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, string(content))
+	return err
+}
+
+func usageError(usage string) error {
+	return e.NewParamError(e.WithMsg("usage: idallocctl (-server URL | -config FILE) " + usage))
+}
+
+func printError(stderr io.Writer, err error) {
+	fmt.Fprintln(stderr, e.FromStdError(err).Msg)
+}
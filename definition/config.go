@@ -2,12 +2,11 @@ package definition
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var Cfg *Config
-
 type Config struct {
 	AppName       string
 	ServerPort    int
@@ -15,6 +14,10 @@ type Config struct {
 	UsePprof      bool
 	UsePrometheus bool
 	RateLimit     RateLimit
+	Tracing       Tracing
+	// AdminTokens: the bearer tokens of the admin api by operator, the operator of the token is the one written to
+	// the audit logs. The admin api is refused if it is empty.
+	AdminTokens map[string]string
 
 	DB                        *sql.DB
 	Redis                     *redis.Client
@@ -24,6 +27,81 @@ type Config struct {
 	RedisBatchAllocNum        int64
 	WriteDBEveryNVersion      int64
 	RecoverRedisEveryNVersion int64
+	// IdempotentKeyExpire: how long the ids returned for a requestId are remembered
+	IdempotentKeyExpire time.Duration
+	// RejectUnknownService: reject alloc requests for services not created by the admin api,
+	// otherwise unknown services are registered on their first alloc
+	RejectUnknownService bool
+	// ServiceRegistryRefreshInterval: how often the service registry is reloaded from db
+	ServiceRegistryRefreshInterval time.Duration
+	// WarmupMode: which service alloc handlers are created at startup, see WARMUP_MODE_*.
+	// The handlers not warmed up are created on the first alloc of each service.
+	WarmupMode string
+	// WarmupServiceNames: the services warmed up in WARMUP_MODE_HOT
+	WarmupServiceNames []string
+	// WarmupConcurrency: the max number of handlers created concurrently during warmup
+	WarmupConcurrency int
+	// WarmupQps: the max number of handlers created per second during warmup, 0 means unlimited
+	WarmupQps int
+	// ShutdownReadinessDelay: how long the instance reports not ready before it stops serving on shutdown,
+	// so that the orchestrator has time to remove it from the load balancer
+	ShutdownReadinessDelay time.Duration
+	// ServiceHandlerIdleTimeout: stop the service alloc handlers not used for this duration, 0 means never
+	ServiceHandlerIdleTimeout time.Duration
+	// MaxServiceHandlerNum: the max number of resident service alloc handlers,
+	// the least recently used ones are stopped when exceeded, and the warmup is capped by it. 0 means unlimited
+	MaxServiceHandlerNum int
+	// ConsistencyCheckInterval: how often the counters in redis, db and the segments held are checked, 0 means never
+	ConsistencyCheckInterval time.Duration
+	// ConsistencyAutoRepair: repair the problems found by the scheduled checks, otherwise they are only reported
+	ConsistencyAutoRepair bool
+	// SegmentJournal: the local journal of the segments fetched from redis, disabled if its Dir is empty
+	SegmentJournal SegmentJournal
+	// InstanceId: identifies this instance in the ledger, hostname:server_port by default
+	InstanceId string
+	// Ledger: records which instance fetched which segment in the db
+	Ledger Ledger
+	// ExhaustionForecast: forecasts when the counter of every service reaches its max value
+	ExhaustionForecast ExhaustionForecast
+}
+
+// ExhaustionForecast: the allocation rate of a service is computed from the counters returned by its redis increments
+// in the Window, which include the increments of the other instances. The time to reach the max value is exported
+// as a gauge every CheckInterval, and a warning is logged when it falls below each of the WarnThresholds.
+type ExhaustionForecast struct {
+	// Window: the rate is averaged over the increments in this window, a service without increments in it has no forecast
+	Window time.Duration
+	// CheckInterval: how often the forecasts are exported and the warnings are logged, 0 means never
+	CheckInterval time.Duration
+	// WarnThresholds: the longest first, the warnings escalate to errors at the last one
+	WarnThresholds []time.Duration
+	// MaxValues: the max value of the counter by service as seen by the clients, e.g. the max of an int32 column
+	// downstream. It is only forecast, the allocation is not limited. The max of the id type for the services not
+	// given, a value beyond it is out of range and ignored.
+	MaxValues map[string]uint64
+}
+
+// Ledger: every segment fetched from redis is written to tbl_alloc_ledger by the sync goroutines, to find out which
+// instance issued an id. The records are dropped if the queue is full, the allocs never wait for the ledger.
+type Ledger struct {
+	Enable bool
+	// Retention: the records older than this are pruned every LEDGER_PRUNE_INTERVAL, 0 means they are kept forever
+	Retention time.Duration
+}
+
+// SegmentJournal: every segment fetched from redis is appended to a local file before it is handed out.
+// On startup the counters in redis are moved above the max value journaled, in case redis and the db lost the recent data.
+type SegmentJournal struct {
+	// Dir: the directory of the journal files, one directory per instance
+	Dir string
+	// MaxFileSize: the journal is rotated to a new file when the current one exceeds this size in bytes
+	MaxFileSize int64
+	// MaxFileNum: how many journal files are kept, the oldest ones are deleted on rotation
+	MaxFileNum int
+	// FsyncPolicy: SEGMENT_JOURNAL_FSYNC_*
+	FsyncPolicy string
+	// FsyncInterval: how often the journal is synced in SEGMENT_JOURNAL_FSYNC_INTERVAL
+	FsyncInterval time.Duration
 }
 
 type RateLimit struct {
@@ -31,23 +109,96 @@ type RateLimit struct {
 	Qps    int
 }
 
+type Tracing struct {
+	Enable bool
+	// Exporter: TRACING_EXPORTER_OTLP or TRACING_EXPORTER_STDOUT
+	Exporter string
+	// OtlpEndpoint: host:port of the otlp http receiver
+	OtlpEndpoint string
+	OtlpInsecure bool
+	// SampleRatio: the ratio of the traces started here to sample, the sampled flag of the parent is followed
+	SampleRatio float64
+}
+
 const (
 	DEFAULT_APP_NAME                      = "idalloc"
 	DEFAULT_SERVER_PORT                   = 8080
 	DEFAULT_LOG_LEVEL                     = "INFO"
+	DEFAULT_REDIS_KEY_PREFIX              = DEFAULT_APP_NAME + ":"
 	DEFAULT_SYNC_REDIS_AND_DB_CHAN_SIZE   = 10000
 	DEFAULT_SYNC_REDIS_AND_DB_THREAD_NUM  = 10
 	DEFAULT_REDIS_BATCH_ALLOC_NUM         = 10000
 	DEFAULT_WRITE_DB_EVERY_N_VERSION      = 10
 	DEFAULT_RECOVER_REDIS_EVERY_N_VERSION = 100
+	DEFAULT_IDEMPOTENT_KEY_EXPIRE         = 24 * time.Hour
+	DEFAULT_SERVICE_REGISTRY_REFRESH      = 30 * time.Second
+	DEFAULT_CONSISTENCY_CHECK_INTERVAL    = 10 * time.Minute
+)
+
+const (
+	DEFAULT_EXHAUSTION_FORECAST_WINDOW         = time.Hour
+	DEFAULT_EXHAUSTION_FORECAST_CHECK_INTERVAL = time.Minute
+	// EXHAUSTION_FORECAST_SAMPLE_NUM: the counters sampled in a window, the increments closer are merged
+	EXHAUSTION_FORECAST_SAMPLE_NUM = 60
+)
+
+// DEFAULT_EXHAUSTION_FORECAST_WARN_THRESHOLDS: 30 days, 7 days and 1 day
+var DEFAULT_EXHAUSTION_FORECAST_WARN_THRESHOLDS = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+const (
+	TRACING_EXPORTER_OTLP   = "otlp"
+	TRACING_EXPORTER_STDOUT = "stdout"
+
+	DEFAULT_TRACING_EXPORTER     = TRACING_EXPORTER_STDOUT
+	DEFAULT_TRACING_SAMPLE_RATIO = 1.0
+)
+
+const (
+	LEDGER_PRUNE_INTERVAL = time.Hour
+	// LEDGER_PRUNE_BATCH_SIZE: how many records are deleted by a statement, so that the table is not locked for long
+	LEDGER_PRUNE_BATCH_SIZE = 10000
+	// LEDGER_QUERY_LIMIT: the max number of records returned by a ledger query
+	LEDGER_QUERY_LIMIT = 100
+	// LEDGER_VERIFY_SCAN_NUM: how many segments starting at or below an id are checked to verify it.
+	// The segments of a service are disjoint unless its counter was moved backwards, so the nearest one is enough.
+	LEDGER_VERIFY_SCAN_NUM = 16
+	// LEDGER_QUEUE_SIZE: the ledger records waiting to be written, apart from the syncs of the counters
+	LEDGER_QUEUE_SIZE = 4096
+	// LEDGER_ENQUEUE_TIMEOUT: how long a fetch waits for the full ledger queue before the record is dropped
+	LEDGER_ENQUEUE_TIMEOUT = time.Second
 )
 
 const (
-	MAX_USER_BATCH_ALLOC_NUM = 100
-	DEFAULT_USER_ALLOC_NUM   = 1
+	// SEGMENT_JOURNAL_FSYNC_ALWAYS: sync every record before the segment is handed out
+	SEGMENT_JOURNAL_FSYNC_ALWAYS = "always"
+	// SEGMENT_JOURNAL_FSYNC_INTERVAL: sync every FsyncInterval, the records since the last sync may be lost on a crash of the host
+	SEGMENT_JOURNAL_FSYNC_INTERVAL = "interval"
+	// SEGMENT_JOURNAL_FSYNC_NEVER: leave it to the os
+	SEGMENT_JOURNAL_FSYNC_NEVER = "never"
+
+	DEFAULT_SEGMENT_JOURNAL_MAX_FILE_SIZE  = 64 << 20
+	DEFAULT_SEGMENT_JOURNAL_MAX_FILE_NUM   = 8
+	DEFAULT_SEGMENT_JOURNAL_FSYNC_POLICY   = SEGMENT_JOURNAL_FSYNC_ALWAYS
+	DEFAULT_SEGMENT_JOURNAL_FSYNC_INTERVAL = time.Second
 )
 
-var (
-	RedisKeyPrefix     string = DEFAULT_APP_NAME + ":"
-	RedisBatchAllocNum int64  = DEFAULT_REDIS_BATCH_ALLOC_NUM
+const (
+	// WARMUP_MODE_EAGER: warm up all active services
+	WARMUP_MODE_EAGER = "eager"
+	// WARMUP_MODE_LAZY: warm up nothing
+	WARMUP_MODE_LAZY = "lazy"
+	// WARMUP_MODE_HOT: warm up the services in WarmupServiceNames only
+	WARMUP_MODE_HOT = "hot"
+
+	DEFAULT_WARMUP_MODE        = WARMUP_MODE_EAGER
+	DEFAULT_WARMUP_CONCURRENCY = 10
+)
+
+const (
+	MAX_USER_BATCH_ALLOC_NUM   = 100
+	MAX_USER_BATCH_SERVICE_NUM = 20
+	DEFAULT_USER_ALLOC_NUM     = 1
+	MAX_SERVICE_NAME_LENGTH    = 64
+	MAX_REQUEST_ID_LENGTH      = 128
+	MAX_VERIFY_ID_NUM          = 100
 )
@@ -0,0 +1,189 @@
+package dto
+
+import (
+	"encoding/json"
+
+	"github.com/daemon-coder/idalloc/definition/entity"
+)
+
+type ListServicesRespDto struct {
+	Services []*ServiceStateDto `json:"services"`
+}
+
+type GetServiceStateReqDto struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type ServiceStateDto struct {
+	ServiceName string            `json:"serviceName"`
+	Status      string            `json:"status"`
+	Redis       *entity.AllocInfo `json:"redis"`
+	RedisError  string            `json:"redisError,omitempty"`
+	DB          *entity.AllocInfo `json:"db"`
+	// Lag: how far the db is behind redis, nil if either side is missing
+	Lag *AllocLagDto `json:"lag"`
+	// Exhaustion: when the counter reaches its max value, nil if this instance has not seen enough recent increments
+	Exhaustion *ExhaustionForecastDto `json:"exhaustion"`
+
+	// Loaded: whether this instance holds a handler for the service.
+	// CurrentSegment and Prefetch are only set for loaded services.
+	Loaded         bool               `json:"loaded"`
+	CurrentSegment *SegmentDto        `json:"currentSegment"`
+	Prefetch       *PrefetchStatusDto `json:"prefetch"`
+}
+
+type AllocLagDto struct {
+	LastAllocValue int64 `json:"lastAllocValue"`
+	DataVersion    int64 `json:"dataVersion"`
+}
+
+type ExhaustionForecastDto struct {
+	MaxValue entity.Value `json:"maxValue"`
+	// MaxValueOutOfRange: the configured max value is beyond the max of the id type, which is used instead
+	MaxValueOutOfRange bool   `json:"maxValueOutOfRange,omitempty"`
+	Remaining          uint64 `json:"remaining"`
+	// Rate: the ids allocated per second by all the instances
+	Rate float64 `json:"rate"`
+	// SecondsToExhaustion: -1 if the counter is not moving forward
+	SecondsToExhaustion float64 `json:"secondsToExhaustion"`
+	// ExhaustAt: the unix time in milliseconds, 0 if the counter is not moving forward or it is too far away
+	ExhaustAt int64 `json:"exhaustAt"`
+	// Level: how many of the warn thresholds the forecast is below
+	Level int `json:"level"`
+}
+
+// SegmentDto: the values are strings for the uint64 services
+type SegmentDto struct {
+	LastAllocValue entity.Value `json:"lastAllocValue"`
+	MaxValue       entity.Value `json:"maxValue"`
+	Remaining      int64        `json:"remaining"`
+}
+
+type PrefetchStatusDto struct {
+	Status    string      `json:"status"`
+	Segment   *SegmentDto `json:"segment"`
+	LastError string      `json:"lastError,omitempty"`
+	UpdatedAt int64       `json:"updatedAt"`
+}
+
+type AdvanceCounterReqDto struct {
+	ServiceName string `json:"serviceName"`
+	// LastAllocValue: the counter after the operation, the next id allocated is LastAllocValue+1.
+	// A number or a string, the values above 2^53 of the uint64 services are passed as strings by the JavaScript clients.
+	LastAllocValue json.Number `json:"lastAllocValue"`
+	// Force: allow moving the counter backwards, which may issue duplicate ids
+	Force    bool   `json:"force"`
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+}
+
+type AdvanceCounterRespDto struct {
+	Before *entity.AllocInfo `json:"before"`
+	After  *entity.AllocInfo `json:"after"`
+}
+
+type RecoverServiceReqDto struct {
+	ServiceName string `json:"serviceName"`
+}
+
+type ServiceStatusReqDto struct {
+	ServiceName string `json:"serviceName"`
+	Operator    string `json:"operator"`
+	Reason      string `json:"reason"`
+	// IdType: int64 or uint64, only used by the creation, empty is int64
+	IdType string `json:"idType,omitempty"`
+}
+
+type ServiceStatusRespDto struct {
+	ServiceName string `json:"serviceName"`
+	Status      string `json:"status"`
+	// IdType: only set by the creation
+	IdType string `json:"idType,omitempty"`
+}
+
+type ConfigChangeDto struct {
+	Setting string `json:"setting"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type ReloadConfigRespDto struct {
+	Applied []*ConfigChangeDto `json:"applied"`
+	// Rejected: the changes which take effect only after a restart, the old values are kept
+	Rejected []*ConfigChangeDto `json:"rejected"`
+}
+
+type CheckConsistencyReqDto struct {
+	// ServiceNames: the services to check, all the services if it is empty
+	ServiceNames []string `json:"serviceNames"`
+	// Repair: repair the problems found by moving the counters forward, Operator is required then
+	Repair   bool   `json:"repair"`
+	Operator string `json:"operator"`
+}
+
+type ConsistencyReportDto struct {
+	StartedAt  int64                  `json:"startedAt"`
+	FinishedAt int64                  `json:"finishedAt"`
+	ServiceNum int                    `json:"serviceNum"`
+	Repair     bool                   `json:"repair"`
+	Issues     []*ConsistencyIssueDto `json:"issues"`
+}
+
+type ConsistencyIssueDto struct {
+	ServiceName string `json:"serviceName"`
+	Kind        string `json:"kind"`
+	Detail      string `json:"detail"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repairError,omitempty"`
+}
+
+type ImportSnapshotReqDto struct {
+	Snapshot *entity.Snapshot `json:"snapshot"`
+	Operator string           `json:"operator"`
+	Reason   string           `json:"reason"`
+}
+
+type ImportSnapshotRespDto struct {
+	ImportedNum int                        `json:"importedNum"`
+	SkippedNum  int                        `json:"skippedNum"`
+	FailedNum   int                        `json:"failedNum"`
+	Results     []*ImportSnapshotResultDto `json:"results"`
+}
+
+type ImportSnapshotResultDto struct {
+	ServiceName string `json:"serviceName"`
+	// Result: imported, skipped or failed
+	Result         string            `json:"result"`
+	Msg            string            `json:"msg,omitempty"`
+	ServiceCreated bool              `json:"serviceCreated"`
+	Before         *entity.AllocInfo `json:"before"`
+	After          *entity.AllocInfo `json:"after"`
+}
+
+type FindLedgerReqDto struct {
+	ServiceName string      `json:"serviceName"`
+	Id          json.Number `json:"id"`
+}
+
+type FindLedgerRespDto struct {
+	// Records: the segments containing the id, more than one means the id has been issued more than once
+	Records []*entity.LedgerRecord `json:"records"`
+}
+
+type WasteReportDto struct {
+	// Since: when this instance started counting, the report is per instance and reset by a restart
+	Since         int64              `json:"since"`
+	BatchAllocNum int64              `json:"batchAllocNum"`
+	Services      []*ServiceWasteDto `json:"services"`
+}
+
+type ServiceWasteDto struct {
+	ServiceName string `json:"serviceName"`
+	SegmentNum  int64  `json:"segmentNum"`
+	FetchedIds  int64  `json:"fetchedIds"`
+	// WastedIds: partitioned by reason: shutdown, evicted, invalidated, recovery and abandoned
+	WastedIds   map[string]int64 `json:"wastedIds"`
+	TotalWasted int64            `json:"totalWasted"`
+	// WasteRatio: TotalWasted / FetchedIds, 0 if nothing is fetched
+	WasteRatio float64 `json:"wasteRatio"`
+}
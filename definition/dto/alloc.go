@@ -1,10 +1,30 @@
 package dto
 
+import "github.com/daemon-coder/idalloc/definition/entity"
+
 type AllocReqDto struct {
 	ServiceName string `json:"serviceName"`
 	Count       int64  `json:"count"`
+	// RequestId: optional idempotency key. Retries with the same requestId get the same ids.
+	RequestId string `json:"requestId"`
 }
 
 type AllocRespDto struct {
-	Ids []int64 `json:"ids"`
+	// Ids: numbers, or strings for the uint64 services, see entity.ID_TYPE_UINT64
+	Ids []entity.Value `json:"ids"`
+}
+
+type BatchAllocReqDto struct {
+	Items []AllocReqDto `json:"items"`
+}
+
+type BatchAllocRespDto struct {
+	// Results is keyed by the normalized service name
+	Results map[string]*BatchAllocItemRespDto `json:"results"`
+}
+
+type BatchAllocItemRespDto struct {
+	Code int            `json:"code"`
+	Msg  string         `json:"msg"`
+	Ids  []entity.Value `json:"ids"`
 }
@@ -0,0 +1,42 @@
+package dto
+
+type HealthRespDto struct {
+	// Status: ok, degraded (some checks failed but the instance can still serve) or unready
+	Status       string             `json:"status"`
+	Ready        bool               `json:"ready"`
+	ShuttingDown bool               `json:"shuttingDown"`
+	Warmup       *WarmupStatusDto   `json:"warmup"`
+	Redis        *DependencyDto     `json:"redis"`
+	DB           *DependencyDto     `json:"db"`
+	SyncQueue    *SyncQueueDto      `json:"syncQueue"`
+	Prefetch     *PrefetchHealthDto `json:"prefetch"`
+}
+
+// WarmupStatusDto: times are unix milliseconds, EndTime is 0 before the warmup finishes
+type WarmupStatusDto struct {
+	Mode      string `json:"mode"`
+	Finished  bool   `json:"finished"`
+	Total     int64  `json:"total"`
+	Succeeded int64  `json:"succeeded"`
+	Failed    int64  `json:"failed"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+}
+
+type DependencyDto struct {
+	Reachable bool   `json:"reachable"`
+	LatencyMs int64  `json:"latencyMs"`
+	Err       string `json:"err,omitempty"`
+}
+
+type SyncQueueDto struct {
+	Len       int  `json:"len"`
+	Cap       int  `json:"cap"`
+	Saturated bool `json:"saturated"`
+}
+
+type PrefetchHealthDto struct {
+	LoadedNum int `json:"loadedNum"`
+	// Failed: the services whose latest prefetch failed, keyed by service name
+	Failed map[string]*PrefetchStatusDto `json:"failed"`
+}
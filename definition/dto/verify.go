@@ -0,0 +1,26 @@
+package dto
+
+import (
+	"encoding/json"
+
+	"github.com/daemon-coder/idalloc/definition/entity"
+)
+
+type VerifyReqDto struct {
+	ServiceName string `json:"serviceName"`
+	// Ids: numbers, or strings as the uint64 services return them
+	Ids []json.Number `json:"ids"`
+}
+
+type VerifyRespDto struct {
+	Results []*VerifyResultDto `json:"results"`
+}
+
+type VerifyResultDto struct {
+	Id entity.Value `json:"id"`
+	// Status: issued, not_issued or unknown. Unknown does not mean that the id was not issued, e.g. its ledger
+	// record may have been dropped, see the dropped and failed ledger_records_total.
+	Status string `json:"status"`
+	// Segment: which instance issued the id and when, only set if it is issued
+	Segment *entity.LedgerRecord `json:"segment"`
+}
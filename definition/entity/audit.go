@@ -0,0 +1,20 @@
+package entity
+
+const (
+	AUDIT_ACTION_ADVANCE_COUNTER  = "advance_counter"
+	AUDIT_ACTION_CREATE_SERVICE   = "create_service"
+	AUDIT_ACTION_FREEZE_SERVICE   = "freeze_service"
+	AUDIT_ACTION_ACTIVATE_SERVICE = "activate_service"
+	AUDIT_ACTION_RETIRE_SERVICE   = "retire_service"
+	AUDIT_ACTION_REPAIR_COUNTER   = "repair_counter"
+	AUDIT_ACTION_IMPORT_SNAPSHOT  = "import_snapshot"
+	AUDIT_ACTION_RAISE_TO_JOURNAL = "raise_to_journal"
+)
+
+type AuditLog struct {
+	ServiceName string `json:"serviceName"`
+	Action      string `json:"action"`
+	Operator    string `json:"operator"`
+	// Detail: json encoded detail of the action
+	Detail string `json:"detail"`
+}
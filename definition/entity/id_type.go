@@ -0,0 +1,123 @@
+package entity
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	// ID_TYPE_INT64: the default id type, the ids are 1~2^63-1
+	ID_TYPE_INT64 = "int64"
+	// ID_TYPE_UINT64: the ids are 1~2^64-1. The values are offset by -2^63 in process and in redis, so that they keep
+	// their order and the int64 arithmetic of the segments and of HINCRBY applies, see FromUint64.
+	// The db stores the unsigned values, and the json output has them as strings.
+	ID_TYPE_UINT64 = "uint64"
+)
+
+// NormalizeIdType: empty is ID_TYPE_INT64, so are the counters created before the id types
+func NormalizeIdType(idType string) string {
+	if idType == "" {
+		return ID_TYPE_INT64
+	}
+	return idType
+}
+
+func IsValidIdType(idType string) bool {
+	return idType == ID_TYPE_INT64 || idType == ID_TYPE_UINT64
+}
+
+// FromUint64: the process form of a uint64 value, 0 is math.MinInt64
+func FromUint64(value uint64) int64 {
+	return int64(value ^ 1<<63)
+}
+
+// ToUint64: the uint64 value of the process form
+func ToUint64(value int64) uint64 {
+	return uint64(value) ^ 1<<63
+}
+
+// ZeroValue: the process form of the counter before the first id is allocated
+func ZeroValue(idType string) int64 {
+	if idType == ID_TYPE_UINT64 {
+		return math.MinInt64
+	}
+	return 0
+}
+
+// FormatValue: the decimal of the value as seen by the clients
+func FormatValue(idType string, value int64) string {
+	if idType == ID_TYPE_UINT64 {
+		return strconv.FormatUint(ToUint64(value), 10)
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// ParseValue: the process form of the decimal seen by the clients
+func ParseValue(idType string, text string) (int64, error) {
+	if idType == ID_TYPE_UINT64 {
+		value, err := strconv.ParseUint(text, 10, 64)
+		return FromUint64(value), err
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+// parseJsonValue: the value may be a json number or a string, it is parsed as the id type
+func parseJsonValue(idType string, data json.RawMessage) (int64, error) {
+	text := string(data)
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &text); err != nil {
+			return 0, err
+		}
+	}
+	value, err := ParseValue(idType, text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value: %s", NormalizeIdType(idType), data)
+	}
+	return value, nil
+}
+
+// Value: a counter value or an id in the json output. It is a number for the int64 services, and a string for the
+// uint64 services, whose values exceed the range of int64 and the precision of the JavaScript numbers.
+type Value struct {
+	IdType string
+	// Raw: the process form
+	Raw int64
+}
+
+func NewValues(idType string, values []int64) []Value {
+	result := make([]Value, 0, len(values))
+	for _, value := range values {
+		result = append(result, Value{IdType: idType, Raw: value})
+	}
+	return result
+}
+
+func (v Value) String() string {
+	return FormatValue(v.IdType, v.Raw)
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	if v.IdType == ID_TYPE_UINT64 {
+		return json.Marshal(v.String())
+	}
+	return []byte(v.String()), nil
+}
+
+// UnmarshalJSON: a string is taken as a uint64 value, a number as an int64 one
+func (v *Value) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	idType := ID_TYPE_INT64
+	if len(data) > 0 && data[0] == '"' {
+		idType = ID_TYPE_UINT64
+	}
+	raw, err := parseJsonValue(idType, data)
+	if err != nil {
+		return err
+	}
+	v.IdType, v.Raw = idType, raw
+	return nil
+}
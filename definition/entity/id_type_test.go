@@ -0,0 +1,86 @@
+package entity
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestUint64Conversion(t *testing.T) {
+	cases := []struct {
+		value uint64
+		raw   int64
+		text  string
+		json  string
+	}{
+		{0, math.MinInt64, "0", `"0"`},
+		{1, math.MinInt64 + 1, "1", `"1"`},
+		{1<<63 - 1, -1, "9223372036854775807", `"9223372036854775807"`},
+		{1 << 63, 0, "9223372036854775808", `"9223372036854775808"`},
+		{math.MaxUint64, math.MaxInt64, "18446744073709551615", `"18446744073709551615"`},
+	}
+	for _, c := range cases {
+		if raw := FromUint64(c.value); raw != c.raw {
+			t.Errorf("FromUint64(%d): got %d, want %d", c.value, raw, c.raw)
+		}
+		if value := ToUint64(c.raw); value != c.value {
+			t.Errorf("ToUint64(%d): got %d, want %d", c.raw, value, c.value)
+		}
+		if text := FormatValue(ID_TYPE_UINT64, c.raw); text != c.text {
+			t.Errorf("FormatValue(%d): got %s, want %s", c.raw, text, c.text)
+		}
+		if raw, err := ParseValue(ID_TYPE_UINT64, c.text); err != nil || raw != c.raw {
+			t.Errorf("ParseValue(%s): got %d %v, want %d", c.text, raw, err, c.raw)
+		}
+
+		data, err := json.Marshal(Value{IdType: ID_TYPE_UINT64, Raw: c.raw})
+		if err != nil || string(data) != c.json {
+			t.Errorf("Marshal(%d): got %s %v, want %s", c.value, data, err, c.json)
+		}
+		var value Value
+		if err = json.Unmarshal(data, &value); err != nil || value != (Value{IdType: ID_TYPE_UINT64, Raw: c.raw}) {
+			t.Errorf("Unmarshal(%s): got %+v %v", data, value, err)
+		}
+	}
+	// the process form keeps the order of the values
+	if !(FromUint64(1<<63-1) < FromUint64(1<<63) && FromUint64(0) < FromUint64(1)) {
+		t.Error("FromUint64 does not keep the order")
+	}
+}
+
+func TestZeroValue(t *testing.T) {
+	if zero := ZeroValue(ID_TYPE_INT64); zero != 0 {
+		t.Errorf("ZeroValue(int64): got %d, want 0", zero)
+	}
+	if zero := ZeroValue(ID_TYPE_UINT64); ToUint64(zero) != 0 {
+		t.Errorf("ZeroValue(uint64): got %d, want the form of 0", zero)
+	}
+}
+
+func TestValueJson(t *testing.T) {
+	cases := []struct {
+		value Value
+		json  string
+	}{
+		{Value{IdType: ID_TYPE_INT64, Raw: 0}, `0`},
+		{Value{IdType: ID_TYPE_INT64, Raw: math.MaxInt64}, `9223372036854775807`},
+		{Value{IdType: ID_TYPE_UINT64, Raw: FromUint64(42)}, `"42"`},
+	}
+	for _, c := range cases {
+		data, err := json.Marshal(c.value)
+		if err != nil || string(data) != c.json {
+			t.Errorf("Marshal(%+v): got %s %v, want %s", c.value, data, err, c.json)
+		}
+		var value Value
+		if err = json.Unmarshal(data, &value); err != nil || value != c.value {
+			t.Errorf("Unmarshal(%s): got %+v %v, want %+v", data, value, err, c.value)
+		}
+	}
+
+	var value Value
+	for _, data := range []string{`"-1"`, `"18446744073709551616"`, `9223372036854775808`, `"abc"`} {
+		if err := json.Unmarshal([]byte(data), &value); err == nil {
+			t.Errorf("Unmarshal(%s): want an error", data)
+		}
+	}
+}
@@ -1,8 +1,48 @@
 package entity
 
+import "encoding/json"
+
 type AllocInfo struct {
 	ServiceName		*string	`json:"serviceName"`
 	LastAllocValue	*int64	`json:"lastAllocValue"`
 	DataVersion		*int64	`json:"dataVersion"`
+	// IdType: ID_TYPE_*, empty is ID_TYPE_INT64. LastAllocValue is in the process form, see ID_TYPE_UINT64.
+	IdType			string	`json:"idType,omitempty"`
+	// Epoch: bumped in redis whenever the counter is set other than by a segment fetch, it is not kept in the db
+	Epoch			int64	`json:"-"`
 	// TODO add fields for loop control
 }
+
+// MarshalJSON: lastAllocValue is the value seen by the clients, a string for the uint64 services
+func (a AllocInfo) MarshalJSON() ([]byte, error) {
+	result := struct {
+		ServiceName    *string `json:"serviceName"`
+		LastAllocValue *Value  `json:"lastAllocValue"`
+		DataVersion    *int64  `json:"dataVersion"`
+		IdType         string  `json:"idType,omitempty"`
+	}{ServiceName: a.ServiceName, DataVersion: a.DataVersion, IdType: a.IdType}
+	if a.LastAllocValue != nil {
+		result.LastAllocValue = &Value{IdType: a.IdType, Raw: *a.LastAllocValue}
+	}
+	return json.Marshal(result)
+}
+
+func (a *AllocInfo) UnmarshalJSON(data []byte) error {
+	type plain AllocInfo
+	result := struct {
+		*plain
+		LastAllocValue json.RawMessage `json:"lastAllocValue"`
+	}{plain: (*plain)(a)}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	a.LastAllocValue = nil
+	if len(result.LastAllocValue) > 0 && string(result.LastAllocValue) != "null" {
+		value, err := parseJsonValue(a.IdType, result.LastAllocValue)
+		if err != nil {
+			return err
+		}
+		a.LastAllocValue = &value
+	}
+	return nil
+}
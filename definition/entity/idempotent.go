@@ -0,0 +1,9 @@
+package entity
+
+// IdempotentAllocRecord is the response remembered for an idempotent alloc request
+type IdempotentAllocRecord struct {
+	Count int64   `json:"count"`
+	Ids   []int64 `json:"ids"`
+	// IdType: ID_TYPE_*, empty is ID_TYPE_INT64. Ids are in the process form.
+	IdType string `json:"idType,omitempty"`
+}
@@ -0,0 +1,15 @@
+package entity
+
+// SegmentJournalRecord: a line of the segment journal, the ids in (LastAllocValue, MaxValue] are handed out
+type SegmentJournalRecord struct {
+	// Time: unix milliseconds
+	Time           int64  `json:"time"`
+	ServiceName    string `json:"serviceName"`
+	LastAllocValue int64  `json:"lastAllocValue"`
+	MaxValue       int64  `json:"maxValue"`
+	DataVersion    int64  `json:"dataVersion"`
+	// Checkpoint: written at the start of every journal file, MaxValue is the max value journaled before
+	Checkpoint bool `json:"checkpoint,omitempty"`
+	// IdType: empty is ID_TYPE_INT64, the values are in the process form of the id type
+	IdType string `json:"idType,omitempty"`
+}
@@ -0,0 +1,55 @@
+package entity
+
+import "encoding/json"
+
+// LedgerRecord: the ids in [StartValue, EndValue] of the service were fetched by the instance.
+// The values are in the process form of the id type, see ID_TYPE_UINT64.
+type LedgerRecord struct {
+	ServiceName string `json:"serviceName"`
+	StartValue  int64  `json:"startValue"`
+	EndValue    int64  `json:"endValue"`
+	InstanceId  string `json:"instanceId"`
+	DataVersion int64  `json:"dataVersion"`
+	// CreateTime: unix milliseconds when the segment was fetched
+	CreateTime int64  `json:"createTime"`
+	IdType     string `json:"idType,omitempty"`
+}
+
+// MarshalJSON: the values are the ones seen by the clients, strings for the uint64 services
+func (r LedgerRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ServiceName string `json:"serviceName"`
+		StartValue  Value  `json:"startValue"`
+		EndValue    Value  `json:"endValue"`
+		InstanceId  string `json:"instanceId"`
+		DataVersion int64  `json:"dataVersion"`
+		CreateTime  int64  `json:"createTime"`
+		IdType      string `json:"idType,omitempty"`
+	}{
+		ServiceName: r.ServiceName,
+		StartValue:  Value{IdType: r.IdType, Raw: r.StartValue},
+		EndValue:    Value{IdType: r.IdType, Raw: r.EndValue},
+		InstanceId:  r.InstanceId,
+		DataVersion: r.DataVersion,
+		CreateTime:  r.CreateTime,
+		IdType:      r.IdType,
+	})
+}
+
+func (r *LedgerRecord) UnmarshalJSON(data []byte) error {
+	type plain LedgerRecord
+	result := struct {
+		*plain
+		StartValue json.RawMessage `json:"startValue"`
+		EndValue   json.RawMessage `json:"endValue"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	var err error
+	if r.StartValue, err = parseJsonValue(r.IdType, result.StartValue); err != nil {
+		return err
+	}
+	r.EndValue, err = parseJsonValue(r.IdType, result.EndValue)
+	return err
+}
@@ -0,0 +1,12 @@
+package entity
+
+const (
+	SERVICE_STATUS_ACTIVE  = "active"
+	SERVICE_STATUS_FROZEN  = "frozen"
+	SERVICE_STATUS_RETIRED = "retired"
+)
+
+type ServiceInfo struct {
+	ServiceName string `json:"serviceName"`
+	Status      string `json:"status"`
+}
@@ -0,0 +1,62 @@
+package entity
+
+import "encoding/json"
+
+// SNAPSHOT_FORMAT_VERSION: bumped on incompatible changes of Snapshot, the snapshots of newer formats are refused
+const SNAPSHOT_FORMAT_VERSION = 1
+
+// Snapshot: the counters and the settings of all services, exported to a json file and imported elsewhere
+type Snapshot struct {
+	FormatVersion int `json:"formatVersion"`
+	// ExportedAt: unix milliseconds
+	ExportedAt int64              `json:"exportedAt"`
+	Services   []*SnapshotService `json:"services"`
+}
+
+type SnapshotService struct {
+	ServiceName string `json:"serviceName"`
+	// LastAllocValue: the process form, it is a string of the uint64 value in the json of the uint64 services
+	LastAllocValue int64 `json:"lastAllocValue"`
+	DataVersion    int64 `json:"dataVersion"`
+	// Status: SERVICE_STATUS_*, empty if the service is not registered
+	Status string `json:"status"`
+	// IdType: ID_TYPE_*, empty is ID_TYPE_INT64
+	IdType string `json:"idType,omitempty"`
+}
+
+func (s SnapshotService) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ServiceName    string `json:"serviceName"`
+		LastAllocValue Value  `json:"lastAllocValue"`
+		DataVersion    int64  `json:"dataVersion"`
+		Status         string `json:"status"`
+		IdType         string `json:"idType,omitempty"`
+	}{
+		ServiceName:    s.ServiceName,
+		LastAllocValue: Value{IdType: s.IdType, Raw: s.LastAllocValue},
+		DataVersion:    s.DataVersion,
+		Status:         s.Status,
+		IdType:         s.IdType,
+	})
+}
+
+// UnmarshalJSON: lastAllocValue is 0 of the id type if it is missing
+func (s *SnapshotService) UnmarshalJSON(data []byte) error {
+	type plain SnapshotService
+	result := struct {
+		*plain
+		LastAllocValue json.RawMessage `json:"lastAllocValue"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	s.LastAllocValue = ZeroValue(s.IdType)
+	if len(result.LastAllocValue) > 0 && string(result.LastAllocValue) != "null" {
+		value, err := parseJsonValue(s.IdType, result.LastAllocValue)
+		if err != nil {
+			return err
+		}
+		s.LastAllocValue = value
+	}
+	return nil
+}
@@ -1,5 +1,7 @@
 package errors
 
+import stdErrors "errors"
+
 func NewParamError(opts ...BaseErrorOpt) BaseError {
 	result := New(ParamErrorType, WithMsg(ParamErrorInfo))
 	if len(opts) > 0 {
@@ -95,8 +97,10 @@ func FromStdError(err error, opts ...BaseErrorOpt) (result BaseError) {
 		return New(OK)
 	}
 
-	if v, ok := err.(BaseError); ok {
-		result = v
+	// the BaseError may be wrapped by fmt.Errorf("...%w", err)
+	var baseError BaseError
+	if stdErrors.As(err, &baseError) {
+		result = baseError
 	} else {
 		result = NewServerError(WithMsg(err.Error()), WithData(err))
 	}
@@ -1,10 +1,11 @@
 package definition
 
 import (
+	"context"
 	"time"
 
 	e "github.com/daemon-coder/idalloc/definition/errors"
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 )
 
 type Result struct {
@@ -15,22 +16,22 @@ type Result struct {
 	Ts			int64		`json:"ts"`
 }
 
-func NewResultOK(data interface{}) Result {
+func NewResultOK(ctx context.Context, data interface{}) Result {
 	return Result{
 		Code:		e.OK,
 		Msg:		e.OKMsg,
 		Data:		data,
-		TraceId:	threadLocal.GetTraceId(),
+		TraceId:	ctxInfra.GetTraceId(ctx),
 		Ts:			time.Now().UnixMilli(),
 	}
 }
 
-func NewResultFromError(err e.BaseError) Result {
+func NewResultFromError(ctx context.Context, err e.BaseError) Result {
 	return Result{
 		Code:		err.ErrorCode(),
 		Msg:		err.Msg,
 		Data:		err.GetData(),
-		TraceId:	threadLocal.GetTraceId(),
+		TraceId:	ctxInfra.GetTraceId(ctx),
 		Ts:			time.Now().UnixMilli(),
 	}
 }
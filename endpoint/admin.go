@@ -0,0 +1,291 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+// ListServices: all services known by the registry, the db or loaded by this instance
+func (ep *Endpoint) ListServices(ctx context.Context) (result dto.ListServicesRespDto, err error) {
+	allocInfos, err := ep.allocHandler.Store().GetAllFromDB(ctx)
+	if err != nil {
+		return
+	}
+	dbAllocInfos := make(map[string]*entity.AllocInfo)
+	for _, allocInfo := range allocInfos {
+		dbAllocInfos[*allocInfo.ServiceName] = allocInfo
+	}
+	serviceNameSet := make(map[string]struct{})
+	for serviceName := range dbAllocInfos {
+		serviceNameSet[serviceName] = struct{}{}
+	}
+	for _, serviceInfo := range ep.serviceRegistry.List() {
+		serviceNameSet[serviceInfo.ServiceName] = struct{}{}
+	}
+	for _, serviceName := range ep.allocHandler.LoadedServiceNames() {
+		serviceNameSet[serviceName] = struct{}{}
+	}
+	serviceNames := make([]string, 0, len(serviceNameSet))
+	for serviceName := range serviceNameSet {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	result.Services = make([]*dto.ServiceStateDto, 0, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		result.Services = append(result.Services, ep.getServiceState(ctx, serviceName, dbAllocInfos[serviceName]))
+	}
+	return
+}
+
+func (ep *Endpoint) GetServiceState(ctx context.Context, param dto.GetServiceStateReqDto) (*dto.ServiceStateDto, error) {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	if len(param.ServiceName) == 0 {
+		return nil, e.NewParamError(e.WithMsg("service_name is empty"))
+	}
+	dbAllocInfo, err := ep.allocHandler.Store().GetServiceAllocInfoFromDB(ctx, param.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	result := ep.getServiceState(ctx, param.ServiceName, dbAllocInfo)
+	if result.Status == "" && result.DB == nil && result.Redis == nil && !result.Loaded {
+		return nil, e.NewNotFoundError(e.WithMsg("service not found. service_name: " + param.ServiceName))
+	}
+	return result, nil
+}
+
+func (ep *Endpoint) getServiceState(ctx context.Context, serviceName string, dbAllocInfo *entity.AllocInfo) *dto.ServiceStateDto {
+	result := &dto.ServiceStateDto{
+		ServiceName: serviceName,
+		DB:          dbAllocInfo,
+	}
+	if serviceInfo := ep.serviceRegistry.Get(serviceName); serviceInfo != nil {
+		result.Status = serviceInfo.Status
+	}
+	result.Redis, result.RedisError = ep.getRedisAllocInfo(ctx, serviceName)
+	if result.Redis != nil && result.DB != nil && entity.NormalizeIdType(result.Redis.IdType) == entity.NormalizeIdType(result.DB.IdType) {
+		result.Lag = &dto.AllocLagDto{
+			LastAllocValue: *result.Redis.LastAllocValue - *result.DB.LastAllocValue,
+			DataVersion:    *result.Redis.DataVersion - *result.DB.DataVersion,
+		}
+	}
+	if forecast := ep.allocHandler.ExhaustionForecast(serviceName); forecast != nil {
+		result.Exhaustion = &dto.ExhaustionForecastDto{
+			MaxValue:            forecast.MaxValue,
+			MaxValueOutOfRange:  forecast.MaxValueOutOfRange,
+			Remaining:           forecast.Remaining,
+			Rate:                forecast.Rate,
+			SecondsToExhaustion: forecast.SecondsToExhaustion,
+			ExhaustAt:           forecast.ExhaustAt,
+			Level:               forecast.Level,
+		}
+	}
+
+	handler := ep.allocHandler.GetLoadedServiceAllocHandler(serviceName)
+	if handler == nil {
+		return result
+	}
+	snapshot := handler.Snapshot()
+	result.Loaded = true
+	result.CurrentSegment = newSegmentDto(&snapshot.CurrentSegment)
+	result.Prefetch = &dto.PrefetchStatusDto{
+		Status:    snapshot.Prefetch.Status,
+		Segment:   newSegmentDto(snapshot.Prefetch.Segment),
+		LastError: snapshot.Prefetch.LastError,
+		UpdatedAt: snapshot.Prefetch.UpdatedAt,
+	}
+	return result
+}
+
+// getRedisAllocInfo: dirty data in redis should not break the whole listing, so the error is returned as a message
+func (ep *Endpoint) getRedisAllocInfo(ctx context.Context, serviceName string) (*entity.AllocInfo, string) {
+	result, err := ep.allocHandler.Store().RedisGet(ctx, serviceName)
+	if err != nil {
+		return nil, e.FromStdError(err).Msg
+	}
+	return result, ""
+}
+
+func newSegmentDto(allocResult *service.AllocResult) *dto.SegmentDto {
+	if allocResult == nil {
+		return nil
+	}
+	return &dto.SegmentDto{
+		LastAllocValue: entity.Value{IdType: allocResult.IdType, Raw: allocResult.LastAllocValue},
+		MaxValue:       entity.Value{IdType: allocResult.IdType, Raw: allocResult.MaxValue},
+		Remaining:      allocResult.MaxValue - allocResult.LastAllocValue,
+	}
+}
+
+func (ep *Endpoint) AdvanceCounter(ctx context.Context, param dto.AdvanceCounterReqDto) (result dto.AdvanceCounterRespDto, err error) {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		err = e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+		return
+	}
+	param.Operator = operatorOf(ctx, param.Operator)
+	if len(param.Operator) == 0 {
+		err = e.NewParamError(e.WithMsg("operator is required"))
+		return
+	}
+	idType, err := ep.allocHandler.GetIdType(ctx, param.ServiceName)
+	if err != nil {
+		return
+	}
+	// a missing value is 0
+	inputValue := param.LastAllocValue.String()
+	if inputValue == "" {
+		inputValue = "0"
+	}
+	lastAllocValue, parseErr := entity.ParseValue(idType, inputValue)
+	if parseErr != nil || (idType == entity.ID_TYPE_INT64 && lastAllocValue < 0) {
+		errMsg := fmt.Sprintf("last_alloc_value is invalid. id_type: %s min: 0 max: %s input:%s", idType, formatMaxValue(idType), param.LastAllocValue)
+		err = e.NewParamError(e.WithMsg(errMsg))
+		return
+	}
+
+	result.Before, result.After, err = ep.allocHandler.AdvanceCounter(
+		ctx,
+		param.ServiceName,
+		lastAllocValue,
+		idType,
+		param.Force,
+		param.Operator,
+		param.Reason,
+	)
+	return
+}
+
+// FindLedger: which instances issued the id of the service, from the ledger
+func (ep *Endpoint) FindLedger(ctx context.Context, param dto.FindLedgerReqDto) (result dto.FindLedgerRespDto, err error) {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		err = e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+		return
+	}
+	idType, err := ep.allocHandler.GetIdType(ctx, param.ServiceName)
+	if err != nil {
+		return
+	}
+	id, err := parseId(idType, param.Id)
+	if err != nil {
+		return
+	}
+	result.Records, err = ep.allocHandler.FindLedgerRecords(ctx, param.ServiceName, idType, id)
+	return
+}
+
+// parseId: an id of the service in the process form of the id type, it is 1 at least
+func parseId(idType string, input json.Number) (int64, error) {
+	id, err := entity.ParseValue(idType, input.String())
+	if err != nil || id <= entity.ZeroValue(idType) {
+		errMsg := fmt.Sprintf("id is invalid. id_type: %s min: 1 max: %s input:%s", idType, formatMaxValue(idType), input)
+		return 0, e.NewParamError(e.WithMsg(errMsg))
+	}
+	return id, nil
+}
+
+// formatMaxValue: the max value of the id type as seen by the clients
+func formatMaxValue(idType string) string {
+	if idType == entity.ID_TYPE_UINT64 {
+		return strconv.FormatUint(math.MaxUint64, 10)
+	}
+	return strconv.FormatInt(math.MaxInt64, 10)
+}
+
+// RecoverService: recover the counter of the service in redis from the db, and return the state afterwards
+func (ep *Endpoint) RecoverService(ctx context.Context, param dto.RecoverServiceReqDto) (*dto.ServiceStateDto, error) {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		return nil, e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+	}
+	if err := ep.allocHandler.RecoverService(ctx, param.ServiceName); err != nil {
+		return nil, err
+	}
+	return ep.GetServiceState(ctx, dto.GetServiceStateReqDto{ServiceName: param.ServiceName})
+}
+
+func (ep *Endpoint) CreateService(ctx context.Context, param dto.ServiceStatusReqDto) (*dto.ServiceStatusRespDto, error) {
+	if err := checkServiceStatusParam(ctx, &param); err != nil {
+		return nil, err
+	}
+	param.IdType = entity.NormalizeIdType(strings.ToLower(strings.TrimSpace(param.IdType)))
+	if !entity.IsValidIdType(param.IdType) {
+		errMsg := fmt.Sprintf("id_type is invalid. options: %s, %s input:%s", entity.ID_TYPE_INT64, entity.ID_TYPE_UINT64, param.IdType)
+		return nil, e.NewParamError(e.WithMsg(errMsg))
+	}
+	serviceInfo, err := ep.serviceRegistry.CreateService(ctx, param.ServiceName, param.IdType, param.Operator, param.Reason)
+	if err != nil {
+		return nil, err
+	}
+	result := newServiceStatusRespDto(serviceInfo)
+	result.IdType = param.IdType
+	return result, nil
+}
+
+func (ep *Endpoint) FreezeService(ctx context.Context, param dto.ServiceStatusReqDto) (*dto.ServiceStatusRespDto, error) {
+	if err := checkServiceStatusParam(ctx, &param); err != nil {
+		return nil, err
+	}
+	serviceInfo, err := ep.serviceRegistry.FreezeService(ctx, param.ServiceName, param.Operator, param.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceStatusRespDto(serviceInfo), nil
+}
+
+func (ep *Endpoint) ActivateService(ctx context.Context, param dto.ServiceStatusReqDto) (*dto.ServiceStatusRespDto, error) {
+	if err := checkServiceStatusParam(ctx, &param); err != nil {
+		return nil, err
+	}
+	serviceInfo, err := ep.serviceRegistry.ActivateService(ctx, param.ServiceName, param.Operator, param.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceStatusRespDto(serviceInfo), nil
+}
+
+func (ep *Endpoint) RetireService(ctx context.Context, param dto.ServiceStatusReqDto) (*dto.ServiceStatusRespDto, error) {
+	if err := checkServiceStatusParam(ctx, &param); err != nil {
+		return nil, err
+	}
+	serviceInfo, err := ep.serviceRegistry.RetireService(ctx, param.ServiceName, param.Operator, param.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceStatusRespDto(serviceInfo), nil
+}
+
+// ReloadConfig: the server started without a config source, e.g. embedded with a config built in code, can not reload
+func (ep *Endpoint) ReloadConfig(ctx context.Context) (*dto.ReloadConfigRespDto, error) {
+	if ep.configReloader == nil {
+		return nil, e.NewBusinessError(e.WithMsg("config reload is not supported, the server has no config source"))
+	}
+	return ep.configReloader(ctx)
+}
+
+func newServiceStatusRespDto(serviceInfo *entity.ServiceInfo) *dto.ServiceStatusRespDto {
+	return &dto.ServiceStatusRespDto{ServiceName: serviceInfo.ServiceName, Status: serviceInfo.Status}
+}
+
+func checkServiceStatusParam(ctx context.Context, param *dto.ServiceStatusReqDto) error {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	param.Operator = operatorOf(ctx, param.Operator)
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+	} else if len(param.Operator) == 0 {
+		return e.NewParamError(e.WithMsg("operator is required"))
+	}
+	return nil
+}
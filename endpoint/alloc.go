@@ -1,28 +1,102 @@
 package endpoint
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	def "github.com/daemon-coder/idalloc/definition"
 	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
 	e "github.com/daemon-coder/idalloc/definition/errors"
-	"github.com/daemon-coder/idalloc/service"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 )
 
-func Alloc(param dto.AllocReqDto) (result dto.AllocRespDto) {
-	// param check
-	param.ServiceName = strings.ToLower(strings.TrimSpace(param.ServiceName))
+func (ep *Endpoint) Alloc(ctx context.Context, param dto.AllocReqDto) (result dto.AllocRespDto, err error) {
+	if err = checkAllocParam(&param); err != nil {
+		return
+	}
+	var ids []int64
+	var idType string
+	if param.RequestId != "" {
+		ids, idType, err = ep.allocHandler.IdempotentAlloc(ctx, param.ServiceName, param.RequestId, param.Count)
+	} else {
+		ids, idType, err = ep.allocHandler.Alloc(ctx, param.ServiceName, param.Count)
+	}
+	if err == nil {
+		result.Ids = entity.NewValues(idType, ids)
+	}
+	return
+}
+
+// BatchAlloc: alloc ids for several services in one request.
+// Every item either gets all the ids it asked for, or fails alone with its own error code.
+func (ep *Endpoint) BatchAlloc(ctx context.Context, param dto.BatchAllocReqDto) (result dto.BatchAllocRespDto, err error) {
+	if len(param.Items) == 0 || len(param.Items) > def.MAX_USER_BATCH_SERVICE_NUM {
+		errMsg := fmt.Sprintf("items is invalid. min: %d max: %d input:%d", 1, def.MAX_USER_BATCH_SERVICE_NUM, len(param.Items))
+		err = e.NewParamError(e.WithMsg(errMsg))
+		return
+	}
+	for i := range param.Items {
+		param.Items[i].ServiceName = normalizeServiceName(param.Items[i].ServiceName)
+	}
+	result.Results = make(map[string]*dto.BatchAllocItemRespDto, len(param.Items))
+	for _, item := range param.Items {
+		if _, ok := result.Results[item.ServiceName]; ok {
+			err = e.NewParamError(e.WithMsg("service_name is duplicated. service_name: " + item.ServiceName))
+			return
+		}
+		result.Results[item.ServiceName] = nil
+	}
+
+	for _, item := range param.Items {
+		result.Results[item.ServiceName] = ep.batchAllocItem(ctx, item)
+	}
+	return
+}
+
+func (ep *Endpoint) batchAllocItem(ctx context.Context, param dto.AllocReqDto) *dto.BatchAllocItemRespDto {
+	respDto, err := ep.Alloc(ctx, param)
+	if err != nil {
+		baseError := e.FromStdError(err)
+		return &dto.BatchAllocItemRespDto{
+			Code: baseError.ErrorCode(),
+			Msg:  baseError.Msg,
+			Ids:  []entity.Value{},
+		}
+	}
+	return &dto.BatchAllocItemRespDto{
+		Code: e.OK,
+		Msg:  e.OKMsg,
+		Ids:  respDto.Ids,
+	}
+}
+
+func checkAllocParam(param *dto.AllocReqDto) error {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
 	if param.Count == 0 {
 		param.Count = def.DEFAULT_USER_ALLOC_NUM
 	}
-	if len(param.ServiceName) == 0 || len(param.ServiceName) > 64 {
-		e.Panic(e.NewParamError(e.WithMsg("service_name is invalid. length: 1~64")))
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
 	} else if param.Count < 0 || param.Count > def.MAX_USER_BATCH_ALLOC_NUM {
 		errMsg := fmt.Sprintf("count is invalid. min: %d max: %d input:%d", 1, def.MAX_USER_BATCH_ALLOC_NUM, param.Count)
-		e.Panic(e.NewParamError(e.WithMsg(errMsg)))
+		return e.NewParamError(e.WithMsg(errMsg))
+	} else if len(param.RequestId) > def.MAX_REQUEST_ID_LENGTH {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("request_id is invalid. max length: %d", def.MAX_REQUEST_ID_LENGTH)))
 	}
+	return nil
+}
 
-	result.Ids = service.DefaultAllocHandler.Alloc(param.ServiceName, param.Count)
-	return
+func normalizeServiceName(serviceName string) string {
+	return strings.ToLower(strings.TrimSpace(serviceName))
+}
+
+// operatorOf: the operator of the admin token overrides the one claimed in the request, which is only taken
+// outside of the admin api, e.g. by idallocctl on the stores directly
+func operatorOf(ctx context.Context, claimed string) string {
+	if operator := ctxInfra.GetOperator(ctx); operator != "" {
+		return operator
+	}
+	return strings.TrimSpace(claimed)
 }
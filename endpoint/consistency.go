@@ -0,0 +1,61 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+func (ep *Endpoint) CheckConsistency(ctx context.Context, param dto.CheckConsistencyReqDto) (*dto.ConsistencyReportDto, error) {
+	serviceNames := make([]string, 0, len(param.ServiceNames))
+	for _, serviceName := range param.ServiceNames {
+		serviceName = normalizeServiceName(serviceName)
+		if len(serviceName) == 0 || len(serviceName) > def.MAX_SERVICE_NAME_LENGTH {
+			return nil, e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+		}
+		serviceNames = append(serviceNames, serviceName)
+	}
+	param.Operator = operatorOf(ctx, param.Operator)
+	if param.Repair && len(param.Operator) == 0 {
+		return nil, e.NewParamError(e.WithMsg("operator is required to repair"))
+	}
+
+	report, err := ep.consistencyChecker.Check(ctx, serviceNames, param.Repair, param.Operator)
+	if err != nil {
+		return nil, err
+	}
+	return newConsistencyReportDto(report), nil
+}
+
+// GetConsistencyReport: the report of the last check, scheduled or on demand
+func (ep *Endpoint) GetConsistencyReport(ctx context.Context) (*dto.ConsistencyReportDto, error) {
+	report := ep.consistencyChecker.LastReport()
+	if report == nil {
+		return nil, e.NewNotFoundError(e.WithMsg("no consistency check has finished"))
+	}
+	return newConsistencyReportDto(report), nil
+}
+
+func newConsistencyReportDto(report *service.ConsistencyReport) *dto.ConsistencyReportDto {
+	result := &dto.ConsistencyReportDto{
+		StartedAt:  report.StartedAt,
+		FinishedAt: report.FinishedAt,
+		ServiceNum: report.ServiceNum,
+		Repair:     report.Repair,
+		Issues:     make([]*dto.ConsistencyIssueDto, 0, len(report.Issues)),
+	}
+	for _, issue := range report.Issues {
+		result.Issues = append(result.Issues, &dto.ConsistencyIssueDto{
+			ServiceName: issue.ServiceName,
+			Kind:        issue.Kind,
+			Detail:      issue.Detail,
+			Repaired:    issue.Repaired,
+			RepairError: issue.RepairError,
+		})
+	}
+	return result
+}
@@ -0,0 +1,36 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+// ConfigReloader: reloads the config of the server and applies the settings safe to change while serving
+type ConfigReloader func(ctx context.Context) (*dto.ReloadConfigRespDto, error)
+
+// Endpoint: the validation and the dto conversion in front of the handlers of a server
+type Endpoint struct {
+	allocHandler       *service.AllocHandler
+	serviceRegistry    *service.ServiceRegistry
+	healthChecker      *service.HealthChecker
+	consistencyChecker *service.ConsistencyChecker
+	configReloader     ConfigReloader
+}
+
+func NewEndpoint(
+	allocHandler *service.AllocHandler,
+	serviceRegistry *service.ServiceRegistry,
+	healthChecker *service.HealthChecker,
+	consistencyChecker *service.ConsistencyChecker,
+	configReloader ConfigReloader,
+) *Endpoint {
+	return &Endpoint{
+		allocHandler:       allocHandler,
+		serviceRegistry:    serviceRegistry,
+		healthChecker:      healthChecker,
+		consistencyChecker: consistencyChecker,
+		configReloader:     configReloader,
+	}
+}
@@ -0,0 +1,70 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+const (
+	HEALTH_STATUS_OK       = "ok"
+	HEALTH_STATUS_DEGRADED = "degraded"
+	HEALTH_STATUS_UNREADY  = "unready"
+)
+
+func (ep *Endpoint) Health(ctx context.Context) (result dto.HealthRespDto) {
+	healthStatus := ep.healthChecker.Check(ctx)
+	result = dto.HealthRespDto{
+		Ready:        healthStatus.Ready(),
+		ShuttingDown: healthStatus.ShuttingDown,
+		Warmup: &dto.WarmupStatusDto{
+			Mode:      healthStatus.Warmup.Mode,
+			Finished:  healthStatus.WarmedUp,
+			Total:     healthStatus.Warmup.Total,
+			Succeeded: healthStatus.Warmup.Finished,
+			Failed:    healthStatus.Warmup.Failed,
+			StartTime: healthStatus.Warmup.StartTime,
+			EndTime:   healthStatus.Warmup.EndTime,
+		},
+		Redis: newDependencyDto(healthStatus.Redis),
+		DB:    newDependencyDto(healthStatus.DB),
+		SyncQueue: &dto.SyncQueueDto{
+			Len:       healthStatus.SyncQueue.Len,
+			Cap:       healthStatus.SyncQueue.Cap,
+			Saturated: healthStatus.SyncQueue.Saturated,
+		},
+		Prefetch: &dto.PrefetchHealthDto{
+			LoadedNum: len(healthStatus.Prefetch),
+			Failed:    make(map[string]*dto.PrefetchStatusDto),
+		},
+	}
+	for serviceName, prefetchStatus := range healthStatus.Prefetch {
+		if prefetchStatus.Status != service.PREFETCH_FAILED {
+			continue
+		}
+		result.Prefetch.Failed[serviceName] = &dto.PrefetchStatusDto{
+			Status:    prefetchStatus.Status,
+			LastError: prefetchStatus.LastError,
+			UpdatedAt: prefetchStatus.UpdatedAt,
+		}
+	}
+
+	switch {
+	case !result.Ready:
+		result.Status = HEALTH_STATUS_UNREADY
+	case !result.DB.Reachable || len(result.Prefetch.Failed) > 0:
+		result.Status = HEALTH_STATUS_DEGRADED
+	default:
+		result.Status = HEALTH_STATUS_OK
+	}
+	return
+}
+
+func newDependencyDto(status service.DependencyStatus) *dto.DependencyDto {
+	return &dto.DependencyDto{
+		Reachable: status.Reachable,
+		LatencyMs: status.Latency.Milliseconds(),
+		Err:       status.Err,
+	}
+}
@@ -0,0 +1,82 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/daemon-coder/idalloc/service"
+)
+
+func (ep *Endpoint) ExportSnapshot(ctx context.Context) (*entity.Snapshot, error) {
+	return ep.allocHandler.ExportSnapshot(ctx)
+}
+
+// ImportSnapshot: the whole snapshot is checked before any counter is changed
+func (ep *Endpoint) ImportSnapshot(ctx context.Context, param dto.ImportSnapshotReqDto) (*dto.ImportSnapshotRespDto, error) {
+	param.Operator = operatorOf(ctx, param.Operator)
+	if len(param.Operator) == 0 {
+		return nil, e.NewParamError(e.WithMsg("operator is required"))
+	} else if err := checkSnapshot(param.Snapshot); err != nil {
+		return nil, err
+	}
+
+	results := ep.allocHandler.ImportSnapshot(ctx, param.Snapshot, param.Operator, param.Reason)
+	respDto := &dto.ImportSnapshotRespDto{Results: make([]*dto.ImportSnapshotResultDto, 0, len(results))}
+	for _, result := range results {
+		switch result.Result {
+		case service.SNAPSHOT_IMPORTED:
+			respDto.ImportedNum++
+		case service.SNAPSHOT_SKIPPED:
+			respDto.SkippedNum++
+		default:
+			respDto.FailedNum++
+		}
+		respDto.Results = append(respDto.Results, &dto.ImportSnapshotResultDto{
+			ServiceName:    result.ServiceName,
+			Result:         result.Result,
+			Msg:            result.Msg,
+			ServiceCreated: result.ServiceCreated,
+			Before:         result.Before,
+			After:          result.After,
+		})
+	}
+	return respDto, nil
+}
+
+// checkSnapshot: the service names are normalized in place
+func checkSnapshot(snapshot *entity.Snapshot) error {
+	if snapshot == nil {
+		return e.NewParamError(e.WithMsg("snapshot is required"))
+	} else if snapshot.FormatVersion < 1 || snapshot.FormatVersion > entity.SNAPSHOT_FORMAT_VERSION {
+		errMsg := fmt.Sprintf("format_version is not supported. max: %d input:%d", entity.SNAPSHOT_FORMAT_VERSION, snapshot.FormatVersion)
+		return e.NewParamError(e.WithMsg(errMsg))
+	}
+	serviceNameSet := make(map[string]struct{}, len(snapshot.Services))
+	for _, item := range snapshot.Services {
+		if item == nil {
+			return e.NewParamError(e.WithMsg("service is null"))
+		}
+		item.ServiceName = normalizeServiceName(item.ServiceName)
+		if len(item.ServiceName) == 0 || len(item.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+			return e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d input:%s", def.MAX_SERVICE_NAME_LENGTH, item.ServiceName)))
+		} else if _, ok := serviceNameSet[item.ServiceName]; ok {
+			return e.NewParamError(e.WithMsg("service_name is duplicated. input:" + item.ServiceName))
+		} else if item.IdType != "" && !entity.IsValidIdType(item.IdType) {
+			return e.NewParamError(e.WithMsg(fmt.Sprintf("id_type is invalid. service_name:%s id_type:%s", item.ServiceName, item.IdType)))
+		} else if item.LastAllocValue < entity.ZeroValue(item.IdType) || item.DataVersion < 0 {
+			errMsg := fmt.Sprintf("counter is invalid. service_name:%s last_alloc_value:%s data_version:%d", item.ServiceName, entity.FormatValue(item.IdType, item.LastAllocValue), item.DataVersion)
+			return e.NewParamError(e.WithMsg(errMsg))
+		}
+		switch item.Status {
+		case "", entity.SERVICE_STATUS_ACTIVE, entity.SERVICE_STATUS_FROZEN, entity.SERVICE_STATUS_RETIRED:
+		default:
+			return e.NewParamError(e.WithMsg(fmt.Sprintf("status is invalid. service_name:%s status:%s", item.ServiceName, item.Status)))
+		}
+		serviceNameSet[item.ServiceName] = struct{}{}
+	}
+	return nil
+}
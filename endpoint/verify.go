@@ -0,0 +1,50 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+)
+
+// Verify: whether the ids have been issued by idalloc, answered by the ledger
+func (ep *Endpoint) Verify(ctx context.Context, param dto.VerifyReqDto) (result dto.VerifyRespDto, err error) {
+	param.ServiceName = normalizeServiceName(param.ServiceName)
+	if len(param.ServiceName) == 0 || len(param.ServiceName) > def.MAX_SERVICE_NAME_LENGTH {
+		err = e.NewParamError(e.WithMsg(fmt.Sprintf("service_name is invalid. length: 1~%d", def.MAX_SERVICE_NAME_LENGTH)))
+		return
+	} else if len(param.Ids) == 0 || len(param.Ids) > def.MAX_VERIFY_ID_NUM {
+		err = e.NewParamError(e.WithMsg(fmt.Sprintf("ids is invalid. min: %d max: %d input:%d", 1, def.MAX_VERIFY_ID_NUM, len(param.Ids))))
+		return
+	}
+	idType, err := ep.allocHandler.GetIdType(ctx, param.ServiceName)
+	if err != nil {
+		return
+	}
+	ids := make([]int64, 0, len(param.Ids))
+	for _, input := range param.Ids {
+		id, parseErr := parseId(idType, input)
+		if parseErr != nil {
+			err = parseErr
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	verifyResults, err := ep.allocHandler.VerifyIds(ctx, param.ServiceName, idType, ids)
+	if err != nil {
+		return
+	}
+	result.Results = make([]*dto.VerifyResultDto, 0, len(verifyResults))
+	for _, verifyResult := range verifyResults {
+		result.Results = append(result.Results, &dto.VerifyResultDto{
+			Id:      entity.Value{IdType: idType, Raw: verifyResult.Id},
+			Status:  verifyResult.Status,
+			Segment: verifyResult.Segment,
+		})
+	}
+	return
+}
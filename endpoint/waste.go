@@ -0,0 +1,31 @@
+package endpoint
+
+import (
+	"context"
+
+	"github.com/daemon-coder/idalloc/definition/dto"
+)
+
+// GetWasteReport: the ids wasted by this instance since it started, partitioned by service and reason
+func (ep *Endpoint) GetWasteReport(ctx context.Context) (*dto.WasteReportDto, error) {
+	report := ep.allocHandler.WasteReport()
+	result := &dto.WasteReportDto{
+		Since:         report.Since,
+		BatchAllocNum: report.BatchAllocNum,
+		Services:      make([]*dto.ServiceWasteDto, 0, len(report.Services)),
+	}
+	for _, service := range report.Services {
+		item := &dto.ServiceWasteDto{
+			ServiceName: service.ServiceName,
+			SegmentNum:  service.SegmentNum,
+			FetchedIds:  service.FetchedIds,
+			WastedIds:   service.WastedIds,
+			TotalWasted: service.TotalWasted,
+		}
+		if service.FetchedIds > 0 {
+			item.WasteRatio = float64(service.TotalWasted) / float64(service.FetchedIds)
+		}
+		result.Services = append(result.Services, item)
+	}
+	return result, nil
+}
@@ -0,0 +1,415 @@
+package config_infra
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	MASKED_SECRET = "***"
+	PING_TIMEOUT  = 10 * time.Second
+
+	// MIN_ADMIN_TOKEN_LENGTH: the admin tokens are compared as they are, they should be random
+	MIN_ADMIN_TOKEN_LENGTH = 16
+)
+
+// FileConfig: the serializable form of definition.Config, the stores are given by DSNs and opened by Open
+type FileConfig struct {
+	AppName       string          `yaml:"app_name" toml:"app_name" json:"app_name"`
+	ServerPort    int             `yaml:"server_port" toml:"server_port" json:"server_port"`
+	LogLevel      string          `yaml:"log_level" toml:"log_level" json:"log_level"`
+	UsePprof      bool            `yaml:"use_pprof" toml:"use_pprof" json:"use_pprof"`
+	UsePrometheus bool            `yaml:"use_prometheus" toml:"use_prometheus" json:"use_prometheus"`
+	RateLimit     RateLimitConfig `yaml:"rate_limit" toml:"rate_limit" json:"rate_limit"`
+	Tracing       TracingConfig   `yaml:"tracing" toml:"tracing" json:"tracing"`
+	// AdminTokens: operator: token, the admin api is refused if it is empty
+	AdminTokens map[string]string `yaml:"admin_tokens" toml:"admin_tokens" json:"admin_tokens"`
+
+	// RedisDSN: redis://[user:password@]host:port[/db]
+	RedisDSN string `yaml:"redis_dsn" toml:"redis_dsn" json:"redis_dsn"`
+	// MysqlDSN: user:password@tcp(host:port)/dbname[?params]
+	MysqlDSN string `yaml:"mysql_dsn" toml:"mysql_dsn" json:"mysql_dsn"`
+
+	RedisKeyPrefix                 string               `yaml:"redis_key_prefix" toml:"redis_key_prefix" json:"redis_key_prefix"`
+	SyncRedisAndDBChanSize         int                  `yaml:"sync_redis_and_db_chan_size" toml:"sync_redis_and_db_chan_size" json:"sync_redis_and_db_chan_size"`
+	SyncRedisAndDBThreadNum        int                  `yaml:"sync_redis_and_db_thread_num" toml:"sync_redis_and_db_thread_num" json:"sync_redis_and_db_thread_num"`
+	RedisBatchAllocNum             int64                `yaml:"redis_batch_alloc_num" toml:"redis_batch_alloc_num" json:"redis_batch_alloc_num"`
+	WriteDBEveryNVersion           int64                `yaml:"write_db_every_n_version" toml:"write_db_every_n_version" json:"write_db_every_n_version"`
+	RecoverRedisEveryNVersion      int64                `yaml:"recover_redis_every_n_version" toml:"recover_redis_every_n_version" json:"recover_redis_every_n_version"`
+	IdempotentKeyExpire            time.Duration        `yaml:"idempotent_key_expire" toml:"idempotent_key_expire" json:"idempotent_key_expire"`
+	RejectUnknownService           bool                 `yaml:"reject_unknown_service" toml:"reject_unknown_service" json:"reject_unknown_service"`
+	ServiceRegistryRefreshInterval time.Duration        `yaml:"service_registry_refresh_interval" toml:"service_registry_refresh_interval" json:"service_registry_refresh_interval"`
+	WarmupMode                     string               `yaml:"warmup_mode" toml:"warmup_mode" json:"warmup_mode"`
+	WarmupServiceNames             []string             `yaml:"warmup_service_names" toml:"warmup_service_names" json:"warmup_service_names"`
+	WarmupConcurrency              int                  `yaml:"warmup_concurrency" toml:"warmup_concurrency" json:"warmup_concurrency"`
+	WarmupQps                      int                  `yaml:"warmup_qps" toml:"warmup_qps" json:"warmup_qps"`
+	ShutdownReadinessDelay         time.Duration        `yaml:"shutdown_readiness_delay" toml:"shutdown_readiness_delay" json:"shutdown_readiness_delay"`
+	ServiceHandlerIdleTimeout      time.Duration        `yaml:"service_handler_idle_timeout" toml:"service_handler_idle_timeout" json:"service_handler_idle_timeout"`
+	MaxServiceHandlerNum           int                  `yaml:"max_service_handler_num" toml:"max_service_handler_num" json:"max_service_handler_num"`
+	ConsistencyCheckInterval       time.Duration        `yaml:"consistency_check_interval" toml:"consistency_check_interval" json:"consistency_check_interval"`
+	ConsistencyAutoRepair          bool                 `yaml:"consistency_auto_repair" toml:"consistency_auto_repair" json:"consistency_auto_repair"`
+	SegmentJournal                 SegmentJournalConfig `yaml:"segment_journal" toml:"segment_journal" json:"segment_journal"`
+	// InstanceId: hostname:server_port if it is empty
+	InstanceId string       `yaml:"instance_id" toml:"instance_id" json:"instance_id"`
+	Ledger     LedgerConfig `yaml:"ledger" toml:"ledger" json:"ledger"`
+	// ExhaustionForecast: the counters are forecast against math.MaxInt64 unless max_values gives another max
+	ExhaustionForecast ExhaustionForecastConfig `yaml:"exhaustion_forecast" toml:"exhaustion_forecast" json:"exhaustion_forecast"`
+}
+
+type RateLimitConfig struct {
+	Enable bool `yaml:"enable" toml:"enable" json:"enable"`
+	Qps    int  `yaml:"qps" toml:"qps" json:"qps"`
+}
+
+type TracingConfig struct {
+	Enable       bool    `yaml:"enable" toml:"enable" json:"enable"`
+	Exporter     string  `yaml:"exporter" toml:"exporter" json:"exporter"`
+	OtlpEndpoint string  `yaml:"otlp_endpoint" toml:"otlp_endpoint" json:"otlp_endpoint"`
+	OtlpInsecure bool    `yaml:"otlp_insecure" toml:"otlp_insecure" json:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio" toml:"sample_ratio" json:"sample_ratio"`
+}
+
+type SegmentJournalConfig struct {
+	// Dir: the journal is disabled if it is empty
+	Dir           string        `yaml:"dir" toml:"dir" json:"dir"`
+	MaxFileSize   int64         `yaml:"max_file_size" toml:"max_file_size" json:"max_file_size"`
+	MaxFileNum    int           `yaml:"max_file_num" toml:"max_file_num" json:"max_file_num"`
+	FsyncPolicy   string        `yaml:"fsync_policy" toml:"fsync_policy" json:"fsync_policy"`
+	FsyncInterval time.Duration `yaml:"fsync_interval" toml:"fsync_interval" json:"fsync_interval"`
+}
+
+type LedgerConfig struct {
+	Enable    bool          `yaml:"enable" toml:"enable" json:"enable"`
+	Retention time.Duration `yaml:"retention" toml:"retention" json:"retention"`
+}
+
+type ExhaustionForecastConfig struct {
+	Window         time.Duration   `yaml:"window" toml:"window" json:"window"`
+	CheckInterval  time.Duration   `yaml:"check_interval" toml:"check_interval" json:"check_interval"`
+	WarnThresholds []time.Duration `yaml:"warn_thresholds" toml:"warn_thresholds" json:"warn_thresholds"`
+	// MaxValues: numbers or decimal strings, toml has no integers above 2^63-1
+	MaxValues map[string]Uint64Setting `yaml:"max_values" toml:"max_values" json:"max_values"`
+}
+
+// Uint64Setting: a uint64 given as a number or a decimal string, for the values of the uint64 services
+type Uint64Setting uint64
+
+func (v *Uint64Setting) parse(text string) error {
+	n, err := strconv.ParseUint(strings.TrimSpace(text), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s is not an unsigned 64-bit integer", text)
+	}
+	*v = Uint64Setting(n)
+	return nil
+}
+
+func (v *Uint64Setting) UnmarshalYAML(node *yaml.Node) error {
+	return v.parse(node.Value)
+}
+
+// UnmarshalTOML: the toml integers are int64, the larger values are given as strings
+func (v *Uint64Setting) UnmarshalTOML(data interface{}) error {
+	switch value := data.(type) {
+	case int64:
+		if value < 0 {
+			return fmt.Errorf("%d is not an unsigned 64-bit integer", value)
+		}
+		*v = Uint64Setting(value)
+		return nil
+	case string:
+		return v.parse(value)
+	}
+	return fmt.Errorf("%v is not an unsigned 64-bit integer", data)
+}
+
+func (v *Uint64Setting) UnmarshalJSON(data []byte) error {
+	return v.parse(strings.Trim(string(data), `"`))
+}
+
+// DefaultFileConfig: the values used for the settings given by none of the file, the env vars and the flags
+func DefaultFileConfig() *FileConfig {
+	return &FileConfig{
+		AppName:    def.DEFAULT_APP_NAME,
+		ServerPort: def.DEFAULT_SERVER_PORT,
+		LogLevel:   def.DEFAULT_LOG_LEVEL,
+		Tracing: TracingConfig{
+			Exporter:    def.DEFAULT_TRACING_EXPORTER,
+			SampleRatio: def.DEFAULT_TRACING_SAMPLE_RATIO,
+		},
+		RedisKeyPrefix:                 def.DEFAULT_REDIS_KEY_PREFIX,
+		SyncRedisAndDBChanSize:         def.DEFAULT_SYNC_REDIS_AND_DB_CHAN_SIZE,
+		SyncRedisAndDBThreadNum:        def.DEFAULT_SYNC_REDIS_AND_DB_THREAD_NUM,
+		RedisBatchAllocNum:             def.DEFAULT_REDIS_BATCH_ALLOC_NUM,
+		WriteDBEveryNVersion:           def.DEFAULT_WRITE_DB_EVERY_N_VERSION,
+		RecoverRedisEveryNVersion:      def.DEFAULT_RECOVER_REDIS_EVERY_N_VERSION,
+		IdempotentKeyExpire:            def.DEFAULT_IDEMPOTENT_KEY_EXPIRE,
+		ServiceRegistryRefreshInterval: def.DEFAULT_SERVICE_REGISTRY_REFRESH,
+		WarmupMode:                     def.DEFAULT_WARMUP_MODE,
+		WarmupConcurrency:              def.DEFAULT_WARMUP_CONCURRENCY,
+		ConsistencyCheckInterval:       def.DEFAULT_CONSISTENCY_CHECK_INTERVAL,
+		SegmentJournal: SegmentJournalConfig{
+			MaxFileSize:   def.DEFAULT_SEGMENT_JOURNAL_MAX_FILE_SIZE,
+			MaxFileNum:    def.DEFAULT_SEGMENT_JOURNAL_MAX_FILE_NUM,
+			FsyncPolicy:   def.DEFAULT_SEGMENT_JOURNAL_FSYNC_POLICY,
+			FsyncInterval: def.DEFAULT_SEGMENT_JOURNAL_FSYNC_INTERVAL,
+		},
+		ExhaustionForecast: ExhaustionForecastConfig{
+			Window:         def.DEFAULT_EXHAUSTION_FORECAST_WINDOW,
+			CheckInterval:  def.DEFAULT_EXHAUSTION_FORECAST_CHECK_INTERVAL,
+			WarnThresholds: append([]time.Duration(nil), def.DEFAULT_EXHAUSTION_FORECAST_WARN_THRESHOLDS...),
+		},
+	}
+}
+
+// Validate: every invalid setting is reported, none of them is replaced by its default
+func (c *FileConfig) Validate() error {
+	problems := make([]string, 0)
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.AppName != "", "app_name is empty")
+	check(c.ServerPort > 0 && c.ServerPort <= 65535, "server_port must be 1~65535, input:%d", c.ServerPort)
+	check(isKnownLogLevel(c.LogLevel), "log_level must be one of DEBUG/INFO/WARN/ERROR, input:%s", c.LogLevel)
+	check(!c.RateLimit.Enable || c.RateLimit.Qps > 0, "rate_limit.qps must be positive when rate_limit is enabled, input:%d", c.RateLimit.Qps)
+	if c.Tracing.Enable {
+		check(
+			c.Tracing.Exporter == def.TRACING_EXPORTER_STDOUT || c.Tracing.Exporter == def.TRACING_EXPORTER_OTLP,
+			"tracing.exporter must be %s or %s, input:%s", def.TRACING_EXPORTER_STDOUT, def.TRACING_EXPORTER_OTLP, c.Tracing.Exporter,
+		)
+		check(c.Tracing.Exporter != def.TRACING_EXPORTER_OTLP || c.Tracing.OtlpEndpoint != "", "tracing.otlp_endpoint is empty")
+		check(c.Tracing.SampleRatio > 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be in (0, 1], input:%v", c.Tracing.SampleRatio)
+	}
+
+	adminTokens := make(map[string]struct{}, len(c.AdminTokens))
+	for operator, token := range c.AdminTokens {
+		check(strings.TrimSpace(operator) != "", "admin_tokens has an empty operator")
+		check(len(token) >= MIN_ADMIN_TOKEN_LENGTH, "admin_tokens of %s must be at least %d characters", operator, MIN_ADMIN_TOKEN_LENGTH)
+		_, duplicated := adminTokens[token]
+		check(!duplicated, "admin_tokens of %s is used by another operator", operator)
+		adminTokens[token] = struct{}{}
+	}
+
+	check(c.RedisDSN != "", "redis_dsn is empty")
+	check(c.MysqlDSN != "", "mysql_dsn is empty")
+	check(c.RedisKeyPrefix != "", "redis_key_prefix is empty")
+	check(c.SyncRedisAndDBChanSize > 0, "sync_redis_and_db_chan_size must be positive, input:%d", c.SyncRedisAndDBChanSize)
+	check(c.SyncRedisAndDBThreadNum > 0, "sync_redis_and_db_thread_num must be positive, input:%d", c.SyncRedisAndDBThreadNum)
+	check(
+		c.RedisBatchAllocNum >= def.MAX_USER_BATCH_ALLOC_NUM,
+		"redis_batch_alloc_num must be at least %d, input:%d", def.MAX_USER_BATCH_ALLOC_NUM, c.RedisBatchAllocNum,
+	)
+	check(c.WriteDBEveryNVersion > 0, "write_db_every_n_version must be positive, input:%d", c.WriteDBEveryNVersion)
+	check(c.RecoverRedisEveryNVersion > 0, "recover_redis_every_n_version must be positive, input:%d", c.RecoverRedisEveryNVersion)
+	check(c.IdempotentKeyExpire > 0, "idempotent_key_expire must be positive, input:%s", c.IdempotentKeyExpire)
+	check(c.ServiceRegistryRefreshInterval > 0, "service_registry_refresh_interval must be positive, input:%s", c.ServiceRegistryRefreshInterval)
+	switch c.WarmupMode {
+	case def.WARMUP_MODE_EAGER, def.WARMUP_MODE_LAZY:
+	case def.WARMUP_MODE_HOT:
+		check(len(c.WarmupServiceNames) > 0, "warmup_service_names is empty in warmup_mode %s", def.WARMUP_MODE_HOT)
+	default:
+		check(false, "warmup_mode must be one of %s/%s/%s, input:%s", def.WARMUP_MODE_EAGER, def.WARMUP_MODE_LAZY, def.WARMUP_MODE_HOT, c.WarmupMode)
+	}
+	check(c.WarmupConcurrency > 0, "warmup_concurrency must be positive, input:%d", c.WarmupConcurrency)
+	check(c.WarmupQps >= 0, "warmup_qps must not be negative, input:%d", c.WarmupQps)
+	check(c.ShutdownReadinessDelay >= 0, "shutdown_readiness_delay must not be negative, input:%s", c.ShutdownReadinessDelay)
+	check(c.ServiceHandlerIdleTimeout >= 0, "service_handler_idle_timeout must not be negative, input:%s", c.ServiceHandlerIdleTimeout)
+	check(c.MaxServiceHandlerNum >= 0, "max_service_handler_num must not be negative, input:%d", c.MaxServiceHandlerNum)
+	check(c.ConsistencyCheckInterval >= 0, "consistency_check_interval must not be negative, input:%s", c.ConsistencyCheckInterval)
+	check(c.Ledger.Retention >= 0, "ledger.retention must not be negative, input:%s", c.Ledger.Retention)
+	check(c.ExhaustionForecast.Window > 0, "exhaustion_forecast.window must be positive, input:%s", c.ExhaustionForecast.Window)
+	check(c.ExhaustionForecast.CheckInterval >= 0, "exhaustion_forecast.check_interval must not be negative, input:%s", c.ExhaustionForecast.CheckInterval)
+	for _, threshold := range c.ExhaustionForecast.WarnThresholds {
+		check(threshold > 0, "exhaustion_forecast.warn_thresholds must be positive, input:%s", threshold)
+	}
+	for serviceName, maxValue := range c.ExhaustionForecast.MaxValues {
+		check(maxValue > 0, "exhaustion_forecast.max_values must be positive, input:%s:%d", serviceName, uint64(maxValue))
+	}
+	if c.SegmentJournal.Dir != "" {
+		check(c.SegmentJournal.MaxFileSize > 0, "segment_journal.max_file_size must be positive, input:%d", c.SegmentJournal.MaxFileSize)
+		check(c.SegmentJournal.MaxFileNum > 0, "segment_journal.max_file_num must be positive, input:%d", c.SegmentJournal.MaxFileNum)
+		switch c.SegmentJournal.FsyncPolicy {
+		case def.SEGMENT_JOURNAL_FSYNC_ALWAYS, def.SEGMENT_JOURNAL_FSYNC_NEVER:
+		case def.SEGMENT_JOURNAL_FSYNC_INTERVAL:
+			check(c.SegmentJournal.FsyncInterval > 0, "segment_journal.fsync_interval must be positive, input:%s", c.SegmentJournal.FsyncInterval)
+		default:
+			check(false, "segment_journal.fsync_policy must be one of %s/%s/%s, input:%s",
+				def.SEGMENT_JOURNAL_FSYNC_ALWAYS, def.SEGMENT_JOURNAL_FSYNC_INTERVAL, def.SEGMENT_JOURNAL_FSYNC_NEVER, c.SegmentJournal.FsyncPolicy)
+		}
+	}
+
+	if len(problems) > 0 {
+		return e.NewParamError(e.WithMsg("config invalid. "+strings.Join(problems, "; ")), e.WithData(problems))
+	}
+	return nil
+}
+
+func isKnownLogLevel(logLevel string) bool {
+	switch strings.ToUpper(logLevel) {
+	case "DEBUG", "INFO", "WARN", "ERROR":
+		return true
+	default:
+		return false
+	}
+}
+
+// Masked: a copy safe to be printed, the passwords in the DSNs and the admin tokens are replaced by MASKED_SECRET
+func (c *FileConfig) Masked() *FileConfig {
+	result := *c
+	result.WarmupServiceNames = append([]string(nil), c.WarmupServiceNames...)
+	result.ExhaustionForecast.WarnThresholds = append([]time.Duration(nil), c.ExhaustionForecast.WarnThresholds...)
+	result.RedisDSN = maskRedisDSN(c.RedisDSN)
+	if c.AdminTokens != nil {
+		result.AdminTokens = make(map[string]string, len(c.AdminTokens))
+		for operator := range c.AdminTokens {
+			result.AdminTokens[operator] = MASKED_SECRET
+		}
+	}
+	result.MysqlDSN = maskMysqlDSN(c.MysqlDSN)
+	return &result
+}
+
+// maskRedisDSN: the whole DSN is masked if it can not be parsed, so that nothing leaks
+func maskRedisDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return MASKED_SECRET
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), MASKED_SECRET)
+	}
+	// url escapes the mask in the userinfo
+	return strings.Replace(u.String(), url.PathEscape(MASKED_SECRET), MASKED_SECRET, 1)
+}
+
+func maskMysqlDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return MASKED_SECRET
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = MASKED_SECRET
+	}
+	return cfg.FormatDSN()
+}
+
+// Open: connect to the stores given by the DSNs, the connections are closed if any of them is unreachable
+func (c *FileConfig) Open(ctx context.Context) (*def.Config, error) {
+	redisOptions, err := redis.ParseURL(c.RedisDSN)
+	if err != nil {
+		return nil, e.NewParamError(e.WithMsg("config invalid. redis_dsn: " + err.Error()))
+	}
+	redisClient := redis.NewClient(redisOptions)
+	pingCtx, cancel := context.WithTimeout(ctx, PING_TIMEOUT)
+	defer cancel()
+	if err = redisClient.Ping(pingCtx).Err(); err != nil {
+		redisClient.Close()
+		return nil, e.NewCriticalError(e.WithMsg("redis ping failed: " + err.Error()))
+	}
+
+	db, err := sql.Open("mysql", c.MysqlDSN)
+	if err != nil {
+		redisClient.Close()
+		return nil, e.NewParamError(e.WithMsg("config invalid. mysql_dsn: " + err.Error()))
+	}
+	if err = db.PingContext(pingCtx); err != nil {
+		db.Close()
+		redisClient.Close()
+		return nil, e.NewCriticalError(e.WithMsg("mysql ping failed: " + err.Error()))
+	}
+
+	config := c.ToConfig()
+	config.DB = db
+	config.Redis = redisClient
+	return config, nil
+}
+
+// ToConfig: the config without the stores, e.g. to compare the settings on a reload
+func (c *FileConfig) ToConfig() *def.Config {
+	return &def.Config{
+		AppName:       c.AppName,
+		ServerPort:    c.ServerPort,
+		LogLevel:      strings.ToUpper(c.LogLevel),
+		UsePprof:      c.UsePprof,
+		UsePrometheus: c.UsePrometheus,
+		RateLimit: def.RateLimit{
+			Enable: c.RateLimit.Enable,
+			Qps:    c.RateLimit.Qps,
+		},
+		Tracing: def.Tracing{
+			Enable:       c.Tracing.Enable,
+			Exporter:     c.Tracing.Exporter,
+			OtlpEndpoint: c.Tracing.OtlpEndpoint,
+			OtlpInsecure: c.Tracing.OtlpInsecure,
+			SampleRatio:  c.Tracing.SampleRatio,
+		},
+		AdminTokens: c.AdminTokens,
+
+		RedisKeyPrefix:                 c.RedisKeyPrefix,
+		SyncRedisAndDBChanSize:         c.SyncRedisAndDBChanSize,
+		SyncRedisAndDBThreadNum:        c.SyncRedisAndDBThreadNum,
+		RedisBatchAllocNum:             c.RedisBatchAllocNum,
+		WriteDBEveryNVersion:           c.WriteDBEveryNVersion,
+		RecoverRedisEveryNVersion:      c.RecoverRedisEveryNVersion,
+		IdempotentKeyExpire:            c.IdempotentKeyExpire,
+		RejectUnknownService:           c.RejectUnknownService,
+		ServiceRegistryRefreshInterval: c.ServiceRegistryRefreshInterval,
+		WarmupMode:                     c.WarmupMode,
+		WarmupServiceNames:             c.WarmupServiceNames,
+		WarmupConcurrency:              c.WarmupConcurrency,
+		WarmupQps:                      c.WarmupQps,
+		ShutdownReadinessDelay:         c.ShutdownReadinessDelay,
+		ServiceHandlerIdleTimeout:      c.ServiceHandlerIdleTimeout,
+		MaxServiceHandlerNum:           c.MaxServiceHandlerNum,
+		ConsistencyCheckInterval:       c.ConsistencyCheckInterval,
+		ConsistencyAutoRepair:          c.ConsistencyAutoRepair,
+		SegmentJournal: def.SegmentJournal{
+			Dir:           c.SegmentJournal.Dir,
+			MaxFileSize:   c.SegmentJournal.MaxFileSize,
+			MaxFileNum:    c.SegmentJournal.MaxFileNum,
+			FsyncPolicy:   c.SegmentJournal.FsyncPolicy,
+			FsyncInterval: c.SegmentJournal.FsyncInterval,
+		},
+		InstanceId: c.InstanceId,
+		Ledger: def.Ledger{
+			Enable:    c.Ledger.Enable,
+			Retention: c.Ledger.Retention,
+		},
+		ExhaustionForecast: def.ExhaustionForecast{
+			Window:         c.ExhaustionForecast.Window,
+			CheckInterval:  c.ExhaustionForecast.CheckInterval,
+			WarnThresholds: c.ExhaustionForecast.WarnThresholds,
+			MaxValues:      c.ExhaustionForecast.maxValues(),
+		},
+	}
+}
+
+func (c ExhaustionForecastConfig) maxValues() map[string]uint64 {
+	if c.MaxValues == nil {
+		return nil
+	}
+	result := make(map[string]uint64, len(c.MaxValues))
+	for serviceName, maxValue := range c.MaxValues {
+		result[serviceName] = uint64(maxValue)
+	}
+	return result
+}
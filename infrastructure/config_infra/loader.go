@@ -0,0 +1,249 @@
+package config_infra
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ENV_PREFIX: the setting rate_limit.qps is read from IDALLOC_RATE_LIMIT_QPS
+	ENV_PREFIX = "IDALLOC_"
+	// CONFIG_FLAG: the flag giving the path of the config file, .yaml/.yml or .toml
+	CONFIG_FLAG = "config"
+)
+
+// Source: where the config is loaded from, so that it can be loaded again for a reload
+type Source struct {
+	// Path: the config file, empty if there is none
+	Path string
+	// PrintConfig: print the effective config and exit
+	PrintConfig bool
+	// flagValues: the raw values of the setting flags given, by setting key
+	flagValues map[string]string
+}
+
+// setting: a leaf field of FileConfig, rate_limit.qps is keyed rate_limit_qps
+type setting struct {
+	key   string
+	field reflect.Value
+}
+
+// ParseFlags: returns flag.ErrHelp if -h is given
+func ParseFlags(args []string) (*Source, error) {
+	source := &Source{flagValues: make(map[string]string)}
+	flagSet := flag.NewFlagSet("idalloc", flag.ContinueOnError)
+	flagSet.StringVar(&source.Path, CONFIG_FLAG, "", "path of the config file, .yaml/.yml or .toml")
+	flagSet.BoolVar(&source.PrintConfig, "print-config", false, "print the effective config with the secrets masked and exit")
+	// the setting flags are only collected here, they are applied after the file and the env vars
+	for _, s := range listSettings(reflect.ValueOf(DefaultFileConfig()).Elem(), "") {
+		flagSet.Var(&collectedFlag{key: s.key, values: source.flagValues, isBool: s.field.Kind() == reflect.Bool}, flagName(s.key), "overrides "+s.key)
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+	if flagSet.NArg() > 0 {
+		return nil, e.NewParamError(e.WithMsg("unexpected arguments: " + strings.Join(flagSet.Args(), " ")))
+	}
+	return source, nil
+}
+
+// Load: the defaults are overridden by the config file, then by the env vars, then by the flags.
+// It reads the file and the env vars again on every call.
+func (s *Source) Load() (*FileConfig, error) {
+	config := DefaultFileConfig()
+	if s.Path != "" {
+		if err := loadFile(s.Path, config); err != nil {
+			return nil, err
+		}
+	}
+	for _, setting := range listSettings(reflect.ValueOf(config).Elem(), "") {
+		envName := ENV_PREFIX + strings.ToUpper(setting.key)
+		if raw, ok := os.LookupEnv(envName); ok {
+			if err := setField(setting.field, raw); err != nil {
+				return nil, e.NewParamError(e.WithMsg(fmt.Sprintf("env %s invalid: %s", envName, err.Error())))
+			}
+		}
+		if raw, ok := s.flagValues[setting.key]; ok {
+			if err := setField(setting.field, raw); err != nil {
+				return nil, e.NewParamError(e.WithMsg(fmt.Sprintf("flag -%s invalid: %s", flagName(setting.key), err.Error())))
+			}
+		}
+	}
+	return config, nil
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+func loadFile(path string, config *FileConfig) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return e.NewParamError(e.WithMsg("read config file failed: " + err.Error()))
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), config)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown settings: %v", meta.Undecoded())
+		}
+	default:
+		return e.NewParamError(e.WithMsg("config file must be .yaml, .yml or .toml: " + path))
+	}
+	if err != nil {
+		return e.NewParamError(e.WithMsg(fmt.Sprintf("parse config file %s failed: %s", path, err.Error())))
+	}
+	return nil
+}
+
+func listSettings(v reflect.Value, prefix string) []setting {
+	result := make([]setting, 0)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		key := prefix + strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if field.Kind() == reflect.Struct {
+			result = append(result, listSettings(field, key+"_")...)
+		} else {
+			result = append(result, setting{key: key, field: field})
+		}
+	}
+	return result
+}
+
+// setField: durations are like 30s, lists are separated by commas, maps are like order:100,user:200
+func setField(field reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		items := make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		if field.Type().Elem() != reflect.TypeOf(time.Duration(0)) {
+			field.Set(reflect.ValueOf(items))
+			return nil
+		}
+		durations := make([]time.Duration, 0, len(items))
+		for _, item := range items {
+			d, err := time.ParseDuration(item)
+			if err != nil {
+				return err
+			}
+			durations = append(durations, d)
+		}
+		field.Set(reflect.ValueOf(durations))
+	case reflect.Map:
+		if field.Type() != reflect.TypeOf(map[string]Uint64Setting(nil)) && field.Type() != reflect.TypeOf(map[string]string(nil)) {
+			return fmt.Errorf("unsupported type %s", field.Type())
+		}
+		values := reflect.MakeMap(field.Type())
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(item, ":")
+			if !ok {
+				return fmt.Errorf("%s is not like key:value", item)
+			}
+			if field.Type().Elem().Kind() == reflect.String {
+				values.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), reflect.ValueOf(strings.TrimSpace(value)))
+				continue
+			}
+			var n Uint64Setting
+			if err := n.parse(value); err != nil {
+				return err
+			}
+			values.SetMapIndex(reflect.ValueOf(strings.TrimSpace(key)), reflect.ValueOf(n))
+		}
+		field.Set(values)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+type collectedFlag struct {
+	key    string
+	values map[string]string
+	isBool bool
+}
+
+func (f *collectedFlag) String() string {
+	return ""
+}
+
+func (f *collectedFlag) Set(raw string) error {
+	f.values[f.key] = raw
+	return nil
+}
+
+func (f *collectedFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// LogFields: the settings as key-value pairs for a log line, mask the config first
+func (c *FileConfig) LogFields() []interface{} {
+	result := make([]interface{}, 0)
+	for _, s := range listSettings(reflect.ValueOf(c).Elem(), "") {
+		if d, ok := s.field.Interface().(time.Duration); ok {
+			result = append(result, s.key, d.String())
+		} else {
+			result = append(result, s.key, s.field.Interface())
+		}
+	}
+	return result
+}
+
+// Yaml: the config in the format of the config file, mask the config first
+func (c *FileConfig) Yaml() string {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
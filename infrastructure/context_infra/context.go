@@ -0,0 +1,71 @@
+package context_infra
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type traceIdKey struct{}
+
+type requestMetaKey struct{}
+
+type operatorKey struct{}
+
+// RequestMeta: the metadata of the http request being served
+type RequestMeta struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+func WithTraceId(ctx context.Context, traceId string) context.Context {
+	if len(traceId) == 0 {
+		traceId = NewRandomTraceId()
+	}
+	return context.WithValue(ctx, traceIdKey{}, traceId)
+}
+
+func GetTraceId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	traceId, _ := ctx.Value(traceIdKey{}).(string)
+	return traceId
+}
+
+func NewRandomTraceId() string {
+	uid, err := uuid.NewRandom()
+	if err != nil {
+		return ""
+	}
+	return strings.ReplaceAll(uid.String(), "-", "")
+}
+
+func WithRequestMeta(ctx context.Context, meta *RequestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, meta)
+}
+
+// GetRequestMeta returns nil outside of http requests
+func GetRequestMeta(ctx context.Context) *RequestMeta {
+	if ctx == nil {
+		return nil
+	}
+	meta, _ := ctx.Value(requestMetaKey{}).(*RequestMeta)
+	return meta
+}
+
+// WithOperator: the operator authenticated by the admin token of the request
+func WithOperator(ctx context.Context, operator string) context.Context {
+	return context.WithValue(ctx, operatorKey{}, operator)
+}
+
+// GetOperator returns "" outside of the authenticated admin requests
+func GetOperator(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	operator, _ := ctx.Value(operatorKey{}).(string)
+	return operator
+}
@@ -1,7 +0,0 @@
-package db_infra
-
-import (
-	"database/sql"
-)
-
-var DBClient *sql.DB
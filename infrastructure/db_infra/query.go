@@ -1,85 +1,133 @@
 package db_infra
 
 import (
+	"context"
 	"database/sql"
 
 	e "github.com/daemon-coder/idalloc/definition/errors"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // To be compatible with DM database, we did not use an ORM framework here; we will switch to GORM later.
 
 type SqlUtil struct {
+	DB   *sql.DB
 	Sql  string
 	Args []interface{}
 }
 
-func (q SqlUtil) QueryOne(rowParser func(*sql.Row) error) {
-	stmt := Prepare(q.Sql)
+func (q SqlUtil) QueryOne(ctx context.Context, rowParser func(*sql.Row) error) (err error) {
+	traceInfra.WithSpan(ctx, "db.QueryOne", func(ctx context.Context, span trace.Span) {
+		err = q.queryOne(ctx, rowParser)
+		recordSpanError(span, err)
+	}, attribute.String("db.statement", q.Sql))
+	return
+}
+
+func (q SqlUtil) queryOne(ctx context.Context, rowParser func(*sql.Row) error) error {
+	stmt, err := Prepare(ctx, q.DB, q.Sql)
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
 
-	row := stmt.QueryRow(q.Args...)
+	row := stmt.QueryRowContext(ctx, q.Args...)
 
-	err := rowParser(row)
+	err = rowParser(row)
 	if err != nil && err != sql.ErrNoRows {
-		log.GetLogger().Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
-		e.NewCriticalError(
+		log.WithContext(ctx).Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
+		return e.NewCriticalError(
 			e.WithMsg("SqlRowParseError"),
 			e.WithData(map[string]interface{}{
-				"sql": q.Sql, "args": q.Args, "err": err,
+				"sql": q.Sql, "args": q.Args, "err": err.Error(),
 			}),
-		).Panic()
+		)
 	}
+	return nil
+}
+
+func (q SqlUtil) QueryList(ctx context.Context, rowParser func(*sql.Rows) error) (err error) {
+	traceInfra.WithSpan(ctx, "db.QueryList", func(ctx context.Context, span trace.Span) {
+		err = q.queryList(ctx, rowParser)
+		recordSpanError(span, err)
+	}, attribute.String("db.statement", q.Sql))
+	return
 }
 
-func (q SqlUtil) QueryList(rowParser func(*sql.Rows) error) {
-	stmt := Prepare(q.Sql)
+func (q SqlUtil) queryList(ctx context.Context, rowParser func(*sql.Rows) error) error {
+	stmt, err := Prepare(ctx, q.DB, q.Sql)
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(q.Args...)
+	rows, err := stmt.QueryContext(ctx, q.Args...)
 	if err == sql.ErrNoRows {
-		return
+		return nil
 	} else if err != nil {
-		log.GetLogger().Warnw("QueryDbError", "sql", q.Sql, "args", q.Args, "err", err)
-		e.NewServerError(
+		log.WithContext(ctx).Warnw("QueryDbError", "sql", q.Sql, "args", q.Args, "err", err)
+		return e.NewServerError(
 			e.WithMsg("QueryDbError"),
 			e.WithData(map[string]interface{}{
-				"sql": q.Sql, "args": q.Args, "err": err,
+				"sql": q.Sql, "args": q.Args, "err": err.Error(),
 			}),
-		).Panic()
+		)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		err := rowParser(rows)
 		if err != nil && err != sql.ErrNoRows {
-			log.GetLogger().Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
-			e.NewCriticalError(
+			log.WithContext(ctx).Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
+			return e.NewCriticalError(
 				e.WithMsg("SqlRowParseError"),
 				e.WithData(map[string]interface{}{
-					"sql": q.Sql, "args": q.Args, "err": err,
+					"sql": q.Sql, "args": q.Args, "err": err.Error(),
 				}),
-			).Panic()
+			)
 		}
 	}
 	if err = rows.Err(); err != nil {
-		log.GetLogger().Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
-		e.NewCriticalError(
+		log.WithContext(ctx).Warnw("SqlRowParseError", "sql", q.Sql, "args", q.Args, "err", err)
+		return e.NewCriticalError(
 			e.WithMsg("SqlRowParseError"),
 			e.WithData(map[string]interface{}{
-				"sql": q.Sql, "args": q.Args, "err": err,
+				"sql": q.Sql, "args": q.Args, "err": err.Error(),
 			}),
-		).Panic()
+		)
 	}
+	return nil
+}
+
+func (q SqlUtil) Exec(ctx context.Context) (rowsAffected, lastInsertId int64, err error) {
+	traceInfra.WithSpan(ctx, "db.Exec", func(ctx context.Context, span trace.Span) {
+		rowsAffected, lastInsertId, err = q.exec(ctx)
+		recordSpanError(span, err)
+	}, attribute.String("db.statement", q.Sql))
+	return
 }
 
-func (q SqlUtil) Exec() (rowsAffected, lastInsertId int64, err error) {
-	stmt := Prepare(q.Sql)
+func (q SqlUtil) exec(ctx context.Context) (rowsAffected, lastInsertId int64, err error) {
+	stmt, err := Prepare(ctx, q.DB, q.Sql)
+	if err != nil {
+		return
+	}
 	defer stmt.Close()
 
-	sqlResult, err := stmt.Exec(q.Args...)
+	sqlResult, err := stmt.ExecContext(ctx, q.Args...)
 	if err != nil {
-		log.GetLogger().Warnw("SqlExecError", "sql", q.Sql, "args", q.Args, "err", err)
+		log.WithContext(ctx).Warnw("SqlExecError", "sql", q.Sql, "args", q.Args, "err", err)
+		err = e.NewServerError(
+			e.WithMsg("SqlExecError"),
+			e.WithData(map[string]interface{}{
+				"sql": q.Sql, "args": q.Args, "err": err.Error(),
+			}),
+		)
+		return
 	}
 	rowsAffected, _ = sqlResult.RowsAffected()
 	lastInsertId, _ = sqlResult.LastInsertId()
@@ -87,16 +135,23 @@ func (q SqlUtil) Exec() (rowsAffected, lastInsertId int64, err error) {
 }
 
 
-func Prepare(sqlStr string) *sql.Stmt {
-	stmt, err := DBClient.Prepare(sqlStr)
+func Prepare(ctx context.Context, db *sql.DB, sqlStr string) (*sql.Stmt, error) {
+	stmt, err := db.PrepareContext(ctx, sqlStr)
 	if err != nil {
-		log.GetLogger().Warnw("SqlError", "sql", sqlStr, "err", err)
-		e.NewCriticalError(
+		log.WithContext(ctx).Warnw("SqlError", "sql", sqlStr, "err", err)
+		return nil, e.NewServerError(
 			e.WithMsg("SqlError"),
 			e.WithData(map[string]interface{}{
-				"sql": sqlStr, "err": err,
+				"sql": sqlStr, "err": err.Error(),
 			}),
-		).Panic()
+		)
+	}
+	return stmt, nil
+}
+
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
-	return stmt
 }
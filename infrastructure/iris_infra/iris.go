@@ -11,24 +11,34 @@ import (
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/middleware/pprof"
 	"github.com/kataras/iris/v12/middleware/recover"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type IrisApp struct {
 	*iris.Application
-	Stopped chan struct{}
+	Stopped     chan struct{}
+	RateLimiter *middleware.RateLimiter
+	AdminAuth   *middleware.AdminAuth
+	ctx         context.Context
 }
 
-func NewIrisApp(cfg *definition.Config, addRouteFn func(*IrisApp)) *IrisApp {
+// NewIrisApp: ctx carries the logger of the server, which is used by the requests too
+func NewIrisApp(ctx context.Context, cfg *definition.Config, registry *prometheus.Registry, addRouteFn func(*IrisApp)) *IrisApp {
 	app := &IrisApp{
 		Application: iris.New(),
 		Stopped:     make(chan struct{}),
+		RateLimiter: middleware.NewRateLimiter(cfg.RateLimit),
+		AdminAuth:   middleware.NewAdminAuth(cfg.AdminTokens),
+		ctx:         ctx,
 	}
+	app.Use(middleware.NewLoggerMiddleware(log.LoggerFromContext(ctx)))
 	app.Use(recover.New())
 	app.Use(middleware.NewTraceIdMiddleware())
+	app.Use(middleware.NewTracingMiddleware())
 	app.Use(middleware.NewAccessLogMiddleware())
 	app.Use(middleware.NewPanicRecoerMiddleware())
-	app.Use(middleware.NewRateLimitMiddleware())
+	app.Use(app.RateLimiter.Middleware())
 
 	addRouteFn(app)
 
@@ -41,9 +51,9 @@ func NewIrisApp(cfg *definition.Config, addRouteFn func(*IrisApp)) *IrisApp {
 
 	// prometheus
 	if cfg.UsePrometheus {
-		m := middleware.NewPrometheusMiddleware(cfg.AppName)
+		m := middleware.NewPrometheusMiddleware(registry, cfg.AppName)
 		app.Use(m.ServeHTTP)
-		app.Get("/metrics", iris.FromStd(promhttp.Handler()))
+		app.Get("/metrics", iris.FromStd(promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})))
 	}
 	return app
 }
@@ -64,13 +74,13 @@ func (app *IrisApp) Start(cfg *definition.Config) {
 				Charset:                           "UTF-8",
 			}),
 		)
-		log.GetLogger().Infow("IrisShutDownFinish", "err", err)
+		log.WithContext(app.ctx).Infow("IrisShutDownFinish", "err", err)
 	}()
 }
 
 func (app *IrisApp) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	log.GetLogger().Info("IrisShutdownGracefully")
+	log.WithContext(app.ctx).Info("IrisShutdownGracefully")
 	app.Application.Shutdown(ctx)
 }
@@ -4,7 +4,7 @@ import (
 	"time"
 
 	"github.com/daemon-coder/idalloc/definition"
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 	"github.com/kataras/iris/v12/context"
 )
 
@@ -14,7 +14,7 @@ func JsonWrapper(transportHandler TransportHandler) context.Handler {
 	return func(ctx *context.Context) {
 		result := transportHandler(ctx)
 		if result.TraceId == "" {
-			result.TraceId = threadLocal.GetTraceId()
+			result.TraceId = ctxInfra.GetTraceId(ctx.Request().Context())
 		}
 		if result.Ts == 0 {
 			result.Ts = time.Now().UnixMilli()
@@ -4,6 +4,7 @@ import (
 	"time"
 
 	"github.com/kataras/iris/v12"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
 
 	"go.uber.org/zap"
@@ -25,11 +26,15 @@ func NewAccessLogMiddleware() iris.Handler {
 				zap.Duration("latency", latency),
 			}
 
+			if traceId := ctxInfra.GetTraceId(ctx.Request().Context()); traceId != "" {
+				fields = append(fields, zap.String("traceId", traceId))
+			}
+
 			if ctx.GetErr() != nil {
 				fields = append(fields, zap.Error(ctx.GetErr()))
-				log.Logger.Info("AccessError", fields...)
+				log.LoggerFromContext(ctx.Request().Context()).Info("AccessError", fields...)
 			} else {
-				log.Logger.Info("AccessLog", fields...)
+				log.LoggerFromContext(ctx.Request().Context()).Info("AccessLog", fields...)
 			}
 		}()
 		ctx.Next()
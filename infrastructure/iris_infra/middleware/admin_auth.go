@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/daemon-coder/idalloc/definition"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/kataras/iris/v12"
+)
+
+// AdminAuth: the admin api requires a bearer token of definition.Config.AdminTokens, the operator of the token is
+// carried by the context of the request. The tokens can be changed while serving.
+type AdminAuth struct {
+	tokens atomic.Pointer[map[string]string]
+}
+
+func NewAdminAuth(tokens map[string]string) *AdminAuth {
+	a := &AdminAuth{}
+	a.Update(tokens)
+	return a
+}
+
+// Update: tokens are operator: token
+func (a *AdminAuth) Update(tokens map[string]string) {
+	copied := make(map[string]string, len(tokens))
+	for operator, token := range tokens {
+		copied[operator] = token
+	}
+	a.tokens.Store(&copied)
+}
+
+// authenticate: the operator of the token, every token is compared in constant time
+func (a *AdminAuth) authenticate(token string) string {
+	result := ""
+	for operator, adminToken := range *a.tokens.Load() {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			result = operator
+		}
+	}
+	return result
+}
+
+func (a *AdminAuth) Middleware() iris.Handler {
+	return func(ctx iris.Context) {
+		reqCtx := ctx.Request().Context()
+		if len(*a.tokens.Load()) == 0 {
+			result := definition.NewResultFromError(reqCtx, e.NewForbiddenError(e.WithMsg("admin api is disabled, set admin_tokens to enable it")))
+			ctx.StopWithJSON(http.StatusForbidden, result)
+			return
+		}
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		operator := ""
+		if ok {
+			operator = a.authenticate(strings.TrimSpace(token))
+		}
+		if operator == "" {
+			log.WithContext(reqCtx).Warnw("AdminAuthFailed", "hasToken", ok)
+			result := definition.NewResultFromError(reqCtx, e.NewAuthError(e.WithMsg("admin token is missing or invalid")))
+			ctx.StopWithJSON(http.StatusUnauthorized, result)
+			return
+		}
+		ctx.ResetRequest(ctx.Request().WithContext(ctxInfra.WithOperator(reqCtx, operator)))
+		ctx.Next()
+	}
+}
@@ -0,0 +1,16 @@
+package middleware
+
+import (
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/kataras/iris/v12"
+	"go.uber.org/zap"
+)
+
+// NewLoggerMiddleware: the logs of the request go to the logger of the server serving it.
+// It must be used before the other middlewares writing logs.
+func NewLoggerMiddleware(logger *zap.Logger) iris.Handler {
+	return func(ctx iris.Context) {
+		ctx.ResetRequest(ctx.Request().WithContext(log.WithLogger(ctx.Request().Context(), logger)))
+		ctx.Next()
+	}
+}
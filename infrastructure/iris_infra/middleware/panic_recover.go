@@ -14,9 +14,9 @@ func NewPanicRecoerMiddleware() iris.Handler {
 	return func(ctx iris.Context) {
 		defer e.PanicRecover(func(err e.BaseError) {
 			httpRequest, _ := httputil.DumpRequest(ctx.Request(), false)
-			log.LogError(err, "RecoveryFromPanic", "err", err, "request", string(httpRequest), "stack", string(debug.Stack()))
+			log.LogError(ctx.Request().Context(), err, "RecoveryFromPanic", "err", err, "request", string(httpRequest), "stack", string(debug.Stack()))
 
-			errResponse := definition.NewResultFromError(err)
+			errResponse := definition.NewResultFromError(ctx.Request().Context(), err)
 			ctx.Header("Content-Type", "application/json; charset=utf-8")
 			ctx.JSON(errResponse)
 		})
@@ -28,10 +28,10 @@ type Prometheus struct {
 	latency *prometheus.HistogramVec
 }
 
-// New returns a new prometheus middleware.
+// New returns a new prometheus middleware, the metrics are registered to the given registerer.
 //
 // If buckets are empty then `DefaultBuckets` are set.
-func NewPrometheusMiddleware(name string, buckets ...float64) *Prometheus {
+func NewPrometheusMiddleware(registerer prometheus.Registerer, name string, buckets ...float64) *Prometheus {
 	p := Prometheus{}
 	p.reqs = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -41,7 +41,7 @@ func NewPrometheusMiddleware(name string, buckets ...float64) *Prometheus {
 		},
 		[]string{"code", "method", "path"},
 	)
-	prometheus.MustRegister(p.reqs)
+	registerer.MustRegister(p.reqs)
 
 	if len(buckets) == 0 {
 		buckets = DefaultBuckets
@@ -55,7 +55,7 @@ func NewPrometheusMiddleware(name string, buckets ...float64) *Prometheus {
 	},
 		[]string{"code", "method", "path"},
 	)
-	prometheus.MustRegister(p.latency)
+	registerer.MustRegister(p.latency)
 
 	return &p
 }
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"sync/atomic"
 
 	"github.com/daemon-coder/idalloc/definition"
 	e "github.com/daemon-coder/idalloc/definition/errors"
@@ -10,18 +11,42 @@ import (
 	"golang.org/x/time/rate"
 )
 
-func NewRateLimitMiddleware() iris.Handler {
-	qps := definition.Cfg.RateLimit.Qps
-	limiter := rate.NewLimiter(rate.Limit(qps), qps)
+// RateLimitSkipPaths: probes and metrics scraping should not be rejected under heavy load
+var RateLimitSkipPaths = map[string]struct{}{
+	"/healthz": {},
+	"/readyz":  {},
+	"/metrics": {},
+}
+
+// RateLimiter: every server has its own limiter, its settings can be changed while serving
+type RateLimiter struct {
+	enable  atomic.Bool
+	limiter *rate.Limiter
+}
+
+func NewRateLimiter(cfg definition.RateLimit) *RateLimiter {
+	l := &RateLimiter{limiter: rate.NewLimiter(rate.Limit(cfg.Qps), cfg.Qps)}
+	l.enable.Store(cfg.Enable)
+	return l
+}
+
+func (l *RateLimiter) Update(cfg definition.RateLimit) {
+	l.limiter.SetLimit(rate.Limit(cfg.Qps))
+	l.limiter.SetBurst(cfg.Qps)
+	l.enable.Store(cfg.Enable)
+}
+
+func (l *RateLimiter) Middleware() iris.Handler {
 	return func(ctx iris.Context) {
-		if !definition.Cfg.RateLimit.Enable {
+		_, skip := RateLimitSkipPaths[ctx.Path()]
+		if !l.enable.Load() || skip {
 			ctx.Next()
 		} else {
-			if limiter.Allow() {
+			if l.limiter.Allow() {
 				ctx.Next()
 			} else {
-				log.GetLogger().Warnw("RateLimit", "qps", qps)
-				result := definition.NewResultFromError(e.NewRateLimitError())
+				log.WithContext(ctx.Request().Context()).Warnw("RateLimit", "qps", l.limiter.Limit())
+				result := definition.NewResultFromError(ctx.Request().Context(), e.NewRateLimitError())
 				ctx.StopWithJSON(http.StatusTooManyRequests, result)
 			}
 		}
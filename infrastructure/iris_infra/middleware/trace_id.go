@@ -1,11 +1,11 @@
 package middleware
 
 import (
-	"strings"
-
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
-	"github.com/google/uuid"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
 	"github.com/kataras/iris/v12/context"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var TraceIDHeaderKey = "X-Trace-Id"
@@ -19,13 +19,19 @@ var DefaultGenerator Generator = func(ctx *context.Context) string {
 	}
 
 	id = ctx.GetHeader(TraceIDHeaderKey)
+	if id == "" && traceInfra.Enabled {
+		// reuse the trace id of the W3C traceparent header, so that the logs can be found by the trace
+		parentCtx := traceInfra.Propagator.Extract(ctx.Request().Context(), propagation.HeaderCarrier(ctx.Request().Header))
+		if spanCtx := trace.SpanContextFromContext(parentCtx); spanCtx.HasTraceID() {
+			id = spanCtx.TraceID().String()
+		}
+	}
 	if id == "" {
-		uid, err := uuid.NewRandom()
-		if err != nil {
+		id = ctxInfra.NewRandomTraceId()
+		if id == "" {
 			ctx.StopWithStatus(500)
 			return ""
 		}
-		id = strings.ReplaceAll(uid.String(), "-", "")
 	}
 
 	ctx.Header(TraceIDHeaderKey, id)
@@ -39,7 +45,7 @@ func NewTraceIdMiddleware(generators ...Generator) context.Handler {
 	}
 
 	return func(ctx *context.Context) {
-		if threadLocal.GetTraceId() != "" {
+		if ctxInfra.GetTraceId(ctx.Request().Context()) != "" {
 			ctx.Next()
 			return
 		}
@@ -49,8 +55,14 @@ func NewTraceIdMiddleware(generators ...Generator) context.Handler {
 			return
 		}
 
-		threadLocal.SetTraceIdWithCallBack(id, func() {
-			ctx.Next()
+		// the trace id and the request metadata are carried by the context of the request from now on
+		reqCtx := ctxInfra.WithTraceId(ctx.Request().Context(), id)
+		reqCtx = ctxInfra.WithRequestMeta(reqCtx, &ctxInfra.RequestMeta{
+			Method:     ctx.Method(),
+			Path:       ctx.Path(),
+			RemoteAddr: ctx.RemoteAddr(),
 		})
+		ctx.ResetRequest(ctx.Request().WithContext(reqCtx))
+		ctx.Next()
 	}
 }
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
+	"github.com/kataras/iris/v12/context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracingMiddleware: continue the trace of the W3C traceparent header, and start a server span for the request
+func NewTracingMiddleware() context.Handler {
+	return func(ctx *context.Context) {
+		if !traceInfra.Enabled {
+			ctx.Next()
+			return
+		}
+
+		parentCtx := traceInfra.Propagator.Extract(ctx.Request().Context(), propagation.HeaderCarrier(ctx.Request().Header))
+		spanCtx, span := traceInfra.Tracer().Start(
+			parentCtx,
+			ctx.Method()+" "+ctx.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", ctx.Method()),
+				attribute.String("url.path", ctx.Path()),
+				attribute.String("idalloc.trace_id", ctxInfra.GetTraceId(ctx.Request().Context())),
+			),
+		)
+		defer span.End()
+		traceInfra.Propagator.Inject(spanCtx, propagation.HeaderCarrier(ctx.ResponseWriter().Header()))
+
+		ctx.ResetRequest(ctx.Request().WithContext(spanCtx))
+		ctx.Next()
+
+		statusCode := ctx.GetStatusCode()
+		span.SetAttributes(attribute.Int("http.response.status_code", statusCode))
+		if statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+	}
+}
@@ -1,68 +1,98 @@
 package log_infra
 
 import (
+	"context"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/daemon-coder/idalloc/definition"
 	e "github.com/daemon-coder/idalloc/definition/errors"
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var Logger *zap.Logger
+// defaultLogger: used when the context does not carry a logger, e.g. outside of a server
+var defaultLogger *zap.Logger
 var loggerLoadOnce sync.Once
 
-func GetLogger() *zap.SugaredLogger {
-	if Logger == nil {
-		InitZapLogger()
-	}
-	return Logger.Sugar()
-}
+type loggerKey struct{}
 
-func InitZapLogger() *zap.Logger {
-	if Logger != nil {
-		return Logger
-	}
+func GetLogger() *zap.SugaredLogger {
 	loggerLoadOnce.Do(func() {
-		config := zap.Config{
-			Encoding:         "console",
-			Development:      false,
-			Level:            zap.NewAtomicLevelAt(transformLogLevel(definition.Cfg.LogLevel)),
-			OutputPaths:      []string{"stdout"},
-			ErrorOutputPaths: []string{"stderr"},
-			EncoderConfig: zapcore.EncoderConfig{
-				ConsoleSeparator: "|",
-				MessageKey:       "msg",
-				LevelKey:         "level",
-				TimeKey:          "timestamp",
-				CallerKey:        "caller",
-				StacktraceKey:    "stacktrace",
-				LineEnding:       zapcore.DefaultLineEnding,
-				EncodeLevel:      zapcore.CapitalLevelEncoder,
-				EncodeTime: func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
-					enc.AppendString(t.Format("2006-01-02 15:04:05.000"))
-				},
-				EncodeDuration: zapcore.SecondsDurationEncoder,
-				EncodeCaller:   zapcore.ShortCallerEncoder,
-			},
-		}
-
-		config.EncoderConfig.EncodeCaller = func(caller zapcore.EntryCaller, enc zapcore.PrimitiveArrayEncoder) {
-			enc.AppendString(caller.TrimmedPath())
-			// Customize the encoder to include request_id in the log prefix
-			enc.AppendString(threadLocal.GetTraceId())
-		}
-
 		var err error
-		Logger, err = config.Build()
+		defaultLogger, err = NewZapLogger(NewLogLevel(""))
 		if err != nil {
 			e.FromStdError(err).Panic()
 		}
 	})
-	return Logger
+	return defaultLogger.Sugar()
+}
+
+// WithLogger: the logs written with the returned context go to logger, so that every server instance has its own
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext: the logger carried by the context, or the default one
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+			return logger
+		}
+	}
+	return GetLogger().Desugar()
+}
+
+// WithContext: the logger with the trace id and the request metadata carried by the context
+func WithContext(ctx context.Context) *zap.SugaredLogger {
+	return LoggerFromContext(ctx).Sugar().With(ContextFields(ctx)...)
+}
+
+func ContextFields(ctx context.Context) []interface{} {
+	fields := make([]interface{}, 0, 2)
+	if traceId := ctxInfra.GetTraceId(ctx); traceId != "" {
+		fields = append(fields, zap.String("traceId", traceId))
+	}
+	if meta := ctxInfra.GetRequestMeta(ctx); meta != nil {
+		fields = append(fields, zap.String("path", meta.Path))
+	}
+	return fields
+}
+
+// NewLogLevel: the level can be changed after the logger is built. Unknown levels fall back to INFO.
+func NewLogLevel(logLevel string) zap.AtomicLevel {
+	return zap.NewAtomicLevelAt(transformLogLevel(logLevel))
+}
+
+// NewZapLogger: the logs are written to stdout unless outputPaths are given, e.g. stderr for a command line tool
+func NewZapLogger(level zap.AtomicLevel, outputPaths ...string) (*zap.Logger, error) {
+	if len(outputPaths) == 0 {
+		outputPaths = []string{"stdout"}
+	}
+	config := zap.Config{
+		Encoding:         "console",
+		Development:      false,
+		Level:            level,
+		OutputPaths:      outputPaths,
+		ErrorOutputPaths: []string{"stderr"},
+		EncoderConfig: zapcore.EncoderConfig{
+			ConsoleSeparator: "|",
+			MessageKey:       "msg",
+			LevelKey:         "level",
+			TimeKey:          "timestamp",
+			CallerKey:        "caller",
+			StacktraceKey:    "stacktrace",
+			LineEnding:       zapcore.DefaultLineEnding,
+			EncodeLevel:      zapcore.CapitalLevelEncoder,
+			EncodeTime: func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+				enc.AppendString(t.Format("2006-01-02 15:04:05.000"))
+			},
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+			EncodeCaller:   zapcore.ShortCallerEncoder,
+		},
+	}
+	return config.Build()
 }
 
 func transformLogLevel(level string) zapcore.Level {
@@ -86,16 +116,16 @@ func transformLogLevel(level string) zapcore.Level {
 	}
 }
 
-func LogError(err error, msg string, kvArgs ...interface{}) {
+func LogError(ctx context.Context, err error, msg string, kvArgs ...interface{}) {
 	baseError := e.FromStdError(err)
 	switch {
 	case baseError.Type == e.OK:
 		return
 	case baseError.Type >= e.CriticalErrorType:
-		GetLogger().Errorw(msg, kvArgs...)
+		WithContext(ctx).Errorw(msg, kvArgs...)
 	case baseError.Type >= e.RateLimitErrorType:
-		GetLogger().Warnw(msg, kvArgs...)
+		WithContext(ctx).Warnw(msg, kvArgs...)
 	default:
-		GetLogger().Infow(msg, kvArgs...)
+		WithContext(ctx).Infow(msg, kvArgs...)
 	}
 }
@@ -1,7 +0,0 @@
-package redis_infra
-
-import (
-	"github.com/redis/go-redis/v9"
-)
-
-var RedisClient *redis.Client
@@ -0,0 +1,101 @@
+package trace_infra
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/daemon-coder/idalloc/definition"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	TRACER_NAME = "github.com/daemon-coder/idalloc"
+)
+
+var (
+	Enabled        bool
+	TracerProvider *sdkTrace.TracerProvider
+	Propagator     propagation.TextMapPropagator = propagation.TraceContext{}
+)
+
+// InitTracerProvider: spans are only recorded if tracing is enabled, otherwise WithSpan costs nothing.
+// Unlike the other state of a server, the provider is process wide, the last server enabling tracing wins.
+func InitTracerProvider(cfg *definition.Config) *sdkTrace.TracerProvider {
+	if !cfg.Tracing.Enable {
+		return nil
+	}
+
+	var exporter sdkTrace.SpanExporter
+	var err error
+	switch cfg.Tracing.Exporter {
+	case definition.TRACING_EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case definition.TRACING_EXPORTER_OTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Tracing.OtlpEndpoint)}
+		if cfg.Tracing.OtlpInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		err = fmt.Errorf("unknown exporter: %s", cfg.Tracing.Exporter)
+	}
+	if err != nil {
+		e.Panic(e.NewCriticalError(e.WithMsg("config invalid. init tracing exporter failed: " + err.Error())))
+	}
+
+	TracerProvider = sdkTrace.NewTracerProvider(
+		sdkTrace.WithBatcher(exporter),
+		sdkTrace.WithSampler(sdkTrace.ParentBased(sdkTrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+		sdkTrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.AppName))),
+	)
+	otel.SetTracerProvider(TracerProvider)
+	otel.SetTextMapPropagator(Propagator)
+	Enabled = true
+	return TracerProvider
+}
+
+// Shutdown: flush the spans not exported yet
+func Shutdown() {
+	if TracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = TracerProvider.Shutdown(ctx)
+}
+
+func Tracer() trace.Tracer {
+	return otel.Tracer(TRACER_NAME)
+}
+
+// WithSpan: run fn in a span which is the child of the span in ctx, fn gets the context carrying the new span.
+// A panic in fn is recorded as the error of the span and then re-panicked.
+func WithSpan(ctx context.Context, name string, fn func(ctx context.Context, span trace.Span), attrs ...attribute.KeyValue) {
+	if !Enabled {
+		fn(ctx, trace.SpanFromContext(ctx))
+		return
+	}
+	ctx, span := Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+	defer func() {
+		if errObj := recover(); errObj != nil {
+			span.SetStatus(codes.Error, fmt.Sprint(errObj))
+			if err, ok := errObj.(error); ok {
+				span.RecordError(err)
+			}
+			panic(errObj)
+		}
+	}()
+	fn(ctx, span)
+}
@@ -1,125 +1,353 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
 	"github.com/daemon-coder/idalloc/definition/entity"
-	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/daemon-coder/idalloc/definition/errors"
 	db "github.com/daemon-coder/idalloc/infrastructure/db_infra"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
 	"github.com/daemon-coder/idalloc/util"
 )
 
-func GetAllocInfoFromDB(serviceNames ...string) (result []*entity.AllocInfo) {
+// ALLOC_INFO_ID_TYPE_COLUMN_SQL: detects the id_type column of tbl_alloc_info, which is added for the uint64 services
+const ALLOC_INFO_ID_TYPE_COLUMN_SQL = "select count(*) from information_schema.columns " +
+	"where table_schema = database() and table_name = 'tbl_alloc_info' and column_name = 'id_type'"
+
+// hasIdTypeColumn: the tables created before the id types do not have the column until it is added as in the
+// README, then all the counters are int64 and the uint64 ones are refused. It is detected once per store, so the
+// instances are restarted after the column is added.
+func (s *Store) hasIdTypeColumn(ctx context.Context) (bool, error) {
+	s.schemaLock.Lock()
+	defer s.schemaLock.Unlock()
+	if s.idTypeColumn != nil {
+		return *s.idTypeColumn, nil
+	}
+	var count int
+	query := db.SqlUtil{
+		DB:  s.DB,
+		Sql: ALLOC_INFO_ID_TYPE_COLUMN_SQL,
+	}
+	err := query.QueryOne(ctx, func(row *sql.Row) error {
+		return row.Scan(&count)
+	})
+	if err != nil {
+		return false, err
+	}
+	s.idTypeColumn = util.Ptr(count > 0)
+	if count == 0 {
+		log.WithContext(ctx).Warnw("DBIdTypeColumnMissing", "msg", "tbl_alloc_info has no id_type column, the counters are all int64")
+	}
+	return *s.idTypeColumn, nil
+}
+
+// selectAllocInfoColumns: the id type is int64 if the column is missing
+func (s *Store) selectAllocInfoColumns(ctx context.Context) (string, error) {
+	hasColumn, err := s.hasIdTypeColumn(ctx)
+	if err != nil {
+		return "", err
+	} else if !hasColumn {
+		return "service_name, last_alloc_value, data_version, 'int64'", nil
+	}
+	return "service_name, last_alloc_value, data_version, id_type", nil
+}
+
+// checkIdTypeColumn: whether the counter can be written, the uint64 ones need the column
+func (s *Store) checkIdTypeColumn(ctx context.Context, allocInfo *entity.AllocInfo) (bool, error) {
+	hasColumn, err := s.hasIdTypeColumn(ctx)
+	if err != nil {
+		return false, err
+	} else if !hasColumn && entity.NormalizeIdType(allocInfo.IdType) != entity.ID_TYPE_INT64 {
+		msg := "DBIdTypeColumnMissing. add the id_type column to tbl_alloc_info for the uint64 services. serviceName:" + *allocInfo.ServiceName
+		return false, errors.NewCriticalError(errors.WithMsg(msg))
+	}
+	return hasColumn, nil
+}
+
+func (s *Store) GetAllocInfoFromDB(ctx context.Context, serviceNames ...string) (result []*entity.AllocInfo, err error) {
+	columns, err := s.selectAllocInfoColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
 	result = make([]*entity.AllocInfo, 0, len(serviceNames))
 	query := db.SqlUtil{
+		DB:   s.DB,
 		Sql: fmt.Sprintf(
-			"select service_name, last_alloc_value, data_version from tbl_alloc_info where service_name in (%s)",
+			"select %s from tbl_alloc_info where service_name in (%s)",
+			columns,
 			strings.Join(util.SliceRepeat("?", len(serviceNames)), ", "),
 		),
 		Args: util.ToInterfaceSlice(serviceNames),
 	}
-	log.GetLogger().Debugw("JIANWEI_DEBUG", "sql", query)
-	query.QueryList(func(row *sql.Rows) (err error) {
-		var serviceNamePtr *string
-		var lastAllocValuePtr, dataVersionPtr *int64
-		err = row.Scan(&serviceNamePtr, &lastAllocValuePtr, &dataVersionPtr)
+	log.WithContext(ctx).Debugw("JIANWEI_DEBUG", "sql", query)
+	err = query.QueryList(ctx, func(row *sql.Rows) (err error) {
+		var allocInfo *entity.AllocInfo
+		allocInfo, err = scanAllocInfo(row)
 		if err == nil {
-			result = append(result, &entity.AllocInfo{
-				ServiceName: serviceNamePtr,
-				LastAllocValue: lastAllocValuePtr,
-				DataVersion: dataVersionPtr,
-			})
+			result = append(result, allocInfo)
 		}
 		return
 	})
 	return
 }
 
-func GetServiceAllocInfoFromDB(serviceName string) (result *entity.AllocInfo) {
+func (s *Store) GetServiceAllocInfoFromDB(ctx context.Context, serviceName string) (result *entity.AllocInfo, err error) {
+	columns, err := s.selectAllocInfoColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
 	query := db.SqlUtil{
-		Sql: "select last_alloc_value, data_version from tbl_alloc_info where service_name = ?",
+		DB:   s.DB,
+		Sql: "select " + columns + " from tbl_alloc_info where service_name = ?",
 		Args: []interface{}{serviceName},
 	}
-	query.QueryOne(func(row *sql.Row) (err error) {
-		var lastAllocValuePtr, dataVersionPtr *int64
-		err = row.Scan(&lastAllocValuePtr, &dataVersionPtr)
-		if err == nil {
-			result = &entity.AllocInfo{
-				ServiceName: util.Ptr(serviceName),
-				LastAllocValue: lastAllocValuePtr,
-				DataVersion: dataVersionPtr,
-			}
-		}
+	err = query.QueryOne(ctx, func(row *sql.Row) (err error) {
+		result, err = scanAllocInfo(row)
 		return
 	})
 	return
 }
 
-func GetAllFromDB() (result []*entity.AllocInfo) {
+func (s *Store) GetAllFromDB(ctx context.Context) (result []*entity.AllocInfo, err error) {
+	columns, err := s.selectAllocInfoColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
 	result = make([]*entity.AllocInfo, 0)
 	query := db.SqlUtil{
-		Sql:  "select service_name, last_alloc_value, data_version from tbl_alloc_info",
+		DB:   s.DB,
+		Sql:  "select " + columns + " from tbl_alloc_info",
 	}
-	query.QueryList(func(row *sql.Rows) (err error) {
-		var serviceNamePtr *string
-		var lastAllocValuePtr, dataVersionPtr *int64
-		err = row.Scan(&serviceNamePtr, &lastAllocValuePtr, &dataVersionPtr)
+	err = query.QueryList(ctx, func(row *sql.Rows) (err error) {
+		var allocInfo *entity.AllocInfo
+		allocInfo, err = scanAllocInfo(row)
 		if err == nil {
-			result = append(result, &entity.AllocInfo{
-				ServiceName: serviceNamePtr,
-				LastAllocValue: lastAllocValuePtr,
-				DataVersion: dataVersionPtr,
-			})
+			result = append(result, allocInfo)
 		}
 		return
 	})
 	return
 }
 
-func InsertAllocInfoToDB(allocInfo *entity.AllocInfo) {
+// scanAllocInfo: last_alloc_value is BIGINT UNSIGNED, it is scanned as uint64 and converted to the process form
+// of the id type, see entity.ID_TYPE_UINT64
+func scanAllocInfo(row interface{ Scan(dest ...any) error }) (*entity.AllocInfo, error) {
+	var serviceNamePtr *string
+	var lastAllocValuePtr *uint64
+	var dataVersionPtr *int64
+	var idType string
+	if err := row.Scan(&serviceNamePtr, &lastAllocValuePtr, &dataVersionPtr, &idType); err != nil {
+		return nil, err
+	}
+	result := &entity.AllocInfo{
+		ServiceName: serviceNamePtr,
+		DataVersion: dataVersionPtr,
+		IdType: idType,
+	}
+	if idType == entity.ID_TYPE_INT64 {
+		result.IdType = ""
+	}
+	if lastAllocValuePtr != nil {
+		if result.IdType == entity.ID_TYPE_UINT64 {
+			result.LastAllocValue = util.Ptr(entity.FromUint64(*lastAllocValuePtr))
+		} else if *lastAllocValuePtr <= math.MaxInt64 && entity.IsValidIdType(idType) {
+			result.LastAllocValue = util.Ptr(int64(*lastAllocValuePtr))
+		} else {
+			serviceName := ""
+			if serviceNamePtr != nil {
+				serviceName = *serviceNamePtr
+			}
+			msg := fmt.Sprintf("DBAllocInfoDirty. serviceName:%s lastAllocValue:%d idType:%s", serviceName, *lastAllocValuePtr, idType)
+			return nil, errors.NewCriticalError(errors.WithMsg(msg))
+		}
+	}
+	return result, nil
+}
+
+// toDBLastAllocValue: the unsigned value of the uint64 services
+func toDBLastAllocValue(allocInfo *entity.AllocInfo) interface{} {
+	if allocInfo.LastAllocValue != nil && allocInfo.IdType == entity.ID_TYPE_UINT64 {
+		return entity.ToUint64(*allocInfo.LastAllocValue)
+	}
+	return allocInfo.LastAllocValue
+}
+
+func (s *Store) InsertAllocInfoToDB(ctx context.Context, allocInfo *entity.AllocInfo) error {
+	hasColumn, err := s.checkIdTypeColumn(ctx, allocInfo)
+	if err != nil {
+		return err
+	}
 	query := db.SqlUtil{
-		Sql:  "insert into tbl_alloc_info(service_name, last_alloc_value, data_version) values (?, ?, ?)",
-		Args: []interface{}{allocInfo.ServiceName, allocInfo.LastAllocValue, allocInfo.DataVersion},
+		DB:   s.DB,
+		Sql:  "insert into tbl_alloc_info(service_name, last_alloc_value, data_version, id_type) values (?, ?, ?, ?)",
+		Args: []interface{}{
+			allocInfo.ServiceName,
+			toDBLastAllocValue(allocInfo),
+			allocInfo.DataVersion,
+			entity.NormalizeIdType(allocInfo.IdType),
+		},
 	}
-	_, _, err := query.Exec()
+	if !hasColumn {
+		query.Sql = "insert into tbl_alloc_info(service_name, last_alloc_value, data_version) values (?, ?, ?)"
+		query.Args = query.Args[:3]
+	}
+	_, _, err = query.Exec(ctx)
 	if err != nil {
-		log.GetLogger().Warnw("InsertAllocInfoToDB", "sql", query.Sql, "args", query.Args, "err", err)
-		e.Panic(err)
+		log.WithContext(ctx).Warnw("InsertAllocInfoToDB", "sql", query.Sql, "args", query.Args, "err", err)
+		return err
 	}
-	log.GetLogger().Infow("InsertAllocInfoToDB", "allocInfo", allocInfo)
+	log.WithContext(ctx).Infow("InsertAllocInfoToDB", "allocInfo", allocInfo)
+	return nil
 }
 
-func UpdateAllocInfoToDB(allocInfo *entity.AllocInfo) {
+// UpdateAllocInfoToDB: the id type of a counter is never changed, the counter of another id type is not updated
+func (s *Store) UpdateAllocInfoToDB(ctx context.Context, allocInfo *entity.AllocInfo) error {
+	hasColumn, err := s.checkIdTypeColumn(ctx, allocInfo)
+	if err != nil {
+		return err
+	}
 	query := db.SqlUtil{
-		Sql:  "update tbl_alloc_info set last_alloc_value = ?, data_version = ? where service_name = ? and data_version < ?",
+		DB:   s.DB,
+		Sql:  "update tbl_alloc_info set last_alloc_value = ?, data_version = ? where service_name = ? and data_version < ? and id_type = ?",
 		Args: []interface{}{
-			allocInfo.LastAllocValue,
+			toDBLastAllocValue(allocInfo),
 			allocInfo.DataVersion,
 			allocInfo.ServiceName,
 			allocInfo.DataVersion,
+			entity.NormalizeIdType(allocInfo.IdType),
 		},
 	}
-	_, _, err := query.Exec()
+	if !hasColumn {
+		query.Sql = "update tbl_alloc_info set last_alloc_value = ?, data_version = ? where service_name = ? and data_version < ?"
+		query.Args = query.Args[:4]
+	}
+	_, _, err = query.Exec(ctx)
 	if err != nil {
-		log.GetLogger().Warnw("InsertAllocInfoToDB", "sql", query.Sql, "args", query.Args, "err", err)
-		e.Panic(err)
+		log.WithContext(ctx).Warnw("InsertAllocInfoToDB", "sql", query.Sql, "args", query.Args, "err", err)
+		return err
 	}
-	log.GetLogger().Infow("UpdateAllocInfoToDB", "allocInfo", allocInfo)
+	log.WithContext(ctx).Infow("UpdateAllocInfoToDB", "allocInfo", allocInfo)
+	return nil
 }
 
-func InsertOrUpdateAllocInfoToDB(allocInfo *entity.AllocInfo) {
+func (s *Store) InsertOrUpdateAllocInfoToDB(ctx context.Context, allocInfo *entity.AllocInfo) error {
 	lockKey := "insert_or_update_db_" + *allocInfo.ServiceName
 	expire := 5 * time.Second
-	WithRedisLock(lockKey, expire, func() {
-		result := GetServiceAllocInfoFromDB(*allocInfo.ServiceName)
+	return s.WithRedisLock(ctx, lockKey, expire, func() error {
+		result, err := s.GetServiceAllocInfoFromDB(ctx, *allocInfo.ServiceName)
+		if err != nil {
+			return err
+		}
 		if result == nil {
-			InsertAllocInfoToDB(allocInfo)
-		} else {
-			UpdateAllocInfoToDB(allocInfo)
+			return s.InsertAllocInfoToDB(ctx, allocInfo)
+		}
+		if entity.NormalizeIdType(result.IdType) != entity.NormalizeIdType(allocInfo.IdType) {
+			msg := fmt.Sprintf("DBIdTypeMismatch. serviceName:%s idTypeInDB:%s input:%s", *allocInfo.ServiceName, entity.NormalizeIdType(result.IdType), entity.NormalizeIdType(allocInfo.IdType))
+			return errors.NewCriticalError(errors.WithMsg(msg))
+		}
+		return s.UpdateAllocInfoToDB(ctx, allocInfo)
+	})
+}
+
+func (s *Store) InsertAuditLogToDB(ctx context.Context, auditLog *entity.AuditLog) error {
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql:  "insert into tbl_audit_log(service_name, action, operator, detail) values (?, ?, ?, ?)",
+		Args: []interface{}{auditLog.ServiceName, auditLog.Action, auditLog.Operator, auditLog.Detail},
+	}
+	_, _, err := query.Exec(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnw("InsertAuditLogToDB", "sql", query.Sql, "args", query.Args, "err", err)
+		return err
+	}
+	log.WithContext(ctx).Infow("InsertAuditLogToDB", "auditLog", auditLog)
+	return nil
+}
+
+func (s *Store) GetAllServiceInfoFromDB(ctx context.Context) (result []*entity.ServiceInfo, err error) {
+	result = make([]*entity.ServiceInfo, 0)
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql: "select service_name, status from tbl_service_info",
+	}
+	err = query.QueryList(ctx, func(row *sql.Rows) (err error) {
+		serviceInfo := &entity.ServiceInfo{}
+		err = row.Scan(&serviceInfo.ServiceName, &serviceInfo.Status)
+		if err == nil {
+			result = append(result, serviceInfo)
 		}
+		return
 	})
+	return
+}
+
+func (s *Store) GetServiceInfoFromDB(ctx context.Context, serviceName string) (result *entity.ServiceInfo, err error) {
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql:  "select service_name, status from tbl_service_info where service_name = ?",
+		Args: []interface{}{serviceName},
+	}
+	err = query.QueryOne(ctx, func(row *sql.Row) (err error) {
+		serviceInfo := &entity.ServiceInfo{}
+		err = row.Scan(&serviceInfo.ServiceName, &serviceInfo.Status)
+		if err == nil {
+			result = serviceInfo
+		}
+		return
+	})
+	return
+}
+
+// InsertServiceInfoToDB returns false if the service already exists
+func (s *Store) InsertServiceInfoToDB(ctx context.Context, serviceInfo *entity.ServiceInfo) (bool, error) {
+	existing, err := s.GetServiceInfoFromDB(ctx, serviceInfo.ServiceName)
+	if err != nil {
+		return false, err
+	} else if existing != nil {
+		return false, nil
+	}
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql:  "insert into tbl_service_info(service_name, status) values (?, ?)",
+		Args: []interface{}{serviceInfo.ServiceName, serviceInfo.Status},
+	}
+	_, _, err = query.Exec(ctx)
+	if err != nil {
+		// the service may be inserted concurrently
+		if existing, _ := s.GetServiceInfoFromDB(ctx, serviceInfo.ServiceName); existing != nil {
+			return false, nil
+		}
+		log.WithContext(ctx).Warnw("InsertServiceInfoToDB", "sql", query.Sql, "args", query.Args, "err", err)
+		return false, err
+	}
+	log.WithContext(ctx).Infow("InsertServiceInfoToDB", "serviceInfo", serviceInfo)
+	return true, nil
+}
+
+// UpdateServiceStatusToDB changes the status only if the current status is fromStatus.
+// Returns false if the status has been changed by others.
+func (s *Store) UpdateServiceStatusToDB(ctx context.Context, serviceName, fromStatus, toStatus string) (bool, error) {
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql:  "update tbl_service_info set status = ? where service_name = ? and status = ?",
+		Args: []interface{}{toStatus, serviceName, fromStatus},
+	}
+	rowsAffected, _, err := query.Exec(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnw("UpdateServiceStatusToDB", "sql", query.Sql, "args", query.Args, "err", err)
+		return false, err
+	}
+	log.WithContext(ctx).Infow("UpdateServiceStatusToDB", "serviceName", serviceName, "fromStatus", fromStatus, "toStatus", toStatus, "rowsAffected", rowsAffected)
+	return rowsAffected > 0, nil
+}
+
+func (s *Store) DBPing(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.DB.PingContext(ctx)
 }
@@ -0,0 +1,305 @@
+package repository
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	"github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+const (
+	SEGMENT_JOURNAL_FILE_PREFIX = "segment-journal-"
+	SEGMENT_JOURNAL_FILE_SUFFIX = ".log"
+	// SEGMENT_JOURNAL_TIME_LAYOUT: the time in the file names, so that they sort by the time created
+	SEGMENT_JOURNAL_TIME_LAYOUT = "20060102T150405.000000000"
+	// SEGMENT_JOURNAL_MAX_LINE_SIZE: the longer lines are skipped as broken when the journal is read
+	SEGMENT_JOURNAL_MAX_LINE_SIZE = 64 << 10
+)
+
+// SegmentJournal: an append-only journal of the segments fetched from redis on the local disk, a json record per line.
+// Every file starts with a checkpoint of the max value journaled of all the services, so the newest file is enough
+// to recover the counters, the older ones are kept for investigation.
+type SegmentJournal struct {
+	sync.Mutex
+	config   def.SegmentJournal
+	file     *os.File
+	fileSize int64
+	dirty    bool
+	// checkpoints: the max value journaled and the id type of every service
+	checkpoints map[string]*entity.SegmentJournalRecord
+
+	wg     *sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewSegmentJournal: ctx carries the logger of the journal, nothing is read or written before Open
+func NewSegmentJournal(ctx context.Context, config def.SegmentJournal) *SegmentJournal {
+	ctx, cancel := context.WithCancel(ctx)
+	return &SegmentJournal{
+		config:      config,
+		checkpoints: make(map[string]*entity.SegmentJournalRecord),
+		wg:          &sync.WaitGroup{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Open: read the journal files in the dir and start a new file. Returns the checkpoint of every service, the max
+// value journaled and its id type, sorted by the service names. A broken line, e.g. the last one written before
+// a crash, is skipped.
+func (j *SegmentJournal) Open() ([]*entity.SegmentJournalRecord, error) {
+	j.Lock()
+	defer j.Unlock()
+	if err := os.MkdirAll(j.config.Dir, 0755); err != nil {
+		return nil, errors.NewServerError(errors.WithMsg("create segment journal dir failed: " + err.Error()))
+	}
+	fileNames, err := j.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, fileName := range fileNames {
+		if err = j.replay(fileName); err != nil {
+			return nil, err
+		}
+	}
+	if err = j.rotate(); err != nil {
+		return nil, err
+	}
+	if j.config.FsyncPolicy == def.SEGMENT_JOURNAL_FSYNC_INTERVAL {
+		j.startSyncLoop()
+	}
+
+	result := j.sortedCheckpoints()
+	log.WithContext(j.ctx).Infow("SegmentJournalOpened", "dir", j.config.Dir, "fileNum", len(fileNames), "serviceNum", len(result))
+	return result, nil
+}
+
+// Append: the record is synced before it returns in SEGMENT_JOURNAL_FSYNC_ALWAYS
+func (j *SegmentJournal) Append(serviceName string, idType string, lastAllocValue, maxValue, dataVersion int64) error {
+	record := &entity.SegmentJournalRecord{
+		Time:           time.Now().UnixMilli(),
+		ServiceName:    serviceName,
+		LastAllocValue: lastAllocValue,
+		MaxValue:       maxValue,
+		DataVersion:    dataVersion,
+		IdType:         normalizeJournalIdType(idType),
+	}
+	content, err := json.Marshal(record)
+	if err != nil {
+		return errors.FromStdError(err)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return errors.NewServerError(errors.WithMsg("segment journal is not open"))
+	}
+	if j.fileSize >= j.config.MaxFileSize {
+		if err = j.rotate(); err != nil {
+			return err
+		}
+	}
+	if err = j.write(content); err != nil {
+		return err
+	}
+	if j.config.FsyncPolicy == def.SEGMENT_JOURNAL_FSYNC_ALWAYS {
+		if err = j.file.Sync(); err != nil {
+			return errors.NewServerError(errors.WithMsg("sync segment journal failed: " + err.Error()))
+		}
+	} else {
+		j.dirty = true
+	}
+	j.raiseCheckpoint(record)
+	return nil
+}
+
+// Close: the journal is synced and closed, it works even if the journal is not open
+func (j *SegmentJournal) Close() {
+	j.cancel()
+	j.wg.Wait()
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		log.WithContext(j.ctx).Errorw("SyncSegmentJournalFailed", "file", j.file.Name(), "err", err)
+	}
+	if err := j.file.Close(); err != nil {
+		log.WithContext(j.ctx).Errorw("CloseSegmentJournalFailed", "file", j.file.Name(), "err", err)
+	}
+	j.file = nil
+	log.WithContext(j.ctx).Info("SegmentJournalClosed")
+}
+
+func (j *SegmentJournal) startSyncLoop() {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(j.config.FsyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.ctx.Done():
+				return
+			case <-ticker.C:
+				j.Lock()
+				if j.dirty && j.file != nil {
+					if err := j.file.Sync(); err != nil {
+						log.WithContext(j.ctx).Errorw("SyncSegmentJournalFailed", "file", j.file.Name(), "err", err)
+					} else {
+						j.dirty = false
+					}
+				}
+				j.Unlock()
+			}
+		}
+	}()
+}
+
+// listFiles: the journal files in the dir, the oldest first
+func (j *SegmentJournal) listFiles() ([]string, error) {
+	entries, err := os.ReadDir(j.config.Dir)
+	if err != nil {
+		return nil, errors.NewServerError(errors.WithMsg("read segment journal dir failed: " + err.Error()))
+	}
+	result := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, SEGMENT_JOURNAL_FILE_PREFIX) && strings.HasSuffix(name, SEGMENT_JOURNAL_FILE_SUFFIX) {
+			result = append(result, filepath.Join(j.config.Dir, name))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (j *SegmentJournal) replay(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return errors.NewServerError(errors.WithMsg("open segment journal failed: " + err.Error()))
+	}
+	defer file.Close()
+
+	brokenLineNum := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var record entity.SegmentJournalRecord
+			if len(line) > SEGMENT_JOURNAL_MAX_LINE_SIZE || json.Unmarshal(line, &record) != nil || record.ServiceName == "" {
+				brokenLineNum++
+			} else {
+				j.raiseCheckpoint(&record)
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	if brokenLineNum > 0 {
+		log.WithContext(j.ctx).Warnw("SegmentJournalBrokenLines", "file", fileName, "lineNum", brokenLineNum)
+	}
+	return nil
+}
+
+// raiseCheckpoint: the values of the uint64 services are negative until they pass 2^63, so a missing service must
+// not be taken as 0. The values of different id types are not comparable, the later record wins.
+func (j *SegmentJournal) raiseCheckpoint(record *entity.SegmentJournalRecord) {
+	idType := normalizeJournalIdType(record.IdType)
+	cur, ok := j.checkpoints[record.ServiceName]
+	if ok && cur.IdType == idType && cur.MaxValue >= record.MaxValue {
+		return
+	}
+	j.checkpoints[record.ServiceName] = &entity.SegmentJournalRecord{
+		ServiceName: record.ServiceName,
+		MaxValue:    record.MaxValue,
+		Checkpoint:  true,
+		IdType:      idType,
+	}
+}
+
+// normalizeJournalIdType: ID_TYPE_INT64 is left out of the lines, as in redis
+func normalizeJournalIdType(idType string) string {
+	if idType == entity.ID_TYPE_INT64 {
+		return ""
+	}
+	return idType
+}
+
+// sortedCheckpoints: copies of the checkpoints, sorted by the service names
+func (j *SegmentJournal) sortedCheckpoints() []*entity.SegmentJournalRecord {
+	result := make([]*entity.SegmentJournalRecord, 0, len(j.checkpoints))
+	for _, checkpoint := range j.checkpoints {
+		record := *checkpoint
+		result = append(result, &record)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].ServiceName < result[b].ServiceName })
+	return result
+}
+
+// rotate: start a new file with the checkpoint, and delete the oldest files beyond MaxFileNum
+func (j *SegmentJournal) rotate() error {
+	if j.file != nil {
+		if err := j.file.Sync(); err != nil {
+			return errors.NewServerError(errors.WithMsg("sync segment journal failed: " + err.Error()))
+		}
+		j.file.Close()
+		j.file = nil
+	}
+	fileName := filepath.Join(j.config.Dir, SEGMENT_JOURNAL_FILE_PREFIX+time.Now().Format(SEGMENT_JOURNAL_TIME_LAYOUT)+SEGMENT_JOURNAL_FILE_SUFFIX)
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.NewServerError(errors.WithMsg("create segment journal failed: " + err.Error()))
+	}
+	j.file, j.fileSize, j.dirty = file, 0, false
+
+	now := time.Now().UnixMilli()
+	for _, checkpoint := range j.sortedCheckpoints() {
+		checkpoint.Time = now
+		content, _ := json.Marshal(checkpoint)
+		if err = j.write(content); err != nil {
+			return err
+		}
+	}
+	// the checkpoint is synced before the older files may be deleted
+	if err = j.file.Sync(); err != nil {
+		return errors.NewServerError(errors.WithMsg("sync segment journal failed: " + err.Error()))
+	}
+	j.prune()
+	return nil
+}
+
+func (j *SegmentJournal) write(content []byte) error {
+	n, err := j.file.Write(append(content, '\n'))
+	j.fileSize += int64(n)
+	if err != nil {
+		return errors.NewServerError(errors.WithMsg("write segment journal failed: " + err.Error()))
+	}
+	return nil
+}
+
+// prune: a failure is only logged, the files are deleted on the next rotation
+func (j *SegmentJournal) prune() {
+	fileNames, err := j.listFiles()
+	if err != nil {
+		log.WithContext(j.ctx).Errorw("PruneSegmentJournalFailed", "err", err)
+		return
+	}
+	for i := 0; i < len(fileNames)-j.config.MaxFileNum; i++ {
+		if err = os.Remove(fileNames[i]); err != nil {
+			log.WithContext(j.ctx).Errorw("PruneSegmentJournalFailed", "file", fileNames[i], "err", err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"go.uber.org/zap"
+)
+
+type journalAppend struct {
+	serviceName string
+	idType      string
+	maxValue    int64
+}
+
+// journalCheckpoint: the id type is left out for int64
+type journalCheckpoint struct {
+	idType   string
+	maxValue int64
+}
+
+func newTestJournal(t *testing.T, dir string, maxFileSize int64, maxFileNum int) *SegmentJournal {
+	t.Helper()
+	ctx := log.WithLogger(context.Background(), zap.NewNop())
+	return NewSegmentJournal(ctx, def.SegmentJournal{
+		Dir:         dir,
+		MaxFileSize: maxFileSize,
+		MaxFileNum:  maxFileNum,
+		FsyncPolicy: def.SEGMENT_JOURNAL_FSYNC_NEVER,
+	})
+}
+
+func openTestJournal(t *testing.T, journal *SegmentJournal) map[string]journalCheckpoint {
+	t.Helper()
+	checkpoints, err := journal.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	result := make(map[string]journalCheckpoint, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		result[checkpoint.ServiceName] = journalCheckpoint{idType: checkpoint.IdType, maxValue: checkpoint.MaxValue}
+	}
+	return result
+}
+
+func TestSegmentJournalReplay(t *testing.T) {
+	u := entity.ID_TYPE_UINT64
+	cases := []struct {
+		name    string
+		appends []journalAppend
+		want    map[string]journalCheckpoint
+	}{
+		{
+			name:    "empty",
+			appends: nil,
+			want:    map[string]journalCheckpoint{},
+		},
+		{
+			name:    "max of every service",
+			appends: []journalAppend{{"order", "", 1000}, {"user", "", 500}, {"order", "", 3000}, {"order", "", 2000}},
+			want:    map[string]journalCheckpoint{"order": {"", 3000}, "user": {"", 500}},
+		},
+		{
+			name:    "int64 is left out",
+			appends: []journalAppend{{"order", entity.ID_TYPE_INT64, 1000}},
+			want:    map[string]journalCheckpoint{"order": {"", 1000}},
+		},
+		{
+			name: "uint64 values below 2^63 are negative",
+			appends: []journalAppend{
+				{"order", u, entity.FromUint64(1000)},
+				{"order", u, entity.FromUint64(3000)},
+				{"order", u, entity.FromUint64(2000)},
+			},
+			want: map[string]journalCheckpoint{"order": {u, entity.FromUint64(3000)}},
+		},
+		{
+			name:    "uint64 zero",
+			appends: []journalAppend{{"order", u, math.MinInt64}},
+			want:    map[string]journalCheckpoint{"order": {u, math.MinInt64}},
+		},
+		{
+			name: "uint64 values passing 2^63",
+			appends: []journalAppend{
+				{"order", u, entity.FromUint64(1<<63 - 1)},
+				{"order", u, entity.FromUint64(math.MaxUint64)},
+				{"order", u, entity.FromUint64(1 << 63)},
+			},
+			want: map[string]journalCheckpoint{"order": {u, entity.FromUint64(math.MaxUint64)}},
+		},
+		{
+			name:    "the later id type wins",
+			appends: []journalAppend{{"order", "", 1000}, {"order", u, entity.FromUint64(500)}},
+			want:    map[string]journalCheckpoint{"order": {u, entity.FromUint64(500)}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			journal := newTestJournal(t, dir, 1<<20, 10)
+			openTestJournal(t, journal)
+			for _, item := range c.appends {
+				if err := journal.Append(item.serviceName, item.idType, item.maxValue-100, item.maxValue, 1); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+			journal.Close()
+
+			reopened := newTestJournal(t, dir, 1<<20, 10)
+			defer reopened.Close()
+			if got := openTestJournal(t, reopened); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("checkpoints: got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSegmentJournalRotate(t *testing.T) {
+	dir := t.TempDir()
+	// every append exceeds the size, so every next one rotates
+	journal := newTestJournal(t, dir, 1, 2)
+	openTestJournal(t, journal)
+	want := map[string]journalCheckpoint{}
+	for i := int64(1); i <= 5; i++ {
+		want["order"] = journalCheckpoint{"", i * 1000}
+		want["uint"] = journalCheckpoint{entity.ID_TYPE_UINT64, entity.FromUint64(uint64(i * 1000))}
+		for serviceName, checkpoint := range want {
+			if err := journal.Append(serviceName, checkpoint.idType, checkpoint.maxValue-1000, checkpoint.maxValue, i); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+		}
+	}
+	journal.Close()
+
+	fileNames, err := journal.listFiles()
+	if err != nil {
+		t.Fatalf("listFiles: %v", err)
+	} else if len(fileNames) != 2 {
+		t.Errorf("file num: got %d, want 2", len(fileNames))
+	}
+	// the older files are pruned, the checkpoints keep the max values and the id types
+	reopened := newTestJournal(t, dir, 1<<20, 2)
+	defer reopened.Close()
+	if got := openTestJournal(t, reopened); !reflect.DeepEqual(got, want) {
+		t.Errorf("checkpoints: got %v, want %v", got, want)
+	}
+}
+
+func TestSegmentJournalBrokenLines(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    map[string]journalCheckpoint
+	}{
+		{
+			name:    "truncated last line",
+			content: `{"serviceName":"order","maxValue":1000}` + "\n" + `{"serviceName":"order","maxVal`,
+			want:    map[string]journalCheckpoint{"order": {"", 1000}},
+		},
+		{
+			name:    "garbage between records",
+			content: `{"serviceName":"order","maxValue":1000}` + "\nnot json\n\n" + `{"serviceName":"order","maxValue":2000}` + "\n",
+			want:    map[string]journalCheckpoint{"order": {"", 2000}},
+		},
+		{
+			name:    "no service name",
+			content: `{"maxValue":5000}` + "\n" + `{"serviceName":"order","maxValue":1000}` + "\n",
+			want:    map[string]journalCheckpoint{"order": {"", 1000}},
+		},
+		{
+			name: "negative values",
+			content: `{"serviceName":"order","maxValue":-9223372036854774808,"idType":"uint64"}` + "\n" +
+				`{"serviceName":"order","maxValue":-9223372036854775000,"idType":"uint64"}` + "\n",
+			want: map[string]journalCheckpoint{"order": {entity.ID_TYPE_UINT64, entity.FromUint64(1000)}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fileName := filepath.Join(dir, SEGMENT_JOURNAL_FILE_PREFIX+"20240101T000000.000000000"+SEGMENT_JOURNAL_FILE_SUFFIX)
+			if err := os.WriteFile(fileName, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			journal := newTestJournal(t, dir, 1<<20, 10)
+			defer journal.Close()
+			if got := openTestJournal(t, journal); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("checkpoints: got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
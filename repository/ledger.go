@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	db "github.com/daemon-coder/idalloc/infrastructure/db_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+func (s *Store) InsertLedgerRecordToDB(ctx context.Context, record *entity.LedgerRecord) error {
+	query := db.SqlUtil{
+		DB:  s.DB,
+		Sql: "insert into tbl_alloc_ledger(service_name, start_value, end_value, instance_id, data_version, create_time) values (?, ?, ?, ?, ?, ?)",
+		Args: []interface{}{
+			record.ServiceName,
+			toDBLedgerValue(record.IdType, record.StartValue),
+			toDBLedgerValue(record.IdType, record.EndValue),
+			record.InstanceId,
+			record.DataVersion,
+			time.UnixMilli(record.CreateTime),
+		},
+	}
+	_, _, err := query.Exec(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnw("InsertLedgerRecordToDB", "record", record, "err", err)
+	}
+	return err
+}
+
+// toDBLedgerValue: the columns are unsigned, they store the values seen by the clients
+func toDBLedgerValue(idType string, value int64) interface{} {
+	if idType == entity.ID_TYPE_UINT64 {
+		return entity.ToUint64(value)
+	}
+	return value
+}
+
+// scanLedgerRecord: the values are converted to the process form of the id type of the service
+func scanLedgerRecord(row *sql.Rows, idType string) (*entity.LedgerRecord, error) {
+	var startValue, endValue uint64
+	record := &entity.LedgerRecord{IdType: idType}
+	if err := row.Scan(&record.ServiceName, &startValue, &endValue, &record.InstanceId, &record.DataVersion, &record.CreateTime); err != nil {
+		return nil, err
+	}
+	if idType == entity.ID_TYPE_UINT64 {
+		record.StartValue, record.EndValue = entity.FromUint64(startValue), entity.FromUint64(endValue)
+	} else {
+		record.StartValue, record.EndValue = int64(startValue), int64(endValue)
+	}
+	return record, nil
+}
+
+// GetLedgerRecordsFromDB: the records whose range contains the id, the earliest first.
+// More than one record means the id has been issued more than once.
+func (s *Store) GetLedgerRecordsFromDB(ctx context.Context, serviceName string, idType string, id int64) (result []*entity.LedgerRecord, err error) {
+	result = make([]*entity.LedgerRecord, 0)
+	query := db.SqlUtil{
+		DB: s.DB,
+		Sql: "select service_name, start_value, end_value, instance_id, data_version, cast(unix_timestamp(create_time) * 1000 as signed) " +
+			"from tbl_alloc_ledger where service_name = ? and start_value <= ? and end_value >= ? order by id limit ?",
+		Args: []interface{}{serviceName, toDBLedgerValue(idType, id), toDBLedgerValue(idType, id), def.LEDGER_QUERY_LIMIT},
+	}
+	err = query.QueryList(ctx, func(row *sql.Rows) (err error) {
+		record, err := scanLedgerRecord(row, idType)
+		if err == nil {
+			result = append(result, record)
+		}
+		return
+	})
+	return
+}
+
+// GetLedgerRecordContainingFromDB: the nearest segment starting at or below the id which contains it, nil if none.
+// It is a seek on the index of (service_name, start_value), so it stays fast however many segments there are.
+func (s *Store) GetLedgerRecordContainingFromDB(ctx context.Context, serviceName string, idType string, id int64) (result *entity.LedgerRecord, err error) {
+	query := db.SqlUtil{
+		DB: s.DB,
+		Sql: "select service_name, start_value, end_value, instance_id, data_version, cast(unix_timestamp(create_time) * 1000 as signed) " +
+			"from tbl_alloc_ledger where service_name = ? and start_value <= ? order by start_value desc limit ?",
+		Args: []interface{}{serviceName, toDBLedgerValue(idType, id), def.LEDGER_VERIFY_SCAN_NUM},
+	}
+	err = query.QueryList(ctx, func(row *sql.Rows) (err error) {
+		record, err := scanLedgerRecord(row, idType)
+		if err == nil && result == nil && record.EndValue >= id {
+			result = record
+		}
+		return
+	})
+	return
+}
+
+// DeleteLedgerRecordsFromDB: delete the records created before the time, LEDGER_PRUNE_BATCH_SIZE at most
+func (s *Store) DeleteLedgerRecordsFromDB(ctx context.Context, before time.Time) (int64, error) {
+	query := db.SqlUtil{
+		DB:   s.DB,
+		Sql:  "delete from tbl_alloc_ledger where create_time < ? limit ?",
+		Args: []interface{}{before, def.LEDGER_PRUNE_BATCH_SIZE},
+	}
+	rowsAffected, _, err := query.Exec(ctx)
+	return rowsAffected, err
+}
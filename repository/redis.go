@@ -2,173 +2,664 @@ package repository
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/daemon-coder/idalloc/definition"
 	"github.com/daemon-coder/idalloc/definition/entity"
 	"github.com/daemon-coder/idalloc/definition/errors"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
-	redis "github.com/daemon-coder/idalloc/infrastructure/redis_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
 	"github.com/daemon-coder/idalloc/util"
 	goRedis "github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	ALLOC_INFO_KEY_PATTERN			= "alloc_info_%s"
 	LAST_ALLOC_VALUE				= "lastAllocValue"
 	DATA_VERSION					= "dataVersion"
+	// ID_TYPE: only set for the counters of the uint64 services, see entity.ID_TYPE_UINT64
+	ID_TYPE							= "idType"
+	// EPOCH: bumped by every set of the counter other than the increments, so that the handlers holding segments
+	// notice the change on their next fetch even if they missed the invalidation
+	EPOCH							= "epoch"
 	LOCK_KEY_PATTERN				= "lock_%s"
+	IDEMPOTENT_KEY_PATTERN			= "idempotent_%s_%s"
+	INVALIDATE_SEGMENT_CHANNEL		= "invalidate_segment"
 )
 
-func GetAllocInfoRedisKey(serviceName string) string {
-	return definition.RedisKeyPrefix + fmt.Sprintf(ALLOC_INFO_KEY_PATTERN, serviceName)
+func (s *Store) GetAllocInfoRedisKey(serviceName string) string {
+	return s.KeyPrefix + fmt.Sprintf(ALLOC_INFO_KEY_PATTERN, serviceName)
 }
 
-func RedisIncr(serviceName string, increment int64) *entity.AllocInfo {
-	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+// RedisIncr: idType is the id type expected, empty if it is not known yet. A missing counter is created by the
+// increment only if it is ID_TYPE_INT64, otherwise nil is returned, so that the counter of a uint64 service lost
+// in redis is never recreated as an int64 one. The counter of another id type is not incremented.
+func (s *Store) RedisIncr(ctx context.Context, serviceName string, increment int64, idType string) (result *entity.AllocInfo, err error) {
+	traceInfra.WithSpan(ctx, "repository.RedisIncr", func(ctx context.Context, span trace.Span) {
+		result, err = s.redisIncr(ctx, serviceName, increment, idType)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return
+		} else if result == nil {
+			return
+		}
+		span.SetAttributes(attribute.Int64("idalloc.last_alloc_value", *result.LastAllocValue), attribute.Int64("idalloc.data_version", *result.DataVersion))
+	}, attribute.String("idalloc.service", serviceName), attribute.Int64("idalloc.increment", increment))
+	return
+}
+
+// RedisIncrCmd: returns {incremented, lastAllocValue, dataVersion, idType, epoch}, the value is read back by HGET
+// since the integer replies are doubles in lua
+var RedisIncrCmd = goRedis.NewScript(`
+local key = KEYS[1]
+local valueField = KEYS[2]
+local versionField = KEYS[3]
+local idTypeField = KEYS[4]
+local epochField = KEYS[5]
+local increment = ARGV[1]
+local inputIdType = ARGV[2]
+
+local values = redis.call("HMGET", key, valueField, versionField, idTypeField, epochField)
+local idTypeInRedis = values[3] or "int64"
+local epoch = tonumber(values[4]) or 0
+if not values[1] then
+	if inputIdType ~= "int64" then
+		return {0, "", 0, "", 0}
+	end
+elseif inputIdType ~= "" and inputIdType ~= idTypeInRedis then
+	return {0, values[1], tonumber(values[2]) or 0, idTypeInRedis, epoch}
+end
+redis.call("HINCRBY", key, valueField, increment)
+local version = redis.call("HINCRBY", key, versionField, 1)
+return {1, redis.call("HGET", key, valueField), version, idTypeInRedis, epoch}
+`)
+
+func (s *Store) redisIncr(ctx context.Context, serviceName string, increment int64, idType string) (*entity.AllocInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
 	defer cancel()
-	pipeline := redis.RedisClient.Pipeline()
-	lastAllocValueCmd := pipeline.HIncrBy(ctx, GetAllocInfoRedisKey(serviceName), LAST_ALLOC_VALUE, increment)
-	dataVersionCmd := pipeline.HIncrBy(ctx, GetAllocInfoRedisKey(serviceName), DATA_VERSION, 1)
-	_, err := pipeline.Exec(ctx)
+	result, err := RedisIncrCmd.Run(ctx, s.Redis, s.getAllocInfoScriptKeys(serviceName), increment, idType).Result()
 	if err != nil {
-		errors.Panic(err)
+		return nil, errors.FromStdError(err)
 	}
-	lastAllocValue, err := lastAllocValueCmd.Result()
-	if err != nil {
-		errors.Panic(err)
+	values, _ := result.([]interface{})
+	if len(values) != 5 {
+		return nil, errors.NewCriticalError(errors.WithMsg("RedisAllocInfoDirty. serviceName:" + serviceName))
 	}
-	dataVersion, err := dataVersionCmd.Result()
+	parsed := make([]int64, 3)
+	for i := range parsed {
+		if i == 1 && values[i] == "" {
+			continue
+		}
+		if parsed[i], err = parseScriptValue(serviceName, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	epoch, err := parseScriptValue(serviceName, values[4])
 	if err != nil {
-		errors.Panic(err)
+		return nil, err
+	}
+	idTypeInRedis, _ := values[3].(string)
+	if parsed[0] == 0 && idTypeInRedis == "" {
+		log.WithContext(ctx).Warnw("RedisIncrCounterMissing", "serviceName", serviceName, "idType", idType)
+		return nil, nil
+	} else if parsed[0] == 0 {
+		return nil, checkRedisIdType(serviceName, idTypeInRedis, idType)
+	}
+	log.WithContext(ctx).Infow("RedisIncr", "serviceName", serviceName, "increment", increment, "lastAllocValue", parsed[1], "dataVersion", parsed[2], "idType", idTypeInRedis)
+	if idTypeInRedis == entity.ID_TYPE_INT64 {
+		idTypeInRedis = ""
 	}
-	log.GetLogger().Infow("RedisIncr", "serviceName", serviceName, "increment", increment, "lastAllocValue", lastAllocValue, "dataVersion", dataVersion)
 	return &entity.AllocInfo{
 		ServiceName: util.Ptr(serviceName),
-		LastAllocValue: util.Ptr(lastAllocValue),
-		DataVersion: util.Ptr(dataVersion),
-	}
+		LastAllocValue: util.Ptr(parsed[1]),
+		DataVersion: util.Ptr(parsed[2]),
+		IdType: idTypeInRedis,
+		Epoch: epoch,
+	}, nil
 }
 
+// redisScriptFunctions: the values are compared as decimal strings and written back as they are, since the lua
+// numbers are doubles and lose the precision above 2^53. The values are canonical, they are written by HINCRBY
+// or formatted by strconv. The id type field is only kept for the uint64 counters.
+const redisScriptFunctions = `
+local function compareValue(a, b)
+	local aNegative, bNegative = a:sub(1, 1) == "-", b:sub(1, 1) == "-"
+	if aNegative ~= bNegative then
+		return aNegative and -1 or 1
+	end
+	local sign = aNegative and -1 or 1
+	if #a ~= #b then
+		return #a < #b and -sign or sign
+	end
+	if a == b then
+		return 0
+	end
+	return a < b and -sign or sign
+end
+
+local function setAllocInfo(key, valueField, value, versionField, version, idTypeField, idType, epochField)
+	redis.call("HMSET", key, valueField, value, versionField, version)
+	if idType == "int64" then
+		redis.call("HDEL", key, idTypeField)
+	else
+		redis.call("HSET", key, idTypeField, idType)
+	end
+	redis.call("HINCRBY", key, epochField, 1)
+end
+`
+
 // RedisCompareVersionAndSetCmd compare the data version in redis.
-// if the version is behind the given version, set the given data to redis
+// if the version is behind the given version, set the given data to redis, the id type included
 //
 // Output:
 // Returns lastAllocValue after all operations
 // Returns dataVersion after all operations
-var RedisCompareVersionAndSetCmd = goRedis.NewScript(`
+// Returns 1 if the given data is set, otherwise 0
+// Returns the id type after all operations
+var RedisCompareVersionAndSetCmd = goRedis.NewScript(redisScriptFunctions + `
 local key = KEYS[1]
 local valueField = KEYS[2]
 local versionField = KEYS[3]
-local inputValue = tonumber(ARGV[1])
+local idTypeField = KEYS[4]
+local epochField = KEYS[5]
+local inputValue = ARGV[1]
 local inputVersion = tonumber(ARGV[2])
+local inputIdType = ARGV[3]
 
-local values = redis.call("HMGET", key, valueField, versionField)
-local valueInRedis = tonumber(values[1])
+local values = redis.call("HMGET", key, valueField, versionField, idTypeField)
+local valueInRedis = values[1]
 local versionInRedis = tonumber(values[2])
-if versionInRedis == nil or valueInRedis == nil or versionInRedis < inputVersion then
-	redis.call("HMSET", key, valueField, inputValue, versionField, inputVersion)
-	return {inputValue, inputVersion}
+local idTypeInRedis = values[3] or "int64"
+if versionInRedis == nil or tonumber(valueInRedis) == nil or versionInRedis < inputVersion then
+	setAllocInfo(key, valueField, inputValue, versionField, ARGV[2], idTypeField, inputIdType, epochField)
+	return {inputValue, inputVersion, 1, inputIdType}
 end
-return {valueInRedis, versionInRedis}
+return {valueInRedis, versionInRedis, 0, idTypeInRedis}
 `)
 
-func RedisCompareVersionAndSet(serviceName string, lastAllocValue, dataVersion int64) (curLastAllocValue int64, curDataVersion int64) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+// RedisCompareVersionAndSet: a counter of another id type is not behind only if it is dirty or out of date,
+// it is reported as an error
+func (s *Store) RedisCompareVersionAndSet(ctx context.Context, serviceName string, lastAllocValue, dataVersion int64, idType string) (curLastAllocValue int64, curDataVersion int64, updated bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
 	defer cancel()
 
-	keys := []string{
-		GetAllocInfoRedisKey(serviceName),
-		LAST_ALLOC_VALUE,
-		DATA_VERSION,
-	}
-	argv := []interface{}{
-		lastAllocValue,
-		dataVersion,
+	idType = entity.NormalizeIdType(idType)
+	result, err := RedisCompareVersionAndSetCmd.Run(ctx, s.Redis, s.getAllocInfoScriptKeys(serviceName), lastAllocValue, dataVersion, idType).Result()
+	if err != nil {
+		err = errors.FromStdError(err)
+		return
 	}
-	result, err := RedisCompareVersionAndSetCmd.Run(ctx, redis.RedisClient, keys, argv...).Result()
+	var curIdType string
+	curLastAllocValue, curDataVersion, updated, curIdType, err = parseSetScriptResult(serviceName, result)
 	if err != nil {
-		errors.Panic(err)
+		return
 	}
-	curLastAllocValue = result.([]interface{})[0].(int64)
-	curDataVersion = result.([]interface{})[1].(int64)
-	log.GetLogger().Infow(
+	log.WithContext(ctx).Infow(
 		"RedisCompareVersionAndSet",
 		"serviceName", serviceName,
 		"valueInDB", lastAllocValue,
 		"versionInDB", dataVersion,
+		"idTypeInDB", idType,
 		"curLastAllocValue", curLastAllocValue,
 		"curDataVersion", curDataVersion,
+		"curIdType", curIdType,
+		"updated", updated,
 	)
+	err = checkRedisIdType(serviceName, curIdType, idType)
 	return
 }
 
-func RedisSet(serviceName string, lastAllocValue, dataVersion int64) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+// RedisMoveForwardCmd is RedisCompareVersionAndSetCmd which also refuses to move the lastAllocValue backwards,
+// for the data from elsewhere, e.g. a snapshot, whose version may be unrelated to the one in redis.
+// A counter of another id type is only set if it is missing or dirty.
+//
+// Output:
+// Returns lastAllocValue after all operations
+// Returns dataVersion after all operations
+// Returns 1 if the given data is set, otherwise 0
+// Returns the id type after all operations
+var RedisMoveForwardCmd = goRedis.NewScript(redisScriptFunctions + `
+local key = KEYS[1]
+local valueField = KEYS[2]
+local versionField = KEYS[3]
+local idTypeField = KEYS[4]
+local epochField = KEYS[5]
+local inputValue = ARGV[1]
+local inputVersion = tonumber(ARGV[2])
+local inputIdType = ARGV[3]
+
+local values = redis.call("HMGET", key, valueField, versionField, idTypeField)
+local valueInRedis = values[1]
+local versionInRedis = tonumber(values[2])
+local idTypeInRedis = values[3] or "int64"
+if versionInRedis == nil or tonumber(valueInRedis) == nil or
+	(idTypeInRedis == inputIdType and versionInRedis < inputVersion and compareValue(valueInRedis, inputValue) <= 0) then
+	setAllocInfo(key, valueField, inputValue, versionField, ARGV[2], idTypeField, inputIdType, epochField)
+	return {inputValue, inputVersion, 1, inputIdType}
+end
+return {valueInRedis, versionInRedis, 0, idTypeInRedis}
+`)
+
+func (s *Store) RedisMoveForward(ctx context.Context, serviceName string, lastAllocValue, dataVersion int64, idType string) (curLastAllocValue int64, curDataVersion int64, updated bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+
+	idType = entity.NormalizeIdType(idType)
+	result, err := RedisMoveForwardCmd.Run(ctx, s.Redis, s.getAllocInfoScriptKeys(serviceName), lastAllocValue, dataVersion, idType).Result()
+	if err != nil {
+		err = errors.FromStdError(err)
+		return
+	}
+	var curIdType string
+	curLastAllocValue, curDataVersion, updated, curIdType, err = parseSetScriptResult(serviceName, result)
+	if err != nil {
+		return
+	}
+	log.WithContext(ctx).Infow(
+		"RedisMoveForward",
+		"serviceName", serviceName,
+		"lastAllocValue", lastAllocValue,
+		"dataVersion", dataVersion,
+		"idType", idType,
+		"curLastAllocValue", curLastAllocValue,
+		"curDataVersion", curDataVersion,
+		"curIdType", curIdType,
+		"updated", updated,
+	)
+	err = checkRedisIdType(serviceName, curIdType, idType)
+	return
+}
+
+// RedisMergeForwardCmd sets the counter to the max of the lastAllocValues in redis and the given data, with a data
+// version above both, so that neither moves the other backwards afterwards. A missing or dirty counter is set to the
+// given data, a counter of another id type is not changed.
+//
+// Output:
+// Returns lastAllocValue after all operations
+// Returns dataVersion after all operations
+// Returns 1 if the counter is set, otherwise 0
+// Returns the id type after all operations
+var RedisMergeForwardCmd = goRedis.NewScript(redisScriptFunctions + `
+local key = KEYS[1]
+local valueField = KEYS[2]
+local versionField = KEYS[3]
+local idTypeField = KEYS[4]
+local epochField = KEYS[5]
+local inputValue = ARGV[1]
+local inputVersion = tonumber(ARGV[2])
+local inputIdType = ARGV[3]
+
+local values = redis.call("HMGET", key, valueField, versionField, idTypeField)
+local valueInRedis = values[1]
+local versionInRedis = tonumber(values[2])
+local idTypeInRedis = values[3] or "int64"
+if versionInRedis == nil or tonumber(valueInRedis) == nil then
+	setAllocInfo(key, valueField, inputValue, versionField, ARGV[2], idTypeField, inputIdType, epochField)
+	return {inputValue, inputVersion, 1, inputIdType}
+elseif idTypeInRedis ~= inputIdType then
+	return {valueInRedis, versionInRedis, 0, idTypeInRedis}
+end
+local value = valueInRedis
+if compareValue(valueInRedis, inputValue) < 0 then
+	value = inputValue
+end
+local version = math.max(versionInRedis, inputVersion) + 1
+setAllocInfo(key, valueField, value, versionField, version, idTypeField, inputIdType, epochField)
+return {value, version, 1, inputIdType}
+`)
+
+func (s *Store) RedisMergeForward(ctx context.Context, serviceName string, lastAllocValue, dataVersion int64, idType string) (after *entity.AllocInfo, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+
+	idType = entity.NormalizeIdType(idType)
+	result, err := RedisMergeForwardCmd.Run(ctx, s.Redis, s.getAllocInfoScriptKeys(serviceName), lastAllocValue, dataVersion, idType).Result()
+	if err != nil {
+		return nil, errors.FromStdError(err)
+	}
+	curLastAllocValue, curDataVersion, updated, curIdType, err := parseSetScriptResult(serviceName, result)
+	if err != nil {
+		return nil, err
+	}
+	log.WithContext(ctx).Infow(
+		"RedisMergeForward",
+		"serviceName", serviceName,
+		"lastAllocValue", lastAllocValue,
+		"dataVersion", dataVersion,
+		"idType", idType,
+		"curLastAllocValue", curLastAllocValue,
+		"curDataVersion", curDataVersion,
+		"curIdType", curIdType,
+		"updated", updated,
+	)
+	if err = checkRedisIdType(serviceName, curIdType, idType); err != nil {
+		return nil, err
+	}
+	if curIdType == entity.ID_TYPE_INT64 {
+		curIdType = ""
+	}
+	return &entity.AllocInfo{
+		ServiceName:    util.Ptr(serviceName),
+		LastAllocValue: util.Ptr(curLastAllocValue),
+		DataVersion:    util.Ptr(curDataVersion),
+		IdType:         curIdType,
+	}, nil
+}
+
+// RedisAdvanceCmd set the lastAllocValue to the given value and bump the data version,
+// so that the new value wins over older data in the db.
+// Moving the value backwards is refused unless force is set, so is changing the id type of the counter.
+//
+// Output:
+// Returns 1 if the value is set, otherwise 0
+// Returns lastAllocValue and dataVersion before the operation
+// Returns lastAllocValue and dataVersion after the operation
+// Returns the id type after the operation
+var RedisAdvanceCmd = goRedis.NewScript(redisScriptFunctions + `
+local key = KEYS[1]
+local valueField = KEYS[2]
+local versionField = KEYS[3]
+local idTypeField = KEYS[4]
+local epochField = KEYS[5]
+local inputValue = ARGV[1]
+local force = ARGV[2] == "1"
+local inputIdType = ARGV[3]
+local zeroValue = ARGV[4]
+
+local values = redis.call("HMGET", key, valueField, versionField, idTypeField)
+local valueInRedis = values[1]
+local versionInRedis = tonumber(values[2]) or 0
+local idTypeInRedis = values[3] or "int64"
+if tonumber(valueInRedis) == nil then
+	valueInRedis = zeroValue
+	idTypeInRedis = inputIdType
+end
+if idTypeInRedis ~= inputIdType or (compareValue(valueInRedis, inputValue) > 0 and not force) then
+	return {0, valueInRedis, versionInRedis, valueInRedis, versionInRedis, idTypeInRedis}
+end
+setAllocInfo(key, valueField, inputValue, versionField, versionInRedis + 1, idTypeField, inputIdType, epochField)
+return {1, valueInRedis, versionInRedis, inputValue, versionInRedis + 1, inputIdType}
+`)
+
+// RedisAdvance: lastAllocValue is in the process form of the id type, see entity.ID_TYPE_UINT64
+func (s *Store) RedisAdvance(ctx context.Context, serviceName string, lastAllocValue int64, idType string, force bool) (applied bool, before, after *entity.AllocInfo, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+
+	idType = entity.NormalizeIdType(idType)
+	forceArg := "0"
+	if force {
+		forceArg = "1"
+	}
+	argv := []interface{}{
+		lastAllocValue,
+		forceArg,
+		idType,
+		entity.ZeroValue(idType),
+	}
+	result, err := RedisAdvanceCmd.Run(ctx, s.Redis, s.getAllocInfoScriptKeys(serviceName), argv...).Result()
+	if err != nil {
+		err = errors.FromStdError(err)
+		return
+	}
+	values := result.([]interface{})
+	if len(values) != 6 {
+		err = errors.NewCriticalError(errors.WithMsg("RedisAllocInfoDirty. serviceName:" + serviceName))
+		return
+	}
+	parsed := make([]int64, 5)
+	for i := range parsed {
+		if parsed[i], err = parseScriptValue(serviceName, values[i]); err != nil {
+			return
+		}
+	}
+	curIdType, _ := values[5].(string)
+	applied = parsed[0] == 1
+	before = &entity.AllocInfo{
+		ServiceName:    util.Ptr(serviceName),
+		LastAllocValue: util.Ptr(parsed[1]),
+		DataVersion:    util.Ptr(parsed[2]),
+		IdType:         curIdType,
+	}
+	after = &entity.AllocInfo{
+		ServiceName:    util.Ptr(serviceName),
+		LastAllocValue: util.Ptr(parsed[3]),
+		DataVersion:    util.Ptr(parsed[4]),
+		IdType:         curIdType,
+	}
+	log.WithContext(ctx).Infow("RedisAdvance", "serviceName", serviceName, "force", force, "applied", applied, "before", before, "after", after)
+	err = checkRedisIdType(serviceName, curIdType, idType)
+	return
+}
+
+func (s *Store) getAllocInfoScriptKeys(serviceName string) []string {
+	return []string{
+		s.GetAllocInfoRedisKey(serviceName),
+		LAST_ALLOC_VALUE,
+		DATA_VERSION,
+		ID_TYPE,
+		EPOCH,
+	}
+}
+
+// parseScriptValue: the values are returned by the scripts as strings to keep their precision, the versions and the
+// flags as integers
+func parseScriptValue(serviceName string, value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case string:
+		if result, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return result, nil
+		}
+	}
+	msg := fmt.Sprintf("RedisAllocInfoDirty. serviceName:%s value:%v", serviceName, value)
+	return 0, errors.NewCriticalError(errors.WithMsg(msg))
+}
+
+func parseSetScriptResult(serviceName string, result interface{}) (lastAllocValue, dataVersion int64, updated bool, idType string, err error) {
+	values := result.([]interface{})
+	if len(values) != 4 {
+		err = errors.NewCriticalError(errors.WithMsg("RedisAllocInfoDirty. serviceName:" + serviceName))
+		return
+	}
+	if lastAllocValue, err = parseScriptValue(serviceName, values[0]); err != nil {
+		return
+	}
+	if dataVersion, err = parseScriptValue(serviceName, values[1]); err != nil {
+		return
+	}
+	updated = values[2].(int64) == 1
+	idType, _ = values[3].(string)
+	return
+}
+
+// checkRedisIdType: the counters of different id types can not be compared, nor can their values be mixed
+func checkRedisIdType(serviceName, idTypeInRedis, idType string) error {
+	if idTypeInRedis == idType {
+		return nil
+	}
+	msg := fmt.Sprintf("RedisIdTypeMismatch. serviceName:%s idTypeInRedis:%s input:%s", serviceName, idTypeInRedis, idType)
+	return errors.NewCriticalError(errors.WithMsg(msg))
+}
+
+func (s *Store) RedisSet(ctx context.Context, serviceName string, lastAllocValue, dataVersion int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
 	defer cancel()
 	data := map[string]interface{} {
 		LAST_ALLOC_VALUE: lastAllocValue,
 		DATA_VERSION: dataVersion,
 	}
-	redisResult := redis.RedisClient.HMSet(ctx, GetAllocInfoRedisKey(serviceName), data)
+	redisResult := s.Redis.HMSet(ctx, s.GetAllocInfoRedisKey(serviceName), data)
 	err := redisResult.Err()
 	if err != nil {
-		errors.Panic(err)
+		return errors.FromStdError(err)
 	}
+	return nil
 }
 
-func RedisGet(serviceName string) *entity.AllocInfo {
-	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+// RedisGet returns nil if the service does not exist in redis
+func (s *Store) RedisGet(ctx context.Context, serviceName string) (*entity.AllocInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
 	defer cancel()
-	redisCmd := redis.RedisClient.HMGet(ctx, GetAllocInfoRedisKey(serviceName), LAST_ALLOC_VALUE, DATA_VERSION)
+	redisCmd := s.Redis.HMGet(ctx, s.GetAllocInfoRedisKey(serviceName), LAST_ALLOC_VALUE, DATA_VERSION, ID_TYPE)
 	values, err := redisCmd.Result()
 	if err == goRedis.Nil {
-		return nil
+		return nil, nil
 	} else if err != nil {
-		errors.Panic(redisCmd.Err())
-	} else if len(values) != 2 {
-		errors.Panic(errors.NewCriticalError(errors.WithMsg("RedisAllocInfoDirty. serviceName:" + serviceName)))
+		return nil, errors.FromStdError(err)
+	} else if len(values) != 3 {
+		return nil, errors.NewCriticalError(errors.WithMsg("RedisAllocInfoDirty. serviceName:" + serviceName))
 	}
 	if values[0] == nil || values[1] == nil {
-		return nil
+		return nil, nil
 	}
 
 	lastAllocValue, err := strconv.ParseInt(values[0].(string), 10, 64)
 	if err != nil {
 		msg := fmt.Sprintf("RedisAllocInfoDirty. serviceName:%s lastAllocValue:%s", serviceName, values[0])
-		errors.Panic(errors.NewCriticalError(errors.WithMsg(msg)))
+		return nil, errors.NewCriticalError(errors.WithMsg(msg))
 	}
 	dataVersion, err := strconv.ParseInt(values[1].(string), 10, 64)
 	if err != nil {
 		msg := fmt.Sprintf("RedisAllocInfoDirty. serviceName:%s dataVersion:%s", serviceName, values[1])
-		errors.Panic(errors.NewCriticalError(errors.WithMsg(msg)))
+		return nil, errors.NewCriticalError(errors.WithMsg(msg))
 	}
+	idType, _ := values[2].(string)
 
 	return &entity.AllocInfo{
 		ServiceName: util.Ptr(serviceName),
 		LastAllocValue: util.Ptr(lastAllocValue),
 		DataVersion: util.Ptr(dataVersion),
+		IdType: idType,
+	}, nil
+}
+
+// RedisScanAllocInfoServiceNames returns the services having a counter in redis, the keys are scanned in batches
+func (s *Store) RedisScanAllocInfoServiceNames(ctx context.Context) ([]string, error) {
+	keyPrefix := s.GetAllocInfoRedisKey("")
+	result := make([]string, 0)
+	iter := s.Redis.Scan(ctx, 0, keyPrefix + "*", 1000).Iterator()
+	for iter.Next(ctx) {
+		result = append(result, strings.TrimPrefix(iter.Val(), keyPrefix))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.FromStdError(err)
 	}
+	return result, nil
 }
 
-func GetLockRedisKey(key string) string {
-	return definition.RedisKeyPrefix + fmt.Sprintf(LOCK_KEY_PATTERN, key)
+// RedisGetIdleTimes returns how long the counters of the services have not been touched, which is how recently their
+// segments were fetched. The services without a counter are left out. It fails if the maxmemory-policy of redis is
+// an LFU one, which does not track the idle times.
+func (s *Store) RedisGetIdleTimes(ctx context.Context, serviceNames []string) (map[string]time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10 * time.Second)
+	defer cancel()
+	pipe := s.Redis.Pipeline()
+	cmds := make([]*goRedis.DurationCmd, 0, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		cmds = append(cmds, pipe.ObjectIdleTime(ctx, s.GetAllocInfoRedisKey(serviceName)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != goRedis.Nil {
+		return nil, errors.FromStdError(err)
+	}
+	result := make(map[string]time.Duration, len(serviceNames))
+	for i, cmd := range cmds {
+		if idleTime, err := cmd.Result(); err == nil {
+			result[serviceNames[i]] = idleTime
+		}
+	}
+	return result, nil
 }
 
-func WithRedisLock(key string, expire time.Duration, fn func()) {
-	ctx, cancel := context.WithTimeout(context.Background(), expire)
+func (s *Store) GetLockRedisKey(key string) string {
+	return s.KeyPrefix + fmt.Sprintf(LOCK_KEY_PATTERN, key)
+}
+
+// WithRedisLock runs fn while holding the lock, and returns the error of fn
+func (s *Store) WithRedisLock(ctx context.Context, key string, expire time.Duration, fn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, expire)
 	defer cancel()
-	redisKey := GetLockRedisKey(key)
-	redisResult := redis.RedisClient.SetNX(ctx, redisKey, 1, expire)
+	redisKey := s.GetLockRedisKey(key)
+	redisResult := s.Redis.SetNX(ctx, redisKey, 1, expire)
 	ok, err := redisResult.Result()
 	if err != nil {
-		errors.Panic(err)
+		return errors.FromStdError(err)
 	}
 	if !ok {
-		errors.Panic(errors.NewBusinessError(errors.WithMsg("LockFailed. key:" + key)))
+		return errors.NewBusinessError(errors.WithMsg("LockFailed. key:" + key))
+	}
+	defer s.Redis.Del(ctx, redisKey)
+	return fn()
+}
+
+func (s *Store) GetIdempotentRedisKey(serviceName, requestId string) string {
+	return s.KeyPrefix + fmt.Sprintf(IDEMPOTENT_KEY_PATTERN, serviceName, requestId)
+}
+
+// RedisGetIdempotentRecord returns nil if no record is saved for the requestId
+func (s *Store) RedisGetIdempotentRecord(ctx context.Context, serviceName, requestId string) (*entity.IdempotentAllocRecord, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+	value, err := s.Redis.Get(ctx, s.GetIdempotentRedisKey(serviceName, requestId)).Result()
+	if err == goRedis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.FromStdError(err)
 	}
-	defer redis.RedisClient.Del(ctx, redisKey)
-	fn()
+	var record entity.IdempotentAllocRecord
+	err = json.Unmarshal([]byte(value), &record)
+	if err != nil {
+		msg := fmt.Sprintf("RedisIdempotentRecordDirty. serviceName:%s requestId:%s", serviceName, requestId)
+		return nil, errors.NewCriticalError(errors.WithMsg(msg))
+	}
+	return &record, nil
+}
+
+// RedisSetIdempotentRecordNX saves the record only if no record exists for the requestId yet.
+// Returns false if another request with the same requestId saved its record first.
+func (s *Store) RedisSetIdempotentRecordNX(ctx context.Context, serviceName, requestId string, record *entity.IdempotentAllocRecord, expire time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+	value, err := json.Marshal(record)
+	if err != nil {
+		return false, errors.FromStdError(err)
+	}
+	ok, err := s.Redis.SetNX(ctx, s.GetIdempotentRedisKey(serviceName, requestId), value, expire).Result()
+	if err != nil {
+		return false, errors.FromStdError(err)
+	}
+	return ok, nil
+}
+
+func (s *Store) GetInvalidateSegmentChannel() string {
+	return s.KeyPrefix + INVALIDATE_SEGMENT_CHANNEL
+}
+
+// RedisPublishInvalidateSegment notify all instances to drop the segments they hold for the service
+func (s *Store) RedisPublishInvalidateSegment(ctx context.Context, serviceName string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3 * time.Second)
+	defer cancel()
+	err := s.Redis.Publish(ctx, s.GetInvalidateSegmentChannel(), serviceName).Err()
+	if err != nil {
+		return errors.FromStdError(err)
+	}
+	return nil
+}
+
+func (s *Store) RedisSubscribeInvalidateSegment(ctx context.Context) *goRedis.PubSub {
+	return s.Redis.Subscribe(ctx, s.GetInvalidateSegmentChannel())
+}
+
+func (s *Store) RedisPing(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.Redis.Ping(ctx).Err()
 }
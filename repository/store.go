@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"database/sql"
+	"sync"
+
+	goRedis "github.com/redis/go-redis/v9"
+)
+
+// Store: the redis and db where the alloc info, service info and audit log are kept
+type Store struct {
+	Redis *goRedis.Client
+	DB    *sql.DB
+	// KeyPrefix: prefix of all the redis keys and channels, so that several apps can share one redis
+	KeyPrefix string
+
+	// idTypeColumn: whether tbl_alloc_info has the id_type column, nil until it is detected, see hasIdTypeColumn
+	schemaLock   sync.Mutex
+	idTypeColumn *bool
+}
+
+func NewStore(redisClient *goRedis.Client, db *sql.DB, keyPrefix string) *Store {
+	return &Store{
+		Redis:     redisClient,
+		DB:        db,
+		KeyPrefix: keyPrefix,
+	}
+}
@@ -1,5 +1,35 @@
 CREATE TABLE IF NOT EXISTS `tbl_alloc_info` (
     `service_name`        VARCHAR(64)     NOT NULL PRIMARY KEY,
     `last_alloc_value`    BIGINT UNSIGNED NOT NULL DEFAULT '0',
-	`data_version`        BIGINT UNSIGNED NOT NULL DEFAULT '0'
+	`data_version`        BIGINT UNSIGNED NOT NULL DEFAULT '0',
+    `id_type`             VARCHAR(8)      NOT NULL DEFAULT 'int64'
+) ENGINE = InnoDB CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `tbl_audit_log` (
+    `id`                  BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `service_name`        VARCHAR(64)     NOT NULL,
+    `action`              VARCHAR(32)     NOT NULL,
+    `operator`            VARCHAR(64)     NOT NULL DEFAULT '',
+    `detail`              TEXT            NOT NULL,
+    `create_time`         DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY `idx_service_name` (`service_name`)
+) ENGINE = InnoDB CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `tbl_service_info` (
+    `service_name`        VARCHAR(64)     NOT NULL PRIMARY KEY,
+    `status`              VARCHAR(16)     NOT NULL DEFAULT 'active',
+    `create_time`         DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    `update_time`         DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE = InnoDB CHARACTER SET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `tbl_alloc_ledger` (
+    `id`                  BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `service_name`        VARCHAR(64)     NOT NULL,
+    `start_value`         BIGINT UNSIGNED NOT NULL,
+    `end_value`           BIGINT UNSIGNED NOT NULL,
+    `instance_id`         VARCHAR(128)    NOT NULL,
+    `data_version`        BIGINT UNSIGNED NOT NULL,
+    `create_time`         DATETIME(3)     NOT NULL,
+    KEY `idx_service_name_start_value` (`service_name`, `start_value`, `end_value`),
+    KEY `idx_create_time` (`create_time`)
 ) ENGINE = InnoDB CHARACTER SET = utf8mb4;
@@ -1,106 +1,497 @@
 package service
 
 import (
+	"container/list"
 	"context"
+	stdErrors "errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
 	e "github.com/daemon-coder/idalloc/definition/errors"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
 	"github.com/daemon-coder/idalloc/repository"
+	"github.com/daemon-coder/idalloc/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 
-var DefaultAllocHandler *AllocHandler
-
 type AllocHandler struct {
 	sync.Mutex
+	store             *repository.Store
+	redisAllocHandler *RedisAllocHandler
+	registry          *ServiceRegistry
+	metrics           *Metrics
+
 	ctx      context.Context
 	wg       *sync.WaitGroup
 	cancel   context.CancelFunc
 	Stopped  chan struct{}
 	handlers map[string]*ServiceAllocHandler
+	// loaders: the handlers being created, so that concurrent requests of a service share one creation
+	loaders map[string]*serviceHandlerLoader
+	// lru: the loaded handlers, the most recently used at the front
+	lru *list.List
+
+	idempotentKeyExpire time.Duration
+	idleTimeout         time.Duration
+	maxHandlerNum       int
+
+	warmupMode         string
+	warmupServiceNames []string
+	warmupConcurrency  int
+	warmupQps          int
+	// Ready is closed when the warmup finishes
+	Ready        chan struct{}
+	warmupStatus warmupStatus
+}
+
+type serviceHandlerLoader struct {
+	done        chan struct{}
+	handler     *ServiceAllocHandler
+	err         error
+	invalidated bool
+}
+
+// errServiceAllocHandlerStopped: the handler is invalidated or evicted, the caller should retry with a new handler.
+// It is of its own type, so it is never taken for a BaseError, whose Data may be incomparable.
+var errServiceAllocHandlerStopped error = serviceAllocHandlerStoppedError{}
+
+type serviceAllocHandlerStoppedError struct{}
+
+func (serviceAllocHandlerStoppedError) Error() string {
+	return "ServiceAllocHandlerStopped"
 }
 
 type ServiceAllocHandler struct {
 	sync.Mutex
 	ctx            context.Context
+	cancel         context.CancelFunc
 	wg             *sync.WaitGroup
+	stopped        bool
+	// stopReason: the waste reason of the segments dropped, the first Stop sets it before the ctx is canceled
+	stopReason     atomic.Pointer[string]
 	serviceName    string
+	// idType: the id type of the first segment, it is never changed for a counter
+	idType         string
 	allocResult    *AllocResult
 	AsyncAllocChan chan *AllocResult
+	// epoch: the epoch of the counter of the last segment fetched, only used by the async alloc goroutine.
+	// epochChanged is set by it when a fetch sees another epoch, the current segment is dropped by the next Alloc.
+	epoch        int64
+	epochChanged atomic.Bool
+
+	redisAllocHandler *RedisAllocHandler
+	metrics           *Metrics
+
+	// lruElement and lastAccess are protected by the lock of AllocHandler
+	lruElement *list.Element
+	lastAccess time.Time
+
+	prefetchLock   sync.RWMutex
+	prefetchStatus PrefetchStatus
 }
 
+// AllocResult: a segment of the ids, the values are in the process form of the id type, see entity.ID_TYPE_UINT64
 type AllocResult struct {
-	LastAllocValue int64 `json:"lastAllocValue"`
-	MaxValue       int64 `json:"maxValue"`
+	LastAllocValue int64  `json:"lastAllocValue"`
+	MaxValue       int64  `json:"maxValue"`
+	IdType         string `json:"idType,omitempty"`
+	// Epoch: the epoch of the counter in redis when the segment was fetched, see repository.EPOCH
+	Epoch int64 `json:"-"`
+}
+
+const (
+	PREFETCH_FETCHING = "fetching"
+	PREFETCH_READY    = "ready"
+	PREFETCH_FAILED   = "failed"
+
+	// PREFETCH_RETRY_INTERVAL: the pause of the async alloc goroutine after a failed fetch
+	PREFETCH_RETRY_INTERVAL = 100 * time.Millisecond
+)
+
+// PrefetchStatus: the state of the async alloc goroutine of a service
+type PrefetchStatus struct {
+	Status    string       `json:"status"`
+	Segment   *AllocResult `json:"segment"`
+	LastError string       `json:"lastError"`
+	UpdatedAt int64        `json:"updatedAt"`
 }
 
-func InitAllocHandler() *AllocHandler {
-	ctx, cancel := context.WithCancel(context.Background())
-	DefaultAllocHandler = &AllocHandler{
+// ServiceAllocSnapshot: the in-process state of a service alloc handler
+type ServiceAllocSnapshot struct {
+	ServiceName    string         `json:"serviceName"`
+	CurrentSegment AllocResult    `json:"currentSegment"`
+	Prefetch       PrefetchStatus `json:"prefetch"`
+}
+
+// NewAllocHandler: ctx carries the logger of the handler. The registry is bound to the new handler, metrics may be nil.
+func NewAllocHandler(ctx context.Context, config *def.Config, store *repository.Store, redisAllocHandler *RedisAllocHandler, registry *ServiceRegistry, metrics *Metrics) *AllocHandler {
+	ctx, cancel := context.WithCancel(ctx)
+	handler := &AllocHandler{
+		store:				store,
+		redisAllocHandler:	redisAllocHandler,
+		registry:			registry,
+		metrics:			metrics,
+
 		wg:			&sync.WaitGroup{},
 		ctx:		ctx,
 		cancel:		cancel,
 		Stopped:	make(chan struct{}),
 		handlers:	make(map[string]*ServiceAllocHandler),
+		loaders:	make(map[string]*serviceHandlerLoader),
+		lru:		list.New(),
+
+		idempotentKeyExpire:	config.IdempotentKeyExpire,
+		idleTimeout:			config.ServiceHandlerIdleTimeout,
+		maxHandlerNum:			config.MaxServiceHandlerNum,
+
+		warmupMode:			config.WarmupMode,
+		warmupServiceNames:	config.WarmupServiceNames,
+		warmupConcurrency:	config.WarmupConcurrency,
+		warmupQps:			config.WarmupQps,
+		Ready:				make(chan struct{}),
 	}
-	return DefaultAllocHandler
+	registry.allocHandler = handler
+	return handler
 }
 
-// Start: recover redis from db and init all service alloc handlers
-func (a *AllocHandler) Start() {
-	DefaultRedisAllocHandler.RecoverRedisFromDB()
-	allocInfoList := repository.GetAllFromDB()
-	for _, allocInfo := range allocInfoList {
-		a.GetServiceAllocHandler(*allocInfo.ServiceName)
+func (a *AllocHandler) Store() *repository.Store {
+	return a.store
+}
+
+// Start: recover redis from db and warm up the service alloc handlers in background.
+// Allocs are served during the warmup, Ready is closed when it finishes.
+func (a *AllocHandler) Start() error {
+	if err := a.redisAllocHandler.RecoverRedisFromDB(ctxInfra.WithTraceId(a.ctx, "AllocHandlerStart")); err != nil {
+		return err
+	}
+	if err := a.StartWarmup(); err != nil {
+		return err
 	}
+	a.StartInvalidateListener()
+	if a.idleTimeout > 0 {
+		a.StartIdleEvictor()
+	}
+	return nil
 }
 
-// Shutdown: shutdown all alloc handlers
+// StartIdleEvictor: stop the handlers not used for idleTimeout, releasing their goroutines and segments
+func (a *AllocHandler) StartIdleEvictor() {
+	ctx := ctxInfra.WithTraceId(a.ctx, "IdleEvictor")
+	a.wg.Add(1)
+	go func() {
+		log.WithContext(ctx).Info("Start")
+		defer log.WithContext(ctx).Info("Stopped")
+		defer a.wg.Done()
+
+		interval := a.idleTimeout / 2
+		if interval < time.Second {
+			interval = time.Second
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				a.EvictIdleServiceAllocHandlers(ctx)
+			}
+		}
+	}()
+}
+
+func (a *AllocHandler) EvictIdleServiceAllocHandlers(ctx context.Context) {
+	deadline := time.Now().Add(-a.idleTimeout)
+	evicted := make([]*ServiceAllocHandler, 0)
+	a.Lock()
+	for element := a.lru.Back(); element != nil; element = a.lru.Back() {
+		handler := element.Value.(*ServiceAllocHandler)
+		if handler.lastAccess.After(deadline) {
+			break
+		}
+		a.removeHandlerLocked(handler.serviceName)
+		evicted = append(evicted, handler)
+	}
+	a.Unlock()
+	stopEvictedHandlers(ctx, evicted, "idle")
+}
+
+// StartInvalidateListener: drop the service alloc handler and reload the service registry
+// when another instance changes the counter or the status of the service
+func (a *AllocHandler) StartInvalidateListener() {
+	ctx := ctxInfra.WithTraceId(a.ctx, "InvalidateListener")
+	a.wg.Add(1)
+	go func() {
+		log.WithContext(ctx).Info("Start")
+		defer log.WithContext(ctx).Info("Stopped")
+		defer a.wg.Done()
+
+		pubsub := a.store.RedisSubscribeInvalidateSegment(ctx)
+		defer pubsub.Close()
+		msgChan := pubsub.Channel()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case msg, ok := <-msgChan:
+				if !ok {
+					return
+				}
+				log.WithContext(ctx).Infow("ReceiveInvalidateSegment", "serviceName", msg.Payload)
+				if err := a.registry.ReloadService(ctx, msg.Payload); err != nil {
+					log.WithContext(ctx).Warnw("ReloadServiceFailed", "serviceName", msg.Payload, "err", err)
+				}
+				a.InvalidateServiceAllocHandler(ctx, msg.Payload)
+			}
+		}
+	}()
+}
+
+// Shutdown: shutdown all alloc handlers, the segments they hold are recorded as wasted
 func (a *AllocHandler) Shutdown() {
-	log.GetLogger().Info("AsyncAllocHandlerShutdownStart")
+	log.WithContext(a.ctx).Info("AsyncAllocHandlerShutdownStart")
 	a.cancel()
 	a.wg.Wait()
+	a.Lock()
+	handlers := make([]*ServiceAllocHandler, 0, len(a.handlers))
+	for _, handler := range a.handlers {
+		handlers = append(handlers, handler)
+	}
+	a.Unlock()
+	for _, handler := range handlers {
+		handler.Stop(WASTE_REASON_SHUTDOWN)
+	}
 	close(a.Stopped)
-	log.GetLogger().Info("AsyncAllocHandlerShutdownFinish")
+	log.WithContext(a.ctx).Info("AsyncAllocHandlerShutdownFinish")
 }
 
-func (a *AllocHandler) Alloc(serviceName string, count int64) []int64 {
-	serviceHandler := a.GetServiceAllocHandler(serviceName)
-	return serviceHandler.Alloc(count)
+// Alloc: the ids are in the process form of the id type of the service, see entity.ID_TYPE_UINT64
+func (a *AllocHandler) Alloc(ctx context.Context, serviceName string, count int64) (ids []int64, idType string, err error) {
+	for {
+		if a.ctx.Err() != nil {
+			return nil, "", e.NewServerError(e.WithMsg("ServiceStopped"))
+		}
+		// checked on every retry, the handler stopped may have been invalidated by freezing or retiring the service
+		if err := a.registry.CheckAllocatable(ctx, serviceName); err != nil {
+			return nil, "", err
+		}
+		serviceHandler, err := a.GetServiceAllocHandler(ctx, serviceName)
+		if err != nil {
+			return nil, "", err
+		}
+		result, err := serviceHandler.Alloc(ctx, count)
+		// the handler may be invalidated concurrently, then retry with a new one
+		if !stdErrors.Is(err, errServiceAllocHandlerStopped) {
+			return result, serviceHandler.IdType(), err
+		}
+	}
+}
+
+// IdempotentAlloc: the ids returned for a requestId are saved in redis, and retries with the same
+// requestId get the same ids. Reusing a requestId with a different count is rejected.
+func (a *AllocHandler) IdempotentAlloc(ctx context.Context, serviceName string, requestId string, count int64) (ids []int64, idType string, err error) {
+	record, err := a.store.RedisGetIdempotentRecord(ctx, serviceName, requestId)
+	if err != nil {
+		return nil, "", err
+	}
+	if record == nil {
+		ids, idType, err := a.Alloc(ctx, serviceName, count)
+		if err != nil {
+			return nil, "", err
+		}
+		record = &entity.IdempotentAllocRecord{
+			Count:  count,
+			Ids:    ids,
+			IdType: idType,
+		}
+		saved, err := a.store.RedisSetIdempotentRecordNX(ctx, serviceName, requestId, record, a.idempotentKeyExpire)
+		if err != nil {
+			a.redisAllocHandler.recordWaste(ctx, serviceName, WASTE_REASON_ABANDONED, int64(len(ids)))
+			return nil, "", err
+		} else if saved {
+			return record.Ids, record.IdType, nil
+		}
+		// a concurrent request with the same requestId saved its ids first, the ids of this one are dropped
+		log.WithContext(ctx).Warnw("IdempotentAllocConflict", "serviceName", serviceName, "requestId", requestId, "droppedIds", record.Ids)
+		a.redisAllocHandler.recordWaste(ctx, serviceName, WASTE_REASON_ABANDONED, int64(len(ids)))
+		record, err = a.store.RedisGetIdempotentRecord(ctx, serviceName, requestId)
+		if err != nil {
+			return nil, "", err
+		} else if record == nil {
+			return nil, "", e.NewServerError(e.WithMsg("IdempotentRecordExpired. requestId:" + requestId))
+		}
+	}
+
+	if record.Count != count {
+		errMsg := fmt.Sprintf("requestId is reused with a different count. requestId:%s count:%d input:%d", requestId, record.Count, count)
+		return nil, "", e.NewParamError(e.WithMsg(errMsg))
+	}
+	log.WithContext(ctx).Infow("IdempotentAllocReplay", "serviceName", serviceName, "requestId", requestId)
+	return record.Ids, record.IdType, nil
 }
 
-func (a *AllocHandler) GetServiceAllocHandler(serviceName string) *ServiceAllocHandler {
+// GetServiceAllocHandler: get or create the handler of the service.
+// The handler is created outside the lock, so that a slow redis alloc does not block other services.
+// The creation is shared by the waiting requests, so it is not canceled with the ctx of the caller.
+func (a *AllocHandler) GetServiceAllocHandler(ctx context.Context, serviceName string) (*ServiceAllocHandler, error) {
 	a.Lock()
-	defer a.Unlock()
+	if handler, ok := a.handlers[serviceName]; ok {
+		handler.lastAccess = time.Now()
+		a.lru.MoveToFront(handler.lruElement)
+		a.Unlock()
+		return handler, nil
+	}
+	loader, loading := a.loaders[serviceName]
+	if !loading {
+		loader = &serviceHandlerLoader{done: make(chan struct{})}
+		a.loaders[serviceName] = loader
+	}
+	a.Unlock()
+
+	if loading {
+		<-loader.done
+	} else {
+		a.loadServiceAllocHandler(context.WithoutCancel(ctx), serviceName, loader)
+	}
+	return loader.handler, loader.err
+}
 
+func (a *AllocHandler) loadServiceAllocHandler(ctx context.Context, serviceName string, loader *serviceHandlerLoader) {
+	defer close(loader.done)
+
+	handler, err := a.NewServiceAllocHandler(ctx, serviceName)
+	if err != nil {
+		a.Lock()
+		delete(a.loaders, serviceName)
+		a.Unlock()
+		loader.err = err
+		return
+	}
+	evicted := make([]*ServiceAllocHandler, 0)
+	a.Lock()
+	delete(a.loaders, serviceName)
+	invalidated := loader.invalidated
+	if !invalidated {
+		handler.lastAccess = time.Now()
+		handler.lruElement = a.lru.PushFront(handler)
+		a.handlers[serviceName] = handler
+		for a.maxHandlerNum > 0 && len(a.handlers) > a.maxHandlerNum {
+			leastUsed := a.lru.Back().Value.(*ServiceAllocHandler)
+			a.removeHandlerLocked(leastUsed.serviceName)
+			evicted = append(evicted, leastUsed)
+		}
+	}
+	a.Unlock()
+	loader.handler = handler
+	if invalidated {
+		// the segment may be allocated before the counter is changed, the caller will retry with a new handler
+		handler.Stop(WASTE_REASON_INVALIDATED)
+	}
+	stopEvictedHandlers(ctx, evicted, "overflow")
+}
+
+func (a *AllocHandler) removeHandlerLocked(serviceName string) *ServiceAllocHandler {
 	handler, ok := a.handlers[serviceName]
-	if ok {
-		return handler
+	if !ok {
+		return nil
 	}
-	handler = a.NewServiceAllocHandler(serviceName)
-	a.handlers[serviceName] = handler
+	delete(a.handlers, serviceName)
+	a.lru.Remove(handler.lruElement)
 	return handler
 }
 
-func (a *AllocHandler) NewServiceAllocHandler(serviceName string) *ServiceAllocHandler {
+func stopEvictedHandlers(ctx context.Context, handlers []*ServiceAllocHandler, reason string) {
+	for _, handler := range handlers {
+		handler.Stop(WASTE_REASON_EVICTED)
+		log.WithContext(ctx).Infow("EvictServiceAllocHandler", "serviceName", handler.serviceName, "reason", reason)
+	}
+}
+
+// GetLoadedServiceAllocHandler: return the handler of the service if this instance holds one, without creating it
+func (a *AllocHandler) GetLoadedServiceAllocHandler(serviceName string) *ServiceAllocHandler {
+	a.Lock()
+	defer a.Unlock()
+	return a.handlers[serviceName]
+}
+
+func (a *AllocHandler) LoadedServiceNames() []string {
+	a.Lock()
+	defer a.Unlock()
+	result := make([]string, 0, len(a.handlers))
+	for serviceName := range a.handlers {
+		result = append(result, serviceName)
+	}
+	return result
+}
+
+// InvalidateServiceAllocHandler: drop the handler of the service together with the segments it holds,
+// the next alloc creates a new handler from the current counter in redis
+func (a *AllocHandler) InvalidateServiceAllocHandler(ctx context.Context, serviceName string) {
+	a.Lock()
+	handler := a.removeHandlerLocked(serviceName)
+	if loader, ok := a.loaders[serviceName]; ok {
+		loader.invalidated = true
+	}
+	a.Unlock()
+	if handler != nil {
+		handler.Stop(WASTE_REASON_INVALIDATED)
+		log.WithContext(ctx).Infow("InvalidateServiceAllocHandler", "serviceName", serviceName)
+	}
+}
+
+// NewServiceAllocHandler: the id type of the handler is the one of its first segment, the later segments of another
+// id type are refused
+func (a *AllocHandler) NewServiceAllocHandler(ctx context.Context, serviceName string) (*ServiceAllocHandler, error) {
+	allocResult, err := a.redisAllocHandler.Alloc(ctx, serviceName, "")
+	if err != nil {
+		return nil, err
+	}
+	handlerCtx, cancel := context.WithCancel(a.ctx)
 	result := &ServiceAllocHandler{
-		ctx:			a.ctx,
+		ctx:			handlerCtx,
+		cancel:			cancel,
 		wg:				a.wg,
 		serviceName:	serviceName,
+		idType:			allocResult.IdType,
+		allocResult:	allocResult,
 		AsyncAllocChan:	make(chan *AllocResult),
+		epoch:			allocResult.Epoch,
+
+		redisAllocHandler:	a.redisAllocHandler,
+		metrics:			a.metrics,
 	}
-	result.allocResult = DefaultRedisAllocHandler.Alloc(serviceName)
 	result.StartAsyncAlloc()
-	return result
+	return result, nil
 }
 
-func (a *ServiceAllocHandler) Alloc(count int64) (result []int64) {
-	result = make([]int64, 0, count)
+// Alloc: returns errServiceAllocHandlerStopped if the handler has been stopped, the caller should retry with a new handler
+func (a *ServiceAllocHandler) Alloc(ctx context.Context, count int64) (result []int64, err error) {
+	traceInfra.WithSpan(ctx, "ServiceAllocHandler.Alloc", func(ctx context.Context, span trace.Span) {
+		result, err = a.alloc(ctx, count)
+	}, attribute.String("idalloc.service", a.serviceName), attribute.Int64("idalloc.count", count))
+	return
+}
+
+func (a *ServiceAllocHandler) alloc(ctx context.Context, count int64) (result []int64, err error) {
 	a.Lock()
 	defer a.Unlock()
+	if a.stopped {
+		return nil, errServiceAllocHandlerStopped
+	}
+	// the counter was set after the current segment was fetched, its ids may be out of the new range
+	if a.epochChanged.CompareAndSwap(true, false) {
+		a.recordSegmentWaste(ctx, WASTE_REASON_INVALIDATED, a.allocResult)
+		a.allocResult.LastAllocValue = a.allocResult.MaxValue
+	}
+	result = make([]int64, 0, count)
 
 	targetValue := a.allocResult.LastAllocValue + count
 	if targetValue <= a.allocResult.MaxValue {
@@ -108,22 +499,15 @@ func (a *ServiceAllocHandler) Alloc(count int64) (result []int64) {
 			result = append(result, i)
 		}
 		a.allocResult.LastAllocValue = targetValue
-		return
+		a.metrics.ObserveAlloc(a.serviceName, len(result), a.allocResult)
+		return result, nil
 	} else {
 		// alloc from AsyncAllocChan
-		var newAllocResult *AllocResult
-		timeout := time.NewTimer(5 * time.Second)
-		defer timeout.Stop()
-		select {
-		case newAllocResult = <-a.AsyncAllocChan:
-			if newAllocResult == nil {
-				e.Panic(e.NewServerError(e.WithMsg("ServiceStopped")))
-			}
-			log.GetLogger().Infow("AllocFromAsyncAllocChan", "allocResult", newAllocResult)
-		case <-timeout.C:
-			e.Panic(e.NewServerError(e.WithMsg("ServiceBusy")))
+		newAllocResult, err := a.waitAsyncAlloc(ctx)
+		if err != nil {
+			return nil, err
 		}
-		
+
 		for i := a.allocResult.LastAllocValue + 1; i <= a.allocResult.MaxValue; i++ {
 			result = append(result, i)
 		}
@@ -133,15 +517,111 @@ func (a *ServiceAllocHandler) Alloc(count int64) (result []int64) {
 		}
 		newAllocResult.LastAllocValue = targetValue
 		a.allocResult = newAllocResult
+		a.metrics.ObserveAlloc(a.serviceName, len(result), a.allocResult)
+		return result, nil
+	}
+}
+
+func (a *ServiceAllocHandler) waitAsyncAlloc(ctx context.Context) (newAllocResult *AllocResult, err error) {
+	traceInfra.WithSpan(ctx, "ServiceAllocHandler.WaitAsyncAlloc", func(ctx context.Context, span trace.Span) {
+		timeout := time.NewTimer(5 * time.Second)
+		defer timeout.Stop()
+		waitStart := time.Now()
+		select {
+		case newAllocResult = <-a.AsyncAllocChan:
+			if newAllocResult == nil {
+				err = e.NewServerError(e.WithMsg("ServiceStopped"))
+				return
+			}
+			a.metrics.ObservePrefetchWait(time.Since(waitStart))
+			log.WithContext(ctx).Infow("AllocFromAsyncAllocChan", "allocResult", newAllocResult)
+		case <-a.ctx.Done():
+			err = errServiceAllocHandlerStopped
+		case <-ctx.Done():
+			err = e.NewServerError(e.WithMsg("RequestCanceled"))
+		case <-timeout.C:
+			a.metrics.IncServiceBusy(a.serviceName)
+			err = e.NewServerError(e.WithMsg("ServiceBusy"))
+		}
+	})
+	return
+}
+
+// Stop: stop the async alloc goroutine and drop the segments held by the handler, they are recorded as wasted
+// for the reason. The prefetched segment is recorded by the async alloc goroutine.
+func (a *ServiceAllocHandler) Stop(reason string) {
+	// the concurrent Stops of shutdown, invalidation and eviction keep the first reason, so that the segments held
+	// and prefetched are recorded under the same one
+	a.stopReason.CompareAndSwap(nil, &reason)
+	// cancel before locking, so that an Alloc waiting on AsyncAllocChan releases the lock
+	a.cancel()
+	a.Lock()
+	defer a.Unlock()
+	if a.stopped {
 		return
 	}
+	a.stopped = true
+	a.recordSegmentWaste(a.ctx, a.getStopReason(), a.allocResult)
+	a.metrics.ForgetService(a.serviceName)
+}
+
+// getStopReason: WASTE_REASON_SHUTDOWN if the ctx is canceled without Stop on shutdown
+func (a *ServiceAllocHandler) getStopReason() string {
+	if reason := a.stopReason.Load(); reason != nil {
+		return *reason
+	}
+	return WASTE_REASON_SHUTDOWN
+}
+
+// IdType: ID_TYPE_*, empty is ID_TYPE_INT64
+func (a *ServiceAllocHandler) IdType() string {
+	return a.idType
+}
+
+func (a *ServiceAllocHandler) Snapshot() *ServiceAllocSnapshot {
+	a.Lock()
+	currentSegment := *a.allocResult
+	a.Unlock()
+
+	return &ServiceAllocSnapshot{
+		ServiceName:    a.serviceName,
+		CurrentSegment: currentSegment,
+		Prefetch:       a.GetPrefetchStatus(),
+	}
+}
+
+// GetPrefetchStatus: unlike Snapshot, it does not wait for the Alloc in progress
+func (a *ServiceAllocHandler) GetPrefetchStatus() PrefetchStatus {
+	a.prefetchLock.RLock()
+	defer a.prefetchLock.RUnlock()
+	result := a.prefetchStatus
+	if result.Segment != nil {
+		result.Segment = util.Ptr(*result.Segment)
+	}
+	return result
+}
+
+func (a *ServiceAllocHandler) setPrefetchStatus(status string, segment *AllocResult, err error) {
+	a.prefetchLock.Lock()
+	defer a.prefetchLock.Unlock()
+	a.prefetchStatus.Status = status
+	a.prefetchStatus.UpdatedAt = time.Now().UnixMilli()
+	if segment != nil {
+		a.prefetchStatus.Segment = util.Ptr(*segment)
+	} else {
+		a.prefetchStatus.Segment = nil
+	}
+	if err != nil {
+		a.prefetchStatus.LastError = err.Error()
+	}
 }
 
 func (a *ServiceAllocHandler) StartAsyncAlloc() {
+	ctx := ctxInfra.WithTraceId(a.ctx, "AsyncAllocHandler-"+a.serviceName)
 	a.wg.Add(1)
-	go threadLocal.SetTraceIdWithCallBack("AsyncAllocHandler-" + a.serviceName, func() {
-		log.GetLogger().Info("Start")
-		defer log.GetLogger().Info("Stopped")
+	go func() {
+		log.WithContext(ctx).Info("Start")
+		defer log.WithContext(ctx).Info("Stopped")
 		defer a.wg.Done()
 
 		for {
@@ -151,15 +631,32 @@ func (a *ServiceAllocHandler) StartAsyncAlloc() {
 			default:
 			}
 
-			allocResult, err := DefaultRedisAllocHandler.AllocWithoutPanic(a.serviceName)
+			a.setPrefetchStatus(PREFETCH_FETCHING, nil, nil)
+			allocResult, err := a.redisAllocHandler.Alloc(ctx, a.serviceName, entity.NormalizeIdType(a.idType))
 			if err != nil {
+				a.setPrefetchStatus(PREFETCH_FAILED, nil, err)
+				// the failures are retried after a pause, so that a broken redis or journal is not hammered
+				select {
+				case <-a.ctx.Done():
+					return
+				case <-time.After(PREFETCH_RETRY_INTERVAL):
+				}
 				continue
 			}
+			// the invalidation of a counter set elsewhere is published once, the epoch catches the handlers that
+			// missed it before they take the next segment
+			if allocResult.Epoch != a.epoch {
+				log.WithContext(ctx).Warnw("CounterEpochChanged", "epoch", a.epoch, "newEpoch", allocResult.Epoch)
+				a.epoch = allocResult.Epoch
+				a.epochChanged.Store(true)
+			}
+			a.setPrefetchStatus(PREFETCH_READY, allocResult, nil)
 			select {
 			case <-a.ctx.Done():
+				a.recordSegmentWaste(ctx, a.getStopReason(), allocResult)
 				return
 			case a.AsyncAllocChan <- allocResult:
 			}
 		}
-	})
+	}()
 }
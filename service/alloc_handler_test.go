@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"go.uber.org/zap"
+)
+
+func newTestAllocHandler(t *testing.T, redis *fakeRedis) *AllocHandler {
+	t.Helper()
+	ctx := log.WithLogger(context.Background(), zap.NewNop())
+	redisAllocHandler := newTestRedisAllocHandler(t, redis, "")
+	config := &def.Config{WarmupMode: def.WARMUP_MODE_LAZY, WarmupConcurrency: 1}
+	registry := NewServiceRegistry(ctx, config, redisAllocHandler.store)
+	return NewAllocHandler(ctx, config, redisAllocHandler.store, redisAllocHandler, registry, nil)
+}
+
+// waitPrefetchReady: the async alloc goroutine holds the next segment, which is the fetchNum-th one from redis
+func waitPrefetchReady(t *testing.T, redis *fakeRedis, handler *ServiceAllocHandler, fetchNum int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for redis.incrCount() < fetchNum || handler.GetPrefetchStatus().Status != PREFETCH_READY {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch status: got %+v, want %s", handler.GetPrefetchStatus(), PREFETCH_READY)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceAllocHandlerEpochChanged(t *testing.T) {
+	ctx := log.WithLogger(context.Background(), zap.NewNop())
+	redis := newFakeRedis()
+	allocHandler := newTestAllocHandler(t, redis)
+	defer allocHandler.cancel()
+
+	// the current segment is [1, 100], [101, 200] is prefetched
+	handler, err := allocHandler.NewServiceAllocHandler(ctx, "order")
+	if err != nil {
+		t.Fatalf("NewServiceAllocHandler: %v", err)
+	}
+	defer handler.Stop(WASTE_REASON_SHUTDOWN)
+	waitPrefetchReady(t, redis, handler, 2)
+
+	// the counter is advanced, and the invalidation is missed
+	redis.set(allocHandler.store.GetAllocInfoRedisKey("order"), 10000)
+	ids, err := handler.Alloc(ctx, 150)
+	if err != nil {
+		t.Fatalf("Alloc: %v", err)
+	} else if ids[len(ids)-1] != 150 {
+		t.Fatalf("last id: got %d, want 150", ids[len(ids)-1])
+	}
+
+	// the next fetch sees the new epoch, the rest of [101, 200] is dropped
+	waitPrefetchReady(t, redis, handler, 3)
+	ids, err = handler.Alloc(ctx, 1)
+	if err != nil {
+		t.Fatalf("Alloc: %v", err)
+	} else if ids[0] != 10001 {
+		t.Errorf("id after the epoch changed: got %d, want 10001", ids[0])
+	}
+	if report := allocHandler.redisAllocHandler.WasteReport(); len(report.Services) != 1 {
+		t.Errorf("waste report: got %d services, want 1", len(report.Services))
+	} else if wasted := report.Services[0].WastedIds; wasted[WASTE_REASON_INVALIDATED] != 50 {
+		t.Errorf("wasted ids: got %v, want 50 invalidated", wasted)
+	}
+}
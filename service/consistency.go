@@ -0,0 +1,393 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+)
+
+const (
+	// CONSISTENCY_REDIS_MISSING: the counter is in the db but not in redis, the next alloc would start from 0
+	CONSISTENCY_REDIS_MISSING = "redis_missing"
+	// CONSISTENCY_REDIS_DIRTY: the counter in redis is not numeric, see RedisAllocInfoDirty
+	CONSISTENCY_REDIS_DIRTY = "redis_dirty"
+	// CONSISTENCY_REDIS_BEHIND_DB: lastAllocValue in redis is below the db, the ids between may be issued again
+	CONSISTENCY_REDIS_BEHIND_DB = "redis_behind_db"
+	// CONSISTENCY_REDIS_VERSION_BEHIND_DB: dataVersion in redis is below the db
+	CONSISTENCY_REDIS_VERSION_BEHIND_DB = "redis_version_behind_db"
+	// CONSISTENCY_VERSION_REGRESSION: dataVersion in redis moved backwards since the last check
+	CONSISTENCY_VERSION_REGRESSION = "version_regression"
+	// CONSISTENCY_DB_MISSING: the counter is in redis but not in the db, it may be transient for a new service
+	CONSISTENCY_DB_MISSING = "db_missing"
+	// CONSISTENCY_SEGMENT_BEYOND_REDIS: a segment held by this instance is above the counter in redis
+	CONSISTENCY_SEGMENT_BEYOND_REDIS = "segment_beyond_redis"
+	// CONSISTENCY_ID_TYPE_MISMATCH: the id types of the counter in redis and in the db differ, the values are not compared
+	CONSISTENCY_ID_TYPE_MISMATCH = "id_type_mismatch"
+
+	// CONSISTENCY_REPAIR_OPERATOR: the operator in the audit logs of the scheduled repairs
+	CONSISTENCY_REPAIR_OPERATOR = "consistency_checker"
+)
+
+var CONSISTENCY_ISSUE_KINDS = []string{
+	CONSISTENCY_REDIS_MISSING,
+	CONSISTENCY_REDIS_DIRTY,
+	CONSISTENCY_REDIS_BEHIND_DB,
+	CONSISTENCY_REDIS_VERSION_BEHIND_DB,
+	CONSISTENCY_VERSION_REGRESSION,
+	CONSISTENCY_DB_MISSING,
+	CONSISTENCY_SEGMENT_BEYOND_REDIS,
+	CONSISTENCY_ID_TYPE_MISMATCH,
+}
+
+type ConsistencyIssue struct {
+	ServiceName string `json:"serviceName"`
+	Kind        string `json:"kind"`
+	Detail      string `json:"detail"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repairError"`
+}
+
+type ConsistencyReport struct {
+	StartedAt  int64               `json:"startedAt"`
+	FinishedAt int64               `json:"finishedAt"`
+	ServiceNum int                 `json:"serviceNum"`
+	Repair     bool                `json:"repair"`
+	Issues     []*ConsistencyIssue `json:"issues"`
+}
+
+// ConsistencyChecker: checks that the counter in redis is never behind the db nor the segments held by this instance,
+// periodically and on demand. The problems can be repaired by moving the counters forward.
+type ConsistencyChecker struct {
+	// Mutex: one check at a time
+	sync.Mutex
+	store        *repository.Store
+	allocHandler *AllocHandler
+	metrics      *Metrics
+	interval     time.Duration
+	autoRepair   bool
+	// lastRedis: the counters in redis seen by the checks before, to find the regressions
+	lastRedis  map[string]entity.AllocInfo
+	lastReport atomic.Pointer[ConsistencyReport]
+
+	Stopped chan struct{}
+	wg      *sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewConsistencyChecker: ctx carries the logger of the checker, metrics may be nil
+func NewConsistencyChecker(ctx context.Context, config *def.Config, store *repository.Store, allocHandler *AllocHandler, metrics *Metrics) *ConsistencyChecker {
+	ctx, cancel := context.WithCancel(ctx)
+	return &ConsistencyChecker{
+		store:        store,
+		allocHandler: allocHandler,
+		metrics:      metrics,
+		interval:     config.ConsistencyCheckInterval,
+		autoRepair:   config.ConsistencyAutoRepair,
+		lastRedis:    make(map[string]entity.AllocInfo),
+		Stopped:      make(chan struct{}),
+		wg:           &sync.WaitGroup{},
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Start: check all the services every interval, nothing is scheduled if the interval is 0
+func (c *ConsistencyChecker) Start() {
+	if c.interval <= 0 {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+				ctx := ctxInfra.WithTraceId(c.ctx, "ConsistencyCheck")
+				if _, err := c.Check(ctx, nil, c.autoRepair, CONSISTENCY_REPAIR_OPERATOR); err != nil {
+					log.WithContext(ctx).Errorw("ConsistencyCheckFailed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func (c *ConsistencyChecker) Shutdown() {
+	log.WithContext(c.ctx).Info("ConsistencyCheckerShutdownStart")
+	c.cancel()
+	c.wg.Wait()
+	close(c.Stopped)
+	log.WithContext(c.ctx).Info("ConsistencyCheckerShutdownFinish")
+}
+
+// LastReport: nil if no check has finished
+func (c *ConsistencyChecker) LastReport() *ConsistencyReport {
+	return c.lastReport.Load()
+}
+
+// Check: check the given services, or all the services in the db, in redis and loaded by this instance.
+// The problems found are repaired if repair is set, and the repairs are written to the audit log as operator.
+func (c *ConsistencyChecker) Check(ctx context.Context, serviceNames []string, repair bool, operator string) (*ConsistencyReport, error) {
+	c.Lock()
+	defer c.Unlock()
+	report := &ConsistencyReport{
+		StartedAt: time.Now().UnixMilli(),
+		Repair:    repair,
+		Issues:    make([]*ConsistencyIssue, 0),
+	}
+
+	// the segments are read before the db, and the db before redis. Redis only moves forward and the db follows it,
+	// so the allocs during the check are not reported as problems.
+	segmentMaxValues := c.getSegmentMaxValues(serviceNames)
+	var dbAllocInfos []*entity.AllocInfo
+	var err error
+	if len(serviceNames) == 0 {
+		dbAllocInfos, err = c.store.GetAllFromDB(ctx)
+	} else {
+		dbAllocInfos, err = c.store.GetAllocInfoFromDB(ctx, serviceNames...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dbAllocInfoMap := make(map[string]*entity.AllocInfo, len(dbAllocInfos))
+	serviceNameSet := make(map[string]struct{})
+	for _, allocInfo := range dbAllocInfos {
+		dbAllocInfoMap[*allocInfo.ServiceName] = allocInfo
+		serviceNameSet[*allocInfo.ServiceName] = struct{}{}
+	}
+	for serviceName := range segmentMaxValues {
+		serviceNameSet[serviceName] = struct{}{}
+	}
+	if len(serviceNames) == 0 {
+		redisServiceNames, err := c.store.RedisScanAllocInfoServiceNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, serviceName := range redisServiceNames {
+			serviceNameSet[serviceName] = struct{}{}
+		}
+	} else {
+		for _, serviceName := range serviceNames {
+			serviceNameSet[serviceName] = struct{}{}
+		}
+	}
+	sortedServiceNames := make([]string, 0, len(serviceNameSet))
+	for serviceName := range serviceNameSet {
+		sortedServiceNames = append(sortedServiceNames, serviceName)
+	}
+	sort.Strings(sortedServiceNames)
+
+	for _, serviceName := range sortedServiceNames {
+		redisAllocInfo, err := c.store.RedisGet(ctx, serviceName)
+		// RedisGet returns a CriticalError only for the dirty data, the other errors break the check
+		if err != nil && e.FromStdError(err).Type != e.CriticalErrorType {
+			return nil, err
+		}
+		segmentMaxValue, loaded := segmentMaxValues[serviceName]
+		state := &serviceConsistencyState{
+			serviceName:     serviceName,
+			redis:           redisAllocInfo,
+			redisErr:        err,
+			db:              dbAllocInfoMap[serviceName],
+			loaded:          loaded,
+			segmentMaxValue: segmentMaxValue,
+		}
+		if state.db != nil {
+			state.idType = state.db.IdType
+		} else if redisAllocInfo != nil {
+			state.idType = redisAllocInfo.IdType
+		} else if handler := c.allocHandler.GetLoadedServiceAllocHandler(serviceName); handler != nil {
+			state.idType = handler.IdType()
+		}
+		issues := c.checkService(state)
+		if repair && len(issues) > 0 {
+			c.repairService(ctx, state, issues, operator)
+		}
+		if redisAllocInfo != nil {
+			c.lastRedis[serviceName] = *redisAllocInfo
+		}
+		report.Issues = append(report.Issues, issues...)
+	}
+	report.ServiceNum = len(sortedServiceNames)
+	report.FinishedAt = time.Now().UnixMilli()
+
+	c.lastReport.Store(report)
+	c.metrics.ObserveConsistencyCheck(report)
+	for _, issue := range report.Issues {
+		log.WithContext(ctx).Warnw("ConsistencyIssue", "issue", issue)
+	}
+	log.WithContext(ctx).Infow("ConsistencyCheckFinished", "serviceNum", report.ServiceNum, "issueNum", len(report.Issues), "repair", repair)
+	return report, nil
+}
+
+type serviceConsistencyState struct {
+	serviceName     string
+	redis           *entity.AllocInfo
+	redisErr        error
+	db              *entity.AllocInfo
+	loaded          bool
+	segmentMaxValue int64
+	// idType: the id type of the counter in the db, or in redis if the db is missing
+	idType string
+}
+
+// getSegmentMaxValues: the max value of the segments held by this instance, by service
+func (c *ConsistencyChecker) getSegmentMaxValues(serviceNames []string) map[string]int64 {
+	if len(serviceNames) == 0 {
+		serviceNames = c.allocHandler.LoadedServiceNames()
+	}
+	result := make(map[string]int64)
+	for _, serviceName := range serviceNames {
+		handler := c.allocHandler.GetLoadedServiceAllocHandler(serviceName)
+		if handler == nil {
+			continue
+		}
+		snapshot := handler.Snapshot()
+		maxValue := snapshot.CurrentSegment.MaxValue
+		if snapshot.Prefetch.Segment != nil && snapshot.Prefetch.Segment.MaxValue > maxValue {
+			maxValue = snapshot.Prefetch.Segment.MaxValue
+		}
+		result[serviceName] = maxValue
+	}
+	return result
+}
+
+func (c *ConsistencyChecker) checkService(state *serviceConsistencyState) []*ConsistencyIssue {
+	issues := make([]*ConsistencyIssue, 0)
+	addIssue := func(kind, format string, args ...interface{}) {
+		issues = append(issues, &ConsistencyIssue{ServiceName: state.serviceName, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	redis, db := state.redis, state.db
+	formatValue := func(value int64) string {
+		return entity.FormatValue(state.idType, value)
+	}
+	if state.redisErr != nil {
+		addIssue(CONSISTENCY_REDIS_DIRTY, "%s", e.FromStdError(state.redisErr).Msg)
+	} else if redis == nil {
+		if db != nil {
+			addIssue(CONSISTENCY_REDIS_MISSING, "db lastAllocValue:%s dataVersion:%d", formatValue(*db.LastAllocValue), *db.DataVersion)
+		}
+	} else {
+		if db == nil {
+			addIssue(CONSISTENCY_DB_MISSING, "redis lastAllocValue:%s dataVersion:%d", formatValue(*redis.LastAllocValue), *redis.DataVersion)
+		} else if redisIdType, dbIdType := entity.NormalizeIdType(redis.IdType), entity.NormalizeIdType(db.IdType); redisIdType != dbIdType {
+			addIssue(CONSISTENCY_ID_TYPE_MISMATCH, "redis idType:%s db idType:%s", redisIdType, dbIdType)
+			return issues
+		} else {
+			if *redis.LastAllocValue < *db.LastAllocValue {
+				addIssue(CONSISTENCY_REDIS_BEHIND_DB, "redis lastAllocValue:%s db lastAllocValue:%s", formatValue(*redis.LastAllocValue), formatValue(*db.LastAllocValue))
+			}
+			if *redis.DataVersion < *db.DataVersion {
+				addIssue(CONSISTENCY_REDIS_VERSION_BEHIND_DB, "redis dataVersion:%d db dataVersion:%d", *redis.DataVersion, *db.DataVersion)
+			}
+		}
+		// a forced counter change moves lastAllocValue backwards with a new version, so only the version is compared
+		if last, ok := c.lastRedis[state.serviceName]; ok && *redis.DataVersion < *last.DataVersion {
+			addIssue(CONSISTENCY_VERSION_REGRESSION, "redis dataVersion:%d last checked dataVersion:%d", *redis.DataVersion, *last.DataVersion)
+		}
+	}
+	if state.loaded && state.redisErr == nil {
+		redisLastAllocValue := entity.ZeroValue(state.idType)
+		if redis != nil {
+			redisLastAllocValue = *redis.LastAllocValue
+		}
+		if state.segmentMaxValue > redisLastAllocValue {
+			addIssue(CONSISTENCY_SEGMENT_BEYOND_REDIS, "segment maxValue:%s redis lastAllocValue:%s", formatValue(state.segmentMaxValue), formatValue(redisLastAllocValue))
+		}
+	}
+	return issues
+}
+
+// repairService: the counters are only moved forward. Redis and the db are merged to the max value with a version
+// above both, then redis is moved above the segments held, and then written to the db if it is missing there.
+// A version regression can not be repaired.
+func (c *ConsistencyChecker) repairService(ctx context.Context, state *serviceConsistencyState, issues []*ConsistencyIssue, operator string) {
+	kinds := make(map[string]bool)
+	for _, issue := range issues {
+		kinds[issue.Kind] = true
+	}
+	results := make(map[string]error)
+	redisBefore := state.redis
+	redisChanged := false
+
+	if kinds[CONSISTENCY_REDIS_MISSING] || kinds[CONSISTENCY_REDIS_DIRTY] ||
+		kinds[CONSISTENCY_REDIS_BEHIND_DB] || kinds[CONSISTENCY_REDIS_VERSION_BEHIND_DB] {
+		var err error
+		if state.db == nil {
+			err = e.NewBusinessError(e.WithMsg("the db is missing, set the counter by the admin api"))
+		} else {
+			// the max of the values with a version above both, since a version behind does not mean a value behind.
+			// The db takes it too, so that neither moves the other backwards.
+			var after *entity.AllocInfo
+			if after, err = c.store.RedisMergeForward(ctx, state.serviceName, *state.db.LastAllocValue, *state.db.DataVersion, state.db.IdType); err == nil {
+				redisChanged = true
+				err = c.store.InsertOrUpdateAllocInfoToDB(ctx, after)
+			}
+		}
+		for _, kind := range []string{CONSISTENCY_REDIS_MISSING, CONSISTENCY_REDIS_DIRTY, CONSISTENCY_REDIS_BEHIND_DB, CONSISTENCY_REDIS_VERSION_BEHIND_DB} {
+			results[kind] = err
+		}
+	}
+	if kinds[CONSISTENCY_SEGMENT_BEYOND_REDIS] {
+		// not applied if redis has been moved above the segment meanwhile
+		applied, _, after, err := c.store.RedisAdvance(ctx, state.serviceName, state.segmentMaxValue, state.idType, false)
+		if err == nil && applied {
+			redisChanged = true
+			err = c.store.InsertOrUpdateAllocInfoToDB(ctx, after)
+		}
+		results[CONSISTENCY_SEGMENT_BEYOND_REDIS] = err
+	}
+	if kinds[CONSISTENCY_DB_MISSING] {
+		results[CONSISTENCY_DB_MISSING] = c.store.InsertOrUpdateAllocInfoToDB(ctx, state.redis)
+	}
+	results[CONSISTENCY_VERSION_REGRESSION] = e.NewBusinessError(e.WithMsg("can not be repaired, check the counter and set it by the admin api"))
+	results[CONSISTENCY_ID_TYPE_MISMATCH] = results[CONSISTENCY_VERSION_REGRESSION]
+
+	for _, issue := range issues {
+		if err := results[issue.Kind]; err != nil {
+			issue.RepairError = e.FromStdError(err).Msg
+		} else {
+			issue.Repaired = true
+		}
+		if issue.Kind != CONSISTENCY_VERSION_REGRESSION && issue.Kind != CONSISTENCY_ID_TYPE_MISMATCH {
+			c.metrics.IncConsistencyRepair(issue.Repaired)
+		}
+	}
+	if !redisChanged {
+		return
+	}
+
+	// the segments held may be below the repaired counter, so they are dropped by all instances
+	c.allocHandler.InvalidateServiceAllocHandler(ctx, state.serviceName)
+	if err := c.store.RedisPublishInvalidateSegment(ctx, state.serviceName); err != nil {
+		log.WithContext(ctx).Errorw("PublishInvalidateSegmentFailed", "serviceName", state.serviceName, "err", err)
+	}
+	redisAfter, _ := c.store.RedisGet(ctx, state.serviceName)
+	detail, _ := json.Marshal(map[string]interface{}{
+		"issues": issues,
+		"before": redisBefore,
+		"after":  redisAfter,
+	})
+	writeAuditLog(ctx, c.store, &entity.AuditLog{
+		ServiceName: state.serviceName,
+		Action:      entity.AUDIT_ACTION_REPAIR_COUNTER,
+		Operator:    operator,
+		Detail:      string(detail),
+	})
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+)
+
+// AdvanceCounter: set the lastAllocValue of the service in redis and db, the next id allocated will be lastAllocValue+1.
+// Moving the counter backwards may issue duplicate ids, so it is refused unless force is set.
+// The segments held by all instances are invalidated, so that no id below the new value is issued afterwards.
+// The instances missing the invalidation drop them on their next segment fetch, see repository.EPOCH.
+// lastAllocValue is in the process form of idType, a counter of another id type is refused.
+func (a *AllocHandler) AdvanceCounter(ctx context.Context, serviceName string, lastAllocValue int64, idType string, force bool, operator, reason string) (before, after *entity.AllocInfo, err error) {
+	serviceInfo, err := a.registry.Ensure(ctx, serviceName)
+	if err != nil {
+		return nil, nil, err
+	} else if serviceInfo.Status == entity.SERVICE_STATUS_RETIRED {
+		return nil, nil, e.NewForbiddenError(e.WithMsg("service is retired. service_name: " + serviceName))
+	}
+	// make sure redis is not behind the db before comparing
+	if err = a.redisAllocHandler.RecoverRedisFromDB(ctx, serviceName); err != nil {
+		return nil, nil, err
+	}
+
+	applied, before, after, err := a.store.RedisAdvance(ctx, serviceName, lastAllocValue, idType, force)
+	if err != nil {
+		return nil, nil, err
+	} else if !applied {
+		errMsg := fmt.Sprintf(
+			"value is behind the current lastAllocValue, set force to move it backwards. current:%s input:%s",
+			entity.FormatValue(idType, *before.LastAllocValue),
+			entity.FormatValue(idType, lastAllocValue),
+		)
+		return nil, nil, e.NewParamError(e.WithMsg(errMsg), e.WithData(before))
+	}
+	// redis has been changed, so the segments are invalidated and the audit log is written even if the db write fails.
+	// The error is returned afterwards, and the operation can be retried with the same value.
+	writeDBErr := a.store.InsertOrUpdateAllocInfoToDB(ctx, after)
+
+	a.InvalidateServiceAllocHandler(ctx, serviceName)
+	publishErr := a.store.RedisPublishInvalidateSegment(ctx, serviceName)
+
+	detail, _ := json.Marshal(map[string]interface{}{
+		"before": before,
+		"after":  after,
+		"force":  force,
+		"reason": reason,
+	})
+	writeAuditLog(ctx, a.store, &entity.AuditLog{
+		ServiceName: serviceName,
+		Action:      entity.AUDIT_ACTION_ADVANCE_COUNTER,
+		Operator:    operator,
+		Detail:      string(detail),
+	})
+	if writeDBErr != nil {
+		return before, after, writeDBErr
+	}
+	return before, after, publishErr
+}
+
+// RecoverService: set the counter of the service in redis to the db if redis is behind, otherwise nothing is changed.
+// The segments held by the instances are below the counter in redis, so they are not invalidated.
+func (a *AllocHandler) RecoverService(ctx context.Context, serviceName string) error {
+	return a.redisAllocHandler.RecoverRedisFromDB(ctx, serviceName)
+}
+
+// FindLedgerRecords: which instances fetched the segments containing the id, from the ledger.
+// The id is in the process form of the id type of the service.
+func (a *AllocHandler) FindLedgerRecords(ctx context.Context, serviceName string, idType string, id int64) ([]*entity.LedgerRecord, error) {
+	return a.store.GetLedgerRecordsFromDB(ctx, serviceName, idType, id)
+}
+
+// GetIdType: the id type of the counter of the service, the db is the source of the id types.
+// ID_TYPE_INT64 if the counter does not exist yet.
+func (a *AllocHandler) GetIdType(ctx context.Context, serviceName string) (string, error) {
+	if handler := a.GetLoadedServiceAllocHandler(serviceName); handler != nil {
+		return entity.NormalizeIdType(handler.IdType()), nil
+	}
+	allocInfo, err := a.store.GetServiceAllocInfoFromDB(ctx, serviceName)
+	if err != nil {
+		return "", err
+	} else if allocInfo == nil {
+		if allocInfo, err = a.store.RedisGet(ctx, serviceName); err != nil {
+			return "", err
+		} else if allocInfo == nil {
+			return entity.ID_TYPE_INT64, nil
+		}
+	}
+	return entity.NormalizeIdType(allocInfo.IdType), nil
+}
+
+// writeAuditLog: the operation has been applied when the audit log is written, so a failure is only logged
+func writeAuditLog(ctx context.Context, store *repository.Store, auditLog *entity.AuditLog) {
+	if err := store.InsertAuditLogToDB(ctx, auditLog); err != nil {
+		log.WithContext(ctx).Errorw("WriteAuditLogFailed", "auditLog", auditLog, "err", err)
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+// ExhaustionForecast: when the counter of a service reaches its max value at the current rate
+type ExhaustionForecast struct {
+	ServiceName    string       `json:"serviceName"`
+	LastAllocValue entity.Value `json:"lastAllocValue"`
+	MaxValue       entity.Value `json:"maxValue"`
+	// MaxValueOutOfRange: the configured max value is beyond the max of the id type, which is used instead
+	MaxValueOutOfRange bool `json:"maxValueOutOfRange,omitempty"`
+	// Remaining: unsigned, it exceeds int64 for the uint64 services
+	Remaining uint64 `json:"remaining"`
+	// Rate: the ids allocated per second by all the instances
+	Rate float64 `json:"rate"`
+	// SecondsToExhaustion: -1 if the counter is not moving forward
+	SecondsToExhaustion float64 `json:"secondsToExhaustion"`
+	// ExhaustAt: the unix time in milliseconds, 0 if it is not moving forward or too far away
+	ExhaustAt int64 `json:"exhaustAt"`
+	// Level: how many of the WarnThresholds the forecast is below
+	Level int `json:"level"`
+}
+
+type exhaustionSample struct {
+	time           time.Time
+	lastAllocValue int64
+}
+
+// ExhaustionForecaster: samples the counters returned by the redis increments of every service, see def.ExhaustionForecast
+type ExhaustionForecaster struct {
+	sync.Mutex
+	config  def.ExhaustionForecast
+	metrics *Metrics
+	samples map[string][]exhaustionSample
+	// idTypes: the id types of the services sampled, empty is entity.ID_TYPE_INT64
+	idTypes map[string]string
+	// levels: the levels logged by the last check, a warning is logged when the level of a service rises
+	levels map[string]int
+}
+
+func NewExhaustionForecaster(config def.ExhaustionForecast, metrics *Metrics) *ExhaustionForecaster {
+	config.WarnThresholds = append([]time.Duration(nil), config.WarnThresholds...)
+	sort.Slice(config.WarnThresholds, func(i, j int) bool {
+		return config.WarnThresholds[i] > config.WarnThresholds[j]
+	})
+	return &ExhaustionForecaster{
+		config:  config,
+		metrics: metrics,
+		samples: make(map[string][]exhaustionSample),
+		idTypes: make(map[string]string),
+		levels:  make(map[string]int),
+	}
+}
+
+// Observe: the increments returned out of order are ignored, so is a counter moved backwards by force,
+// the samples before it expire with the window. lastAllocValue is in the process form of idType.
+func (f *ExhaustionForecaster) Observe(serviceName string, lastAllocValue int64, idType string) {
+	now := time.Now()
+	f.Lock()
+	defer f.Unlock()
+	if idType != f.idTypes[serviceName] {
+		// the values of different id types can not be compared
+		delete(f.samples, serviceName)
+		f.idTypes[serviceName] = idType
+	}
+	samples := f.samples[serviceName]
+	n := len(samples)
+	if n > 0 && lastAllocValue <= samples[n-1].lastAllocValue {
+		return
+	}
+	sample := exhaustionSample{time: now, lastAllocValue: lastAllocValue}
+	if n >= 2 && now.Sub(samples[n-2].time) < f.config.Window/def.EXHAUSTION_FORECAST_SAMPLE_NUM {
+		samples[n-1] = sample
+	} else {
+		samples = append(samples, sample)
+	}
+	f.samples[serviceName] = f.pruneLocked(samples, now)
+}
+
+// pruneLocked: the samples in the window and the last one before it are kept, nil if the last increment is out of the window
+func (f *ExhaustionForecaster) pruneLocked(samples []exhaustionSample, now time.Time) []exhaustionSample {
+	windowStart := now.Add(-f.config.Window)
+	if len(samples) == 0 || samples[len(samples)-1].time.Before(windowStart) {
+		return nil
+	}
+	first := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].time.Before(windowStart)
+	})
+	if first > 1 {
+		samples = append(samples[:0], samples[first-1:]...)
+	}
+	return samples
+}
+
+// Forecast: nil if the service has less than 2 increments around the window
+func (f *ExhaustionForecaster) Forecast(serviceName string) *ExhaustionForecast {
+	f.Lock()
+	defer f.Unlock()
+	return f.forecastLocked(serviceName, time.Now())
+}
+
+func (f *ExhaustionForecaster) forecastLocked(serviceName string, now time.Time) *ExhaustionForecast {
+	samples := f.pruneLocked(f.samples[serviceName], now)
+	if samples == nil {
+		delete(f.samples, serviceName)
+		delete(f.idTypes, serviceName)
+		return nil
+	}
+	f.samples[serviceName] = samples
+	first, last := samples[0], samples[len(samples)-1]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if len(samples) < 2 || elapsed <= 0 {
+		return nil
+	}
+
+	idType := f.idTypes[serviceName]
+	maxValue, inRange := f.maxValue(serviceName, idType)
+	result := &ExhaustionForecast{
+		ServiceName:         serviceName,
+		LastAllocValue:      entity.Value{IdType: idType, Raw: last.lastAllocValue},
+		MaxValue:            entity.Value{IdType: idType, Raw: maxValue},
+		MaxValueOutOfRange:  !inRange,
+		Rate:                float64(last.lastAllocValue-first.lastAllocValue) / elapsed,
+		SecondsToExhaustion: -1,
+	}
+	if maxValue > last.lastAllocValue {
+		result.Remaining = uint64(maxValue) - uint64(last.lastAllocValue)
+	}
+	if result.Rate > 0 {
+		result.SecondsToExhaustion = float64(result.Remaining)/result.Rate - now.Sub(last.time).Seconds()
+		if result.SecondsToExhaustion < 0 {
+			result.SecondsToExhaustion = 0
+		}
+		if exhaustAt := float64(now.UnixMilli()) + result.SecondsToExhaustion*1000; exhaustAt < math.MaxInt64 {
+			result.ExhaustAt = int64(exhaustAt)
+		}
+		for _, threshold := range f.config.WarnThresholds {
+			if result.SecondsToExhaustion < threshold.Seconds() {
+				result.Level++
+			}
+		}
+	}
+	return result
+}
+
+// maxValue: the process form of the max value of the id type, the configured max values are the ones seen by the
+// clients. A configured value beyond the max of the id type is out of range, the max of the id type is used.
+func (f *ExhaustionForecaster) maxValue(serviceName string, idType string) (result int64, inRange bool) {
+	maxValue, ok := f.config.MaxValues[serviceName]
+	if idType == entity.ID_TYPE_UINT64 {
+		if !ok {
+			return entity.FromUint64(math.MaxUint64), true
+		}
+		return entity.FromUint64(maxValue), true
+	} else if !ok {
+		return math.MaxInt64, true
+	} else if maxValue > math.MaxInt64 {
+		return math.MaxInt64, false
+	}
+	return int64(maxValue), true
+}
+
+// Check: export the forecasts, and log a warning when a service falls below a threshold, an error at the last one
+func (f *ExhaustionForecaster) Check(ctx context.Context) {
+	f.Lock()
+	defer f.Unlock()
+	now := time.Now()
+	serviceNames := make(map[string]bool, len(f.samples)+len(f.levels))
+	for serviceName := range f.samples {
+		serviceNames[serviceName] = true
+	}
+	for serviceName := range f.levels {
+		serviceNames[serviceName] = true
+	}
+
+	for serviceName := range serviceNames {
+		forecast := f.forecastLocked(serviceName, now)
+		if forecast != nil && forecast.MaxValueOutOfRange {
+			log.WithContext(ctx).Errorw("ExhaustionMaxValueOutOfRange", "serviceName", serviceName, "idType",
+				entity.NormalizeIdType(forecast.MaxValue.IdType), "maxValue", f.config.MaxValues[serviceName])
+		}
+		if forecast == nil || forecast.SecondsToExhaustion < 0 {
+			f.metrics.ForgetExhaustionForecast(serviceName)
+			delete(f.levels, serviceName)
+			continue
+		}
+		f.metrics.SetExhaustionForecast(serviceName, forecast.SecondsToExhaustion)
+
+		lastLevel := f.levels[serviceName]
+		f.levels[serviceName] = forecast.Level
+		if forecast.Level > lastLevel {
+			threshold := f.config.WarnThresholds[forecast.Level-1]
+			logger := log.WithContext(ctx).Warnw
+			if forecast.Level == len(f.config.WarnThresholds) {
+				logger = log.WithContext(ctx).Errorw
+			}
+			logger("ServiceNearExhaustion", "serviceName", serviceName, "threshold", threshold.String(), "forecast", forecast)
+		} else if forecast.Level == 0 && lastLevel > 0 {
+			log.WithContext(ctx).Infow("ServiceNoLongerNearExhaustion", "serviceName", serviceName, "forecast", forecast)
+		}
+	}
+}
+
+// startExhaustionForecaster: called by Start if the check interval is set
+func (r *RedisAllocHandler) startExhaustionForecaster(interval time.Duration) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				r.forecaster.Check(ctxInfra.WithTraceId(r.ctx, "ExhaustionForecast"))
+			}
+		}
+	}()
+}
+
+// ExhaustionForecast: nil if the service has not enough increments seen by this instance
+func (r *RedisAllocHandler) ExhaustionForecast(serviceName string) *ExhaustionForecast {
+	return r.forecaster.Forecast(serviceName)
+}
+
+func (a *AllocHandler) ExhaustionForecast(serviceName string) *ExhaustionForecast {
+	return a.redisAllocHandler.ExhaustionForecast(serviceName)
+}
@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemon-coder/idalloc/repository"
+)
+
+const (
+	HEALTH_CHECK_TIMEOUT = 1 * time.Second
+	// SYNC_QUEUE_SATURATION_RATIO: the sync queue is saturated when it is filled beyond this ratio,
+	// allocs from redis block once it is full
+	SYNC_QUEUE_SATURATION_RATIO = 0.8
+)
+
+type HealthChecker struct {
+	store             *repository.Store
+	allocHandler      *AllocHandler
+	redisAllocHandler *RedisAllocHandler
+	shuttingDown      atomic.Bool
+}
+
+type HealthStatus struct {
+	ShuttingDown bool                      `json:"shuttingDown"`
+	Warmup       WarmupStatus              `json:"warmup"`
+	WarmedUp     bool                      `json:"warmedUp"`
+	Redis        DependencyStatus          `json:"redis"`
+	DB           DependencyStatus          `json:"db"`
+	SyncQueue    SyncQueueStatus           `json:"syncQueue"`
+	Prefetch     map[string]PrefetchStatus `json:"prefetch"`
+	// JournalBroken: the last append to the segment journal failed, the fetches from redis back off
+	JournalBroken bool `json:"journalBroken"`
+}
+
+type DependencyStatus struct {
+	Reachable bool          `json:"reachable"`
+	Latency   time.Duration `json:"latency"`
+	Err       string        `json:"err"`
+}
+
+type SyncQueueStatus struct {
+	Len       int  `json:"len"`
+	Cap       int  `json:"cap"`
+	Saturated bool `json:"saturated"`
+}
+
+func NewHealthChecker(store *repository.Store, allocHandler *AllocHandler, redisAllocHandler *RedisAllocHandler) *HealthChecker {
+	return &HealthChecker{
+		store:             store,
+		allocHandler:      allocHandler,
+		redisAllocHandler: redisAllocHandler,
+	}
+}
+
+// MarkShuttingDown: the instance reports not ready from now on
+func (h *HealthChecker) MarkShuttingDown() {
+	h.shuttingDown.Store(true)
+}
+
+func (h *HealthChecker) IsShuttingDown() bool {
+	return h.shuttingDown.Load()
+}
+
+func (h *HealthChecker) Check(ctx context.Context) *HealthStatus {
+	result := &HealthStatus{
+		ShuttingDown:  h.IsShuttingDown(),
+		Warmup:        h.allocHandler.GetWarmupStatus(),
+		WarmedUp:      h.allocHandler.IsReady(),
+		Redis:         checkDependency(ctx, h.store.RedisPing),
+		DB:            checkDependency(ctx, h.store.DBPing),
+		SyncQueue:     h.redisAllocHandler.GetSyncQueueStatus(),
+		Prefetch:      make(map[string]PrefetchStatus),
+		JournalBroken: h.redisAllocHandler.IsJournalBroken(),
+	}
+	for _, serviceName := range h.allocHandler.LoadedServiceNames() {
+		handler := h.allocHandler.GetLoadedServiceAllocHandler(serviceName)
+		if handler != nil {
+			result.Prefetch[serviceName] = handler.GetPrefetchStatus()
+		}
+	}
+	return result
+}
+
+// Ready: the db is only used for backups and the prefetch failures of single services are tolerated,
+// so they do not make the instance unready. A broken journal does, since no segment is handed out without it.
+func (s *HealthStatus) Ready() bool {
+	return !s.ShuttingDown && s.WarmedUp && s.Redis.Reachable && !s.SyncQueue.Saturated && !s.JournalBroken
+}
+
+func checkDependency(ctx context.Context, ping func(ctx context.Context, timeout time.Duration) error) (result DependencyStatus) {
+	start := time.Now()
+	err := ping(ctx, HEALTH_CHECK_TIMEOUT)
+	result.Latency = time.Since(start)
+	result.Reachable = err == nil
+	if err != nil {
+		result.Err = err.Error()
+	}
+	return
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const METRICS_NAMESPACE = "idalloc"
+
+// Metrics: the business metrics of the allocation internals.
+// Per-service latency is not recorded to keep the cardinality low.
+// A nil *Metrics records nothing, for the embedders not using prometheus.
+type Metrics struct {
+	registerer          prometheus.Registerer
+	constLabels         prometheus.Labels
+	allocatedIds        *prometheus.CounterVec
+	segmentFetches      *prometheus.CounterVec
+	segmentFetchLatency prometheus.Histogram
+	prefetchWaitLatency prometheus.Histogram
+	serviceBusy         *prometheus.CounterVec
+	dbWriteFailures     prometheus.Counter
+	redisRecoveries     *prometheus.CounterVec
+	segmentRemaining    *prometheus.GaugeVec
+	consistencyIssues   *prometheus.GaugeVec
+	consistencyRepairs  *prometheus.CounterVec
+	journalFailures     prometheus.Counter
+	ledgerRecords       *prometheus.CounterVec
+	wastedIds           *prometheus.CounterVec
+	exhaustionForecasts *prometheus.GaugeVec
+}
+
+func NewMetrics(registerer prometheus.Registerer, appName string) *Metrics {
+	constLabels := prometheus.Labels{"app": appName}
+	m := &Metrics{
+		registerer:  registerer,
+		constLabels: constLabels,
+		allocatedIds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "allocated_ids_total",
+			Help:        "How many ids are allocated to the clients, partitioned by service.",
+			ConstLabels: constLabels,
+		}, []string{"service"}),
+		segmentFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "redis_segment_fetches_total",
+			Help:        "How many segments are fetched from redis, partitioned by service and result.",
+			ConstLabels: constLabels,
+		}, []string{"service", "result"}),
+		segmentFetchLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "redis_segment_fetch_duration_seconds",
+			Help:        "How long it took to fetch a segment from redis.",
+			ConstLabels: constLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}),
+		prefetchWaitLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "prefetch_wait_duration_seconds",
+			Help:        "How long an alloc waited for the prefetched segment when the current one is exhausted.",
+			ConstLabels: constLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+		serviceBusy: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "service_busy_total",
+			Help:        "How many allocs timed out waiting for the prefetched segment, partitioned by service.",
+			ConstLabels: constLabels,
+		}, []string{"service"}),
+		dbWriteFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "db_write_failures_total",
+			Help:        "How many times syncing redis to the db failed.",
+			ConstLabels: constLabels,
+		}),
+		redisRecoveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "redis_recoveries_total",
+			Help:        "How many services are checked by RecoverRedisFromDB, partitioned by whether redis was behind the db and overwritten.",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		segmentRemaining: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "segment_remaining_ids",
+			Help:        "How many ids remain in the current segment, partitioned by service.",
+			ConstLabels: constLabels,
+		}, []string{"service"}),
+		consistencyIssues: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "consistency_issues",
+			Help:        "How many problems the last consistency check found, partitioned by kind.",
+			ConstLabels: constLabels,
+		}, []string{"kind"}),
+		consistencyRepairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "consistency_repairs_total",
+			Help:        "How many problems found by the consistency checks are repaired, partitioned by result.",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		journalFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "segment_journal_write_failures_total",
+			Help:        "How many segments failed to be written to the segment journal, their ids are not handed out.",
+			ConstLabels: constLabels,
+		}),
+		ledgerRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "ledger_records_total",
+			Help:        "How many segments are recorded in the ledger, partitioned by result: written, failed or dropped as the queue stays full.",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		wastedIds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "wasted_ids_total",
+			Help:        "How many ids are fetched from redis but never handed out, partitioned by service and reason.",
+			ConstLabels: constLabels,
+		}, []string{"service", "reason"}),
+		exhaustionForecasts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   METRICS_NAMESPACE,
+			Name:        "exhaustion_forecast_seconds",
+			Help:        "How long until the counter reaches its max value at the current rate, partitioned by service. Absent if the counter is not moving.",
+			ConstLabels: constLabels,
+		}, []string{"service"}),
+	}
+	registerer.MustRegister(
+		m.allocatedIds,
+		m.segmentFetches,
+		m.segmentFetchLatency,
+		m.prefetchWaitLatency,
+		m.serviceBusy,
+		m.dbWriteFailures,
+		m.redisRecoveries,
+		m.segmentRemaining,
+		m.consistencyIssues,
+		m.consistencyRepairs,
+		m.journalFailures,
+		m.ledgerRecords,
+		m.wastedIds,
+		m.exhaustionForecasts,
+	)
+	return m
+}
+
+// watchSyncQueue: export the queue length of the handler, called once by NewRedisAllocHandler
+func (m *Metrics) watchSyncQueue(handler *RedisAllocHandler) {
+	if m == nil {
+		return
+	}
+	m.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   METRICS_NAMESPACE,
+		Name:        "sync_queue_length",
+		Help:        "How many alloc infos are waiting in SyncRedisAndDBChan.",
+		ConstLabels: m.constLabels,
+	}, func() float64 {
+		return float64(len(handler.SyncRedisAndDBChan))
+	}))
+}
+
+func (m *Metrics) ObserveAlloc(serviceName string, count int, allocResult *AllocResult) {
+	if m == nil {
+		return
+	}
+	m.allocatedIds.WithLabelValues(serviceName).Add(float64(count))
+	m.segmentRemaining.WithLabelValues(serviceName).Set(float64(allocResult.MaxValue - allocResult.LastAllocValue))
+}
+
+func (m *Metrics) ObserveSegmentFetch(serviceName string, success bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !success {
+		result = "failure"
+	}
+	m.segmentFetches.WithLabelValues(serviceName, result).Inc()
+	m.segmentFetchLatency.Observe(latency.Seconds())
+}
+
+func (m *Metrics) ObservePrefetchWait(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.prefetchWaitLatency.Observe(latency.Seconds())
+}
+
+func (m *Metrics) IncServiceBusy(serviceName string) {
+	if m == nil {
+		return
+	}
+	m.serviceBusy.WithLabelValues(serviceName).Inc()
+}
+
+func (m *Metrics) IncDBWriteFailure() {
+	if m == nil {
+		return
+	}
+	m.dbWriteFailures.Inc()
+}
+
+func (m *Metrics) IncSegmentJournalWriteFailure() {
+	if m == nil {
+		return
+	}
+	m.journalFailures.Inc()
+}
+
+// IncLedgerRecord: the result is LEDGER_RESULT_FAILED if err is not nil
+func (m *Metrics) IncLedgerRecord(result string, err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		result = LEDGER_RESULT_FAILED
+	}
+	m.ledgerRecords.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) AddWastedIds(serviceName string, reason string, count int64) {
+	if m == nil {
+		return
+	}
+	m.wastedIds.WithLabelValues(serviceName, reason).Add(float64(count))
+}
+
+func (m *Metrics) SetExhaustionForecast(serviceName string, seconds float64) {
+	if m == nil {
+		return
+	}
+	m.exhaustionForecasts.WithLabelValues(serviceName).Set(seconds)
+}
+
+func (m *Metrics) ForgetExhaustionForecast(serviceName string) {
+	if m == nil {
+		return
+	}
+	m.exhaustionForecasts.DeleteLabelValues(serviceName)
+}
+
+func (m *Metrics) IncRedisRecovery(recovered bool) {
+	if m == nil {
+		return
+	}
+	result := "skipped"
+	if recovered {
+		result = "recovered"
+	}
+	m.redisRecoveries.WithLabelValues(result).Inc()
+}
+
+// ObserveConsistencyCheck: the kinds not found by the check are reset to 0
+func (m *Metrics) ObserveConsistencyCheck(report *ConsistencyReport) {
+	if m == nil {
+		return
+	}
+	counts := make(map[string]int)
+	for _, kind := range CONSISTENCY_ISSUE_KINDS {
+		counts[kind] = 0
+	}
+	for _, issue := range report.Issues {
+		counts[issue.Kind]++
+	}
+	for kind, count := range counts {
+		m.consistencyIssues.WithLabelValues(kind).Set(float64(count))
+	}
+}
+
+func (m *Metrics) IncConsistencyRepair(repaired bool) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if repaired {
+		result = "success"
+	}
+	m.consistencyRepairs.WithLabelValues(result).Inc()
+}
+
+// ForgetService: drop the per-service gauges of a handler that is no longer loaded
+func (m *Metrics) ForgetService(serviceName string) {
+	if m == nil {
+		return
+	}
+	m.segmentRemaining.DeleteLabelValues(serviceName)
+}
@@ -2,22 +2,59 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	def "github.com/daemon-coder/idalloc/definition"
 	"github.com/daemon-coder/idalloc/definition/entity"
-	"github.com/daemon-coder/idalloc/definition/errors"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
-	threadLocal "github.com/daemon-coder/idalloc/infrastructure/threadlocal_infra"
 	"github.com/daemon-coder/idalloc/repository"
 )
 
+const (
+	// SEGMENT_JOURNAL_OPERATOR: the operator in the audit logs of the counters raised to the segment journal
+	SEGMENT_JOURNAL_OPERATOR = "segment_journal"
+
+	// SEGMENT_JOURNAL_RETRY_*: the fetches from redis back off after a failure to append to the segment journal,
+	// since the segments fetched are wasted until the journal works again
+	SEGMENT_JOURNAL_RETRY_MIN_INTERVAL = 100 * time.Millisecond
+	SEGMENT_JOURNAL_RETRY_MAX_INTERVAL = 10 * time.Second
+
+	// LEDGER_RESULT_*: the results of the ledger records in the metrics
+	LEDGER_RESULT_WRITTEN = "written"
+	LEDGER_RESULT_FAILED  = "failed"
+	LEDGER_RESULT_DROPPED = "dropped"
+)
+
 type RedisAllocHandler struct {
-	SyncRedisAndDBChan        chan *entity.AllocInfo
-	redisToDBThreadNum        int
-	writeDBEveryNVersion      int64
-	recoverRedisEveryNVersion int64
+	store              *repository.Store
+	metrics            *Metrics
+	SyncRedisAndDBChan chan *entity.AllocInfo
+	redisToDBThreadNum int
+	// the settings below can be changed by a config reload
+	batchAllocNum             atomic.Int64
+	writeDBEveryNVersion      atomic.Int64
+	recoverRedisEveryNVersion atomic.Int64
+	// journal: nil if the segment journal is disabled
+	journal *repository.SegmentJournal
+	// journalBackoff: 0 unless the last append to the journal failed, then the next fetch waits until journalRetryAt
+	journalLock    sync.Mutex
+	journalBackoff time.Duration
+	journalRetryAt time.Time
+	// LedgerChan: the ledger records waiting to be written by the ledger writer, nil if the ledger is disabled
+	LedgerChan      chan *entity.LedgerRecord
+	instanceId      string
+	ledgerRetention time.Duration
+	waste           *WasteTracker
+	forecaster      *ExhaustionForecaster
+	// forecastCheckInterval: 0 if the forecasts are not checked periodically
+	forecastCheckInterval time.Duration
 
 	Stopped chan struct{}
 	wg      *sync.WaitGroup
@@ -25,115 +62,414 @@ type RedisAllocHandler struct {
 	cancel  context.CancelFunc
 }
 
-var DefaultRedisAllocHandler *RedisAllocHandler
-
-func InitRedisAllocHandler(config *def.Config) *RedisAllocHandler {
-	ctx, cancel := context.WithCancel(context.Background())
-	DefaultRedisAllocHandler = &RedisAllocHandler{
-		SyncRedisAndDBChan:        make(chan *entity.AllocInfo, config.SyncRedisAndDBChanSize),
-		redisToDBThreadNum:        config.SyncRedisAndDBThreadNum,
-		writeDBEveryNVersion:      config.WriteDBEveryNVersion,
-		recoverRedisEveryNVersion: config.RecoverRedisEveryNVersion,
-		Stopped:                   make(chan struct{}),
-		wg:                        &sync.WaitGroup{},
-		ctx:                       ctx,
-		cancel:                    cancel,
+// NewRedisAllocHandler: ctx carries the logger of the handler, metrics may be nil
+func NewRedisAllocHandler(ctx context.Context, config *def.Config, store *repository.Store, metrics *Metrics) *RedisAllocHandler {
+	ctx, cancel := context.WithCancel(ctx)
+	handler := &RedisAllocHandler{
+		store:              store,
+		metrics:            metrics,
+		SyncRedisAndDBChan: make(chan *entity.AllocInfo, config.SyncRedisAndDBChanSize),
+		redisToDBThreadNum: config.SyncRedisAndDBThreadNum,
+		waste:              NewWasteTracker(),
+		forecaster:         NewExhaustionForecaster(config.ExhaustionForecast, metrics),
+		Stopped:            make(chan struct{}),
+		wg:                 &sync.WaitGroup{},
+		ctx:                ctx,
+		cancel:             cancel,
 	}
-	return DefaultRedisAllocHandler
+	handler.SetBatchAllocNum(config.RedisBatchAllocNum)
+	handler.SetSyncEveryNVersion(config.WriteDBEveryNVersion, config.RecoverRedisEveryNVersion)
+	if config.SegmentJournal.Dir != "" {
+		handler.journal = repository.NewSegmentJournal(ctx, config.SegmentJournal)
+	}
+	if config.Ledger.Enable {
+		handler.LedgerChan = make(chan *entity.LedgerRecord, def.LEDGER_QUEUE_SIZE)
+		handler.instanceId = config.InstanceId
+		handler.ledgerRetention = config.Ledger.Retention
+	}
+	handler.forecastCheckInterval = config.ExhaustionForecast.CheckInterval
+	metrics.watchSyncQueue(handler)
+	return handler
+}
+
+// SetBatchAllocNum: the segments fetched afterwards have the new size, the ones held keep theirs
+func (r *RedisAllocHandler) SetBatchAllocNum(batchAllocNum int64) {
+	r.batchAllocNum.Store(batchAllocNum)
+}
+
+func (r *RedisAllocHandler) SetSyncEveryNVersion(writeDBEveryNVersion, recoverRedisEveryNVersion int64) {
+	r.writeDBEveryNVersion.Store(writeDBEveryNVersion)
+	r.recoverRedisEveryNVersion.Store(recoverRedisEveryNVersion)
 }
 
 func (r *RedisAllocHandler) Start() {
 	for i := 0; i < r.redisToDBThreadNum; i++ {
+		ctx := ctxInfra.WithTraceId(r.ctx, "SyncRedisAndDB-"+strconv.Itoa(i))
 		r.wg.Add(1)
-		go threadLocal.SetTraceIdWithCallBack("SyncRedisAndDB-"+strconv.Itoa(i), func() {
-			log.GetLogger().Info("Start")
-			defer log.GetLogger().Info("Stopped")
+		go func() {
+			log.WithContext(ctx).Info("Start")
+			defer log.WithContext(ctx).Info("Stopped")
 			defer r.wg.Done()
 
 			for {
 				select {
 				case <-r.ctx.Done():
+					// the queue is drained after the cancel, so the writes must not use the canceled ctx
 					for allocInfo := range r.SyncRedisAndDBChan {
-						r.SyncRedisAndDB(allocInfo)
+						r.SyncRedisAndDB(context.WithoutCancel(ctx), allocInfo)
 					}
 					return
 				case allocInfo := <-r.SyncRedisAndDBChan:
 					if allocInfo == nil {
 						continue
 					}
-					r.SyncRedisAndDB(allocInfo)
+					r.SyncRedisAndDB(ctx, allocInfo)
 				}
 			}
-		})
+		}()
+	}
+	if r.LedgerChan != nil {
+		r.startLedgerWriter()
+		if r.ledgerRetention > 0 {
+			r.startLedgerPruner()
+		}
+	}
+	if r.forecastCheckInterval > 0 {
+		r.startExhaustionForecaster(r.forecastCheckInterval)
+	}
+}
+
+// startLedgerWriter: the queue is drained on shutdown, so the records of the segments handed out are not lost
+func (r *RedisAllocHandler) startLedgerWriter() {
+	ctx := ctxInfra.WithTraceId(r.ctx, "LedgerWriter")
+	r.wg.Add(1)
+	go func() {
+		log.WithContext(ctx).Info("Start")
+		defer log.WithContext(ctx).Info("Stopped")
+		defer r.wg.Done()
+
+		// the writes must not use the canceled ctx while draining
+		ctx := context.WithoutCancel(ctx)
+		for record := range r.LedgerChan {
+			r.writeLedger(ctx, record)
+		}
+	}()
+}
+
+// startLedgerPruner: every instance prunes, the deletes are idempotent
+func (r *RedisAllocHandler) startLedgerPruner() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(def.LEDGER_PRUNE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				r.PruneLedger(ctxInfra.WithTraceId(r.ctx, "PruneLedger"))
+			}
+		}
+	}()
+}
+
+// PruneLedger: delete the ledger records older than the retention in batches
+func (r *RedisAllocHandler) PruneLedger(ctx context.Context) {
+	before := time.Now().Add(-r.ledgerRetention)
+	total := int64(0)
+	for ctx.Err() == nil {
+		deleted, err := r.store.DeleteLedgerRecordsFromDB(ctx, before)
+		if err != nil {
+			log.WithContext(ctx).Errorw("PruneLedgerFailed", "before", before, "deleted", total, "err", err)
+			return
+		}
+		total += deleted
+		if deleted < def.LEDGER_PRUNE_BATCH_SIZE {
+			break
+		}
+	}
+	log.WithContext(ctx).Infow("PruneLedger", "before", before, "deleted", total)
+}
+
+func (r *RedisAllocHandler) writeLedger(ctx context.Context, record *entity.LedgerRecord) {
+	err := r.store.InsertLedgerRecordToDB(ctx, record)
+	r.metrics.IncLedgerRecord(LEDGER_RESULT_WRITTEN, err)
+}
+
+// recordLedger: the fetch waits LEDGER_ENQUEUE_TIMEOUT at most if the queue is full, then the record is dropped
+func (r *RedisAllocHandler) recordLedger(ctx context.Context, serviceName string, result *AllocResult, dataVersion int64) {
+	record := &entity.LedgerRecord{
+		ServiceName: serviceName,
+		StartValue:  result.LastAllocValue + 1,
+		EndValue:    result.MaxValue,
+		InstanceId:  r.instanceId,
+		DataVersion: dataVersion,
+		CreateTime:  time.Now().UnixMilli(),
+		IdType:      result.IdType,
+	}
+	select {
+	case r.LedgerChan <- record:
+		return
+	default:
+	}
+	timer := time.NewTimer(def.LEDGER_ENQUEUE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case r.LedgerChan <- record:
+	case <-timer.C:
+		r.metrics.IncLedgerRecord(LEDGER_RESULT_DROPPED, nil)
+		log.WithContext(ctx).Warnw("LedgerRecordDropped", "record", record)
 	}
 }
 
 func (r *RedisAllocHandler) Shutdown() {
-	log.GetLogger().Info("RedisAllocHandlerShutdownStart")
+	log.WithContext(r.ctx).Info("RedisAllocHandlerShutdownStart")
 	close(r.SyncRedisAndDBChan)
+	if r.LedgerChan != nil {
+		close(r.LedgerChan)
+	}
 	r.cancel()
 	r.wg.Wait()
+	if r.journal != nil {
+		r.journal.Close()
+	}
+	// the report is gone with the process, so it is logged to quantify the gaps of the restarts
+	log.WithContext(r.ctx).Infow("WasteReport", "report", r.WasteReport())
 	close(r.Stopped)
-	log.GetLogger().Info("RedisAllocHandlerShutdownFinish")
+	log.WithContext(r.ctx).Info("RedisAllocHandlerShutdownFinish")
 }
 
-func (r *RedisAllocHandler) AllocWithoutPanic(serviceName string) (result *AllocResult, err error) {
-	defer errors.PanicRecover(func(recoverErr errors.BaseError) {
-		err = recoverErr
-	})
-	result = r.Alloc(serviceName)
-	return
+func (r *RedisAllocHandler) GetSyncQueueStatus() SyncQueueStatus {
+	queueLen, queueCap := len(r.SyncRedisAndDBChan), cap(r.SyncRedisAndDBChan)
+	return SyncQueueStatus{
+		Len:       queueLen,
+		Cap:       queueCap,
+		Saturated: float64(queueLen) >= float64(queueCap)*SYNC_QUEUE_SATURATION_RATIO,
+	}
 }
 
-func (r *RedisAllocHandler) Alloc(serviceName string) *AllocResult {
-	newAllocInfo := repository.RedisIncr(serviceName, def.RedisBatchAllocNum)
+// Alloc: fetch a segment of the id type, empty if it is not known yet, e.g. for a new handler
+func (r *RedisAllocHandler) Alloc(ctx context.Context, serviceName string, idType string) (*AllocResult, error) {
+	if err := r.checkJournal(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	batchAllocNum := r.batchAllocNum.Load()
+	newAllocInfo, err := r.incrCounter(ctx, serviceName, batchAllocNum, idType)
+	r.metrics.ObserveSegmentFetch(serviceName, err == nil, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	r.forecaster.Observe(serviceName, *newAllocInfo.LastAllocValue, newAllocInfo.IdType)
 	// Synchronize the data changes in Redis to the database every 10 times.
 	if r.NeedRecoverRedis(*newAllocInfo.DataVersion) || r.NeedWriteDB(*newAllocInfo.DataVersion) {
 		r.SyncRedisAndDBChan <- newAllocInfo
 	}
-	return &AllocResult{
-		LastAllocValue: *newAllocInfo.LastAllocValue - def.RedisBatchAllocNum,
+	result := &AllocResult{
+		LastAllocValue: *newAllocInfo.LastAllocValue - batchAllocNum,
 		MaxValue:       *newAllocInfo.LastAllocValue,
+		IdType:         newAllocInfo.IdType,
+		Epoch:          newAllocInfo.Epoch,
+	}
+	r.waste.AddFetched(serviceName, batchAllocNum)
+	// the segment is journaled before it is handed out, the ids of a segment failed to be journaled are wasted
+	if r.journal != nil {
+		err = r.journal.Append(serviceName, result.IdType, result.LastAllocValue, result.MaxValue, *newAllocInfo.DataVersion)
+		r.onJournalAppend(err)
+		if err != nil {
+			r.metrics.IncSegmentJournalWriteFailure()
+			log.WithContext(ctx).Errorw("AppendSegmentJournalFailed", "serviceName", serviceName, "allocResult", result, "err", err)
+			r.recordWaste(ctx, serviceName, WASTE_REASON_ABANDONED, batchAllocNum)
+			return nil, err
+		}
+	}
+	if r.LedgerChan != nil {
+		r.recordLedger(ctx, serviceName, result, *newAllocInfo.DataVersion)
+	}
+	return result, nil
+}
+
+// checkJournal: the fetches are refused during the backoff after a failure to append to the journal. One fetch is
+// let through when the backoff is over, the others wait for its result.
+func (r *RedisAllocHandler) checkJournal() error {
+	if r.journal == nil {
+		return nil
+	}
+	r.journalLock.Lock()
+	defer r.journalLock.Unlock()
+	if r.journalBackoff == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(r.journalRetryAt) {
+		return e.NewServerError(e.WithMsg("SegmentJournalBroken. retry after " + r.journalRetryAt.Sub(now).String()))
 	}
+	r.journalRetryAt = now.Add(r.journalBackoff)
+	return nil
 }
 
-func (r *RedisAllocHandler) SyncRedisAndDB(allocInfo *entity.AllocInfo) {
-	defer errors.PanicRecover(func(err errors.BaseError) {
-		log.GetLogger().Warnw("SaveToDBPanic", "err", err)
+func (r *RedisAllocHandler) onJournalAppend(err error) {
+	r.journalLock.Lock()
+	defer r.journalLock.Unlock()
+	if err == nil {
+		r.journalBackoff = 0
+		return
+	}
+	r.journalBackoff = min(max(r.journalBackoff*2, SEGMENT_JOURNAL_RETRY_MIN_INTERVAL), SEGMENT_JOURNAL_RETRY_MAX_INTERVAL)
+	r.journalRetryAt = time.Now().Add(r.journalBackoff)
+}
+
+// IsJournalBroken: whether the last append to the segment journal failed
+func (r *RedisAllocHandler) IsJournalBroken() bool {
+	r.journalLock.Lock()
+	defer r.journalLock.Unlock()
+	return r.journalBackoff > 0
+}
+
+// incrCounter: a counter missing in redis is recovered from the db before it is created, so that the counter of a
+// uint64 service is never recreated as an int64 one, and the one of an int64 service does not restart from 0
+func (r *RedisAllocHandler) incrCounter(ctx context.Context, serviceName string, increment int64, idType string) (*entity.AllocInfo, error) {
+	allocInfo, err := r.store.RedisIncr(ctx, serviceName, increment, idType)
+	if err != nil {
+		return nil, err
+	} else if allocInfo == nil {
+		if err = r.RecoverRedisFromDB(ctx, serviceName); err != nil {
+			return nil, err
+		}
+		// the db does not have it either if it is still missing, then it is a new service, which is int64
+		if allocInfo, err = r.store.RedisIncr(ctx, serviceName, increment, entity.NormalizeIdType(idType)); err != nil {
+			return nil, err
+		} else if allocInfo == nil {
+			msg := fmt.Sprintf("RedisAllocInfoMissing. the counter is lost in redis and the db. serviceName:%s idType:%s", serviceName, idType)
+			return nil, e.NewCriticalError(e.WithMsg(msg))
+		}
+	}
+	// redis does not increment the counter of another id type, it is checked again before the segment is handed out
+	if idType != "" && entity.NormalizeIdType(allocInfo.IdType) != entity.NormalizeIdType(idType) {
+		msg := fmt.Sprintf("RedisIdTypeMismatch. serviceName:%s idTypeInRedis:%s input:%s", serviceName, allocInfo.IdType, idType)
+		return nil, e.NewCriticalError(e.WithMsg(msg))
+	}
+	return allocInfo, nil
+}
+
+// OpenJournal: open the segment journal, and move the counter in redis above the max value journaled of every
+// service, in case redis and the db lost the recent data. It is called before serving, nothing is done if the
+// journal is disabled.
+func (r *RedisAllocHandler) OpenJournal(ctx context.Context) error {
+	if r.journal == nil {
+		return nil
+	}
+	checkpoints, err := r.journal.Open()
+	if err != nil {
+		return err
+	}
+	for _, checkpoint := range checkpoints {
+		if err = r.raiseToJournal(ctx, checkpoint.ServiceName, checkpoint.MaxValue, checkpoint.IdType); err != nil {
+			r.journal.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// raiseToJournal: the counter is created with the id type journaled if redis and the db both lost it
+func (r *RedisAllocHandler) raiseToJournal(ctx context.Context, serviceName string, maxValue int64, idType string) error {
+	// make sure redis is not behind the db before comparing
+	if err := r.RecoverRedisFromDB(ctx, serviceName); err != nil {
+		return err
+	}
+	current, err := r.store.RedisGet(ctx, serviceName)
+	if err != nil {
+		return err
+	} else if current != nil && entity.NormalizeIdType(current.IdType) != entity.NormalizeIdType(idType) {
+		// the values of different id types are not comparable, the counter keeps its own
+		log.WithContext(ctx).Errorw("SegmentJournalIdTypeMismatch", "serviceName", serviceName, "current", current, "journalIdType", idType)
+		return nil
+	} else if current != nil && *current.LastAllocValue >= maxValue {
+		return nil
+	}
+	applied, before, after, err := r.store.RedisAdvance(ctx, serviceName, maxValue, idType, false)
+	if err != nil || !applied {
+		return err
+	}
+	if err = r.WriteDB(ctx, after); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Warnw("RaiseCounterToJournal", "serviceName", serviceName, "before", before, "after", after)
+	// some of the ids skipped may have been handed out before the restart, so it is the upper bound of the gap
+	r.recordWaste(ctx, serviceName, WASTE_REASON_RECOVERY, *after.LastAllocValue-*before.LastAllocValue)
+	detail, _ := json.Marshal(map[string]interface{}{
+		"before":          before,
+		"after":           after,
+		"journalMaxValue": maxValue,
 	})
+	writeAuditLog(ctx, r.store, &entity.AuditLog{
+		ServiceName: serviceName,
+		Action:      entity.AUDIT_ACTION_RAISE_TO_JOURNAL,
+		Operator:    SEGMENT_JOURNAL_OPERATOR,
+		Detail:      string(detail),
+	})
+	return nil
+}
 
+// SyncRedisAndDB: runs in the sync goroutines, so the errors are only logged
+func (r *RedisAllocHandler) SyncRedisAndDB(ctx context.Context, allocInfo *entity.AllocInfo) {
 	if r.NeedRecoverRedis(*allocInfo.DataVersion) {
-		r.RecoverRedisFromDB(*allocInfo.ServiceName)
+		if err := r.RecoverRedisFromDB(ctx, *allocInfo.ServiceName); err != nil {
+			log.WithContext(ctx).Warnw("RecoverRedisFromDBFailed", "allocInfo", allocInfo, "err", err)
+		}
 	}
 
 	if r.NeedWriteDB(*allocInfo.DataVersion) {
-		repository.InsertOrUpdateAllocInfoToDB(allocInfo)
+		if err := r.WriteDB(ctx, allocInfo); err != nil {
+			log.WithContext(ctx).Warnw("SaveToDBFailed", "allocInfo", allocInfo, "err", err)
+		}
 	}
 }
 
-func (r *RedisAllocHandler) RecoverRedisFromDB(serviceNames ...string) {
+func (r *RedisAllocHandler) WriteDB(ctx context.Context, allocInfo *entity.AllocInfo) error {
+	err := r.store.InsertOrUpdateAllocInfoToDB(ctx, allocInfo)
+	if err != nil {
+		r.metrics.IncDBWriteFailure()
+	}
+	return err
+}
+
+func (r *RedisAllocHandler) RecoverRedisFromDB(ctx context.Context, serviceNames ...string) error {
 	var allocInfos []*entity.AllocInfo
+	var err error
 	if len(serviceNames) == 0 {
-		allocInfos = repository.GetAllFromDB()
+		allocInfos, err = r.store.GetAllFromDB(ctx)
 	} else {
-		allocInfos = repository.GetAllocInfoFromDB(serviceNames...)
+		allocInfos, err = r.store.GetAllocInfoFromDB(ctx, serviceNames...)
+	}
+	if err != nil {
+		return err
 	}
 	for _, allocInfo := range allocInfos {
-		repository.RedisCompareVersionAndSet(
+		_, _, updated, err := r.store.RedisCompareVersionAndSet(
+			ctx,
 			*allocInfo.ServiceName,
 			*allocInfo.LastAllocValue,
 			*allocInfo.DataVersion,
+			allocInfo.IdType,
 		)
+		if err != nil {
+			return err
+		}
+		r.metrics.IncRedisRecovery(updated)
 	}
+	return nil
 }
 
 // NeedRecoverRedis: Synchronize the data from Redis to the database, and perform sampling checks to ensure
 // that the Redis data version is not behind the database (to minimize the risk of data loss in Redis).
 func (r *RedisAllocHandler) NeedWriteDB(version int64) bool {
-	return version == 1 || version%r.writeDBEveryNVersion == 0
+	return version == 1 || version%r.writeDBEveryNVersion.Load() == 0
 }
 
 // NeedRecoverRedis: Synchronize the data from database to Redis
 func (r *RedisAllocHandler) NeedRecoverRedis(version int64) bool {
-	return version == 1 || version%r.recoverRedisEveryNVersion == 0
+	return version == 1 || version%r.recoverRedisEveryNVersion.Load() == 0
 }
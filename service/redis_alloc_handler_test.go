@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+	goRedis "github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// fakeRedis: keeps the int64 counters in memory and answers RedisIncrCmd, the other commands fail.
+// It is a hook of the client, so nothing is dialed.
+type fakeRedis struct {
+	sync.Mutex
+	values   map[string]int64
+	versions map[string]int64
+	epochs   map[string]int64
+	incrNum  int
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: make(map[string]int64), versions: make(map[string]int64), epochs: make(map[string]int64)}
+}
+
+// set: as the set scripts do, e.g. RedisAdvanceCmd
+func (f *fakeRedis) set(key string, value int64) {
+	f.Lock()
+	defer f.Unlock()
+	f.values[key] = value
+	f.versions[key]++
+	f.epochs[key]++
+}
+
+func (f *fakeRedis) client() *goRedis.Client {
+	client := goRedis.NewClient(&goRedis.Options{Addr: "fake:6379"})
+	client.AddHook(f)
+	return client
+}
+
+func (f *fakeRedis) incrCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.incrNum
+}
+
+func (f *fakeRedis) DialHook(next goRedis.DialHook) goRedis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, context.Canceled
+	}
+}
+
+func (f *fakeRedis) ProcessHook(next goRedis.ProcessHook) goRedis.ProcessHook {
+	return func(ctx context.Context, cmd goRedis.Cmder) error {
+		args := cmd.Args()
+		if len(args) < 10 || cmd.Name() != "evalsha" || args[1] != repository.RedisIncrCmd.Hash() {
+			cmd.SetErr(goRedis.Nil)
+			return goRedis.Nil
+		}
+		// evalsha sha 5 key valueField versionField idTypeField epochField increment idType
+		key, _ := args[3].(string)
+		increment, _ := args[8].(int64)
+		f.Lock()
+		defer f.Unlock()
+		f.incrNum++
+		f.values[key] += increment
+		f.versions[key]++
+		cmd.(*goRedis.Cmd).SetVal([]interface{}{int64(1), strconv.FormatInt(f.values[key], 10), f.versions[key], "", f.epochs[key]})
+		return nil
+	}
+}
+
+func (f *fakeRedis) ProcessPipelineHook(next goRedis.ProcessPipelineHook) goRedis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []goRedis.Cmder) error {
+		for _, cmd := range cmds {
+			cmd.SetErr(goRedis.Nil)
+		}
+		return goRedis.Nil
+	}
+}
+
+func newTestRedisAllocHandler(t *testing.T, redis *fakeRedis, journalDir string) *RedisAllocHandler {
+	t.Helper()
+	ctx := log.WithLogger(context.Background(), zap.NewNop())
+	config := &def.Config{
+		RedisBatchAllocNum:        100,
+		SyncRedisAndDBChanSize:    10,
+		WriteDBEveryNVersion:      1 << 30,
+		RecoverRedisEveryNVersion: 1 << 30,
+		SegmentJournal: def.SegmentJournal{
+			Dir:         journalDir,
+			MaxFileSize: 1 << 20,
+			MaxFileNum:  2,
+			FsyncPolicy: def.SEGMENT_JOURNAL_FSYNC_NEVER,
+		},
+	}
+	return NewRedisAllocHandler(ctx, config, repository.NewStore(redis.client(), nil, "test"), nil)
+}
+
+func TestRedisAllocHandlerJournalBroken(t *testing.T) {
+	ctx := log.WithLogger(context.Background(), zap.NewNop())
+	redis := newFakeRedis()
+	// the journal is not opened, so every append fails
+	handler := newTestRedisAllocHandler(t, redis, t.TempDir())
+
+	deadline := time.Now().Add(SEGMENT_JOURNAL_RETRY_MIN_INTERVAL*3 + SEGMENT_JOURNAL_RETRY_MIN_INTERVAL/2)
+	failedNum := 0
+	for time.Now().Before(deadline) {
+		if _, err := handler.Alloc(ctx, "order", entity.ID_TYPE_INT64); err == nil {
+			t.Fatal("Alloc: want an error while the journal is broken")
+		}
+		failedNum++
+	}
+	// the backoff doubles: the fetches at 0, 100ms and 300ms
+	if incrNum := redis.incrCount(); incrNum > 3 || failedNum <= incrNum {
+		t.Errorf("fetches while the journal is broken: got %d of %d allocs, want at most 3", incrNum, failedNum)
+	}
+	if !handler.IsJournalBroken() {
+		t.Error("IsJournalBroken: got false, want true")
+	}
+
+	// the first fetch after the backoff succeeds once the journal works again
+	if _, err := handler.journal.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer handler.journal.Close()
+	time.Sleep(SEGMENT_JOURNAL_RETRY_MIN_INTERVAL * 6)
+	incrNum := redis.incrCount()
+	result, err := handler.Alloc(ctx, "order", entity.ID_TYPE_INT64)
+	if err != nil {
+		t.Fatalf("Alloc: %v", err)
+	} else if result.MaxValue != int64(incrNum+1)*100 {
+		t.Errorf("MaxValue: got %d, want %d", result.MaxValue, (incrNum+1)*100)
+	}
+	if handler.IsJournalBroken() {
+		t.Error("IsJournalBroken: got true, want false")
+	}
+}
@@ -0,0 +1,346 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/daemon-coder/idalloc/repository"
+	"github.com/daemon-coder/idalloc/util"
+)
+
+// ServiceRegistry: an in-process cache of tbl_service_info.
+// It is reloaded periodically, and a single service is reloaded when its segments are invalidated.
+type ServiceRegistry struct {
+	sync.RWMutex
+	store *repository.Store
+	// allocHandler: set by NewAllocHandler, its handlers are dropped when a service is changed
+	allocHandler         *AllocHandler
+	services             map[string]*entity.ServiceInfo
+	rejectUnknownService bool
+	refreshInterval      time.Duration
+
+	Stopped chan struct{}
+	wg      *sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewServiceRegistry: ctx carries the logger of the registry
+func NewServiceRegistry(ctx context.Context, config *def.Config, store *repository.Store) *ServiceRegistry {
+	ctx, cancel := context.WithCancel(ctx)
+	return &ServiceRegistry{
+		store:                store,
+		services:             make(map[string]*entity.ServiceInfo),
+		rejectUnknownService: config.RejectUnknownService,
+		refreshInterval:      config.ServiceRegistryRefreshInterval,
+		Stopped:              make(chan struct{}),
+		wg:                   &sync.WaitGroup{},
+		ctx:                  ctx,
+		cancel:               cancel,
+	}
+}
+
+// Start: register the services created before the registry existed, and reload the registry periodically
+func (r *ServiceRegistry) Start() error {
+	startCtx := ctxInfra.WithTraceId(r.ctx, "ServiceRegistryStart")
+	if err := r.Reload(startCtx); err != nil {
+		return err
+	}
+	allocInfos, err := r.store.GetAllFromDB(startCtx)
+	if err != nil {
+		return err
+	}
+	for _, allocInfo := range allocInfos {
+		if r.Get(*allocInfo.ServiceName) == nil {
+			if _, err := r.register(startCtx, *allocInfo.ServiceName); err != nil {
+				return err
+			}
+		}
+	}
+
+	ctx := ctxInfra.WithTraceId(r.ctx, "ServiceRegistryRefresh")
+	r.wg.Add(1)
+	go func() {
+		log.WithContext(ctx).Info("Start")
+		defer log.WithContext(ctx).Info("Stopped")
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Reload(ctx); err != nil {
+					log.WithContext(ctx).Warnw("ReloadServiceRegistryFailed", "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *ServiceRegistry) Shutdown() {
+	log.WithContext(r.ctx).Info("ServiceRegistryShutdownStart")
+	r.cancel()
+	r.wg.Wait()
+	close(r.Stopped)
+	log.WithContext(r.ctx).Info("ServiceRegistryShutdownFinish")
+}
+
+func (r *ServiceRegistry) Reload(ctx context.Context) error {
+	serviceInfos, err := r.store.GetAllServiceInfoFromDB(ctx)
+	if err != nil {
+		return err
+	}
+	services := make(map[string]*entity.ServiceInfo)
+	for _, serviceInfo := range serviceInfos {
+		services[serviceInfo.ServiceName] = serviceInfo
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.services = services
+	return nil
+}
+
+func (r *ServiceRegistry) ReloadService(ctx context.Context, serviceName string) error {
+	serviceInfo, err := r.store.GetServiceInfoFromDB(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if serviceInfo == nil {
+		delete(r.services, serviceName)
+	} else {
+		r.services[serviceName] = serviceInfo
+	}
+	return nil
+}
+
+// Get: returns nil if the service is unknown
+func (r *ServiceRegistry) Get(serviceName string) *entity.ServiceInfo {
+	r.RLock()
+	defer r.RUnlock()
+	serviceInfo, ok := r.services[serviceName]
+	if !ok {
+		return nil
+	}
+	result := *serviceInfo
+	return &result
+}
+
+func (r *ServiceRegistry) List() []*entity.ServiceInfo {
+	r.RLock()
+	defer r.RUnlock()
+	result := make([]*entity.ServiceInfo, 0, len(r.services))
+	for _, serviceInfo := range r.services {
+		info := *serviceInfo
+		result = append(result, &info)
+	}
+	return result
+}
+
+func (r *ServiceRegistry) IsActive(serviceName string) bool {
+	serviceInfo := r.Get(serviceName)
+	return serviceInfo != nil && serviceInfo.Status == entity.SERVICE_STATUS_ACTIVE
+}
+
+// CheckAllocatable: returns an error if ids of the service can not be allocated.
+// Unknown services are registered here unless rejectUnknownService is set.
+func (r *ServiceRegistry) CheckAllocatable(ctx context.Context, serviceName string) error {
+	serviceInfo, err := r.Ensure(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	switch serviceInfo.Status {
+	case entity.SERVICE_STATUS_ACTIVE:
+		return nil
+	case entity.SERVICE_STATUS_FROZEN:
+		return e.NewForbiddenError(e.WithMsg("service is frozen. service_name: " + serviceName))
+	default:
+		return e.NewForbiddenError(e.WithMsg("service is retired. service_name: " + serviceName))
+	}
+}
+
+// Ensure: get the service, register it if it is unknown and rejectUnknownService is not set
+func (r *ServiceRegistry) Ensure(ctx context.Context, serviceName string) (*entity.ServiceInfo, error) {
+	if serviceInfo := r.Get(serviceName); serviceInfo != nil {
+		return serviceInfo, nil
+	}
+	if r.rejectUnknownService {
+		return nil, e.NewNotFoundError(e.WithMsg("service not found. service_name: " + serviceName))
+	}
+	return r.register(ctx, serviceName)
+}
+
+// register: insert the service as active, or load it if it has been inserted by others
+func (r *ServiceRegistry) register(ctx context.Context, serviceName string) (*entity.ServiceInfo, error) {
+	serviceInfo := &entity.ServiceInfo{
+		ServiceName: serviceName,
+		Status:      entity.SERVICE_STATUS_ACTIVE,
+	}
+	inserted, err := r.store.InsertServiceInfoToDB(ctx, serviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !inserted {
+		serviceInfo, err = r.store.GetServiceInfoFromDB(ctx, serviceName)
+		if err != nil {
+			return nil, err
+		} else if serviceInfo == nil {
+			return nil, e.NewServerError(e.WithMsg("service is deleted concurrently. service_name: " + serviceName))
+		}
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.services[serviceName] = serviceInfo
+	result := *serviceInfo
+	return &result, nil
+}
+
+// ImportService: register the service with the status if it is unknown, the status of a known service is kept
+func (r *ServiceRegistry) ImportService(ctx context.Context, serviceName, status string) (created bool, err error) {
+	created, err = r.store.InsertServiceInfoToDB(ctx, &entity.ServiceInfo{ServiceName: serviceName, Status: status})
+	if err != nil || !created {
+		return false, err
+	}
+	r.notifyServiceChanged(ctx, serviceName)
+	return true, nil
+}
+
+// CreateService: register a new active service, a retired service name can not be reused.
+// The counter of a service of another id type than ID_TYPE_INT64 is created with it, since the counters created by
+// the allocs are int64, and the id type of an existing counter can not be changed.
+func (r *ServiceRegistry) CreateService(ctx context.Context, serviceName, idType, operator, reason string) (*entity.ServiceInfo, error) {
+	serviceInfo := &entity.ServiceInfo{
+		ServiceName: serviceName,
+		Status:      entity.SERVICE_STATUS_ACTIVE,
+	}
+	if entity.NormalizeIdType(idType) != entity.ID_TYPE_INT64 {
+		existing, err := r.store.GetServiceInfoFromDB(ctx, serviceName)
+		if err != nil {
+			return nil, err
+		} else if existing != nil {
+			return nil, e.NewParamError(e.WithMsg("service already exists. service_name: " + serviceName))
+		}
+		if err = r.createCounter(ctx, serviceName, idType); err != nil {
+			return nil, err
+		}
+	}
+	inserted, err := r.store.InsertServiceInfoToDB(ctx, serviceInfo)
+	if err != nil {
+		return nil, err
+	} else if !inserted {
+		return nil, e.NewParamError(e.WithMsg("service already exists. service_name: " + serviceName))
+	}
+	r.notifyServiceChanged(ctx, serviceName)
+	r.writeServiceAuditLog(ctx, serviceName, entity.AUDIT_ACTION_CREATE_SERVICE, operator, reason, "", entity.SERVICE_STATUS_ACTIVE)
+	return serviceInfo, nil
+}
+
+// createCounter: the counter starts from 0 of the id type, in the db and then in redis
+func (r *ServiceRegistry) createCounter(ctx context.Context, serviceName, idType string) error {
+	dbAllocInfo, err := r.store.GetServiceAllocInfoFromDB(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	redisAllocInfo, err := r.store.RedisGet(ctx, serviceName)
+	if err != nil {
+		return err
+	}
+	if dbAllocInfo != nil || redisAllocInfo != nil {
+		return e.NewParamError(e.WithMsg("the counter of the service exists, its id type can not be changed. service_name: " + serviceName))
+	}
+	allocInfo := &entity.AllocInfo{
+		ServiceName:    &serviceName,
+		LastAllocValue: util.Ptr(entity.ZeroValue(idType)),
+		DataVersion:    util.Ptr(int64(0)),
+		IdType:         idType,
+	}
+	if err = r.store.InsertAllocInfoToDB(ctx, allocInfo); err != nil {
+		return err
+	}
+	if _, _, _, err = r.store.RedisCompareVersionAndSet(ctx, serviceName, *allocInfo.LastAllocValue, *allocInfo.DataVersion, idType); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infow("CreateCounter", "allocInfo", allocInfo)
+	return nil
+}
+
+func (r *ServiceRegistry) FreezeService(ctx context.Context, serviceName, operator, reason string) (*entity.ServiceInfo, error) {
+	return r.changeStatus(ctx, serviceName, entity.SERVICE_STATUS_FROZEN, entity.AUDIT_ACTION_FREEZE_SERVICE, operator, reason, entity.SERVICE_STATUS_ACTIVE)
+}
+
+func (r *ServiceRegistry) ActivateService(ctx context.Context, serviceName, operator, reason string) (*entity.ServiceInfo, error) {
+	return r.changeStatus(ctx, serviceName, entity.SERVICE_STATUS_ACTIVE, entity.AUDIT_ACTION_ACTIVATE_SERVICE, operator, reason, entity.SERVICE_STATUS_FROZEN)
+}
+
+func (r *ServiceRegistry) RetireService(ctx context.Context, serviceName, operator, reason string) (*entity.ServiceInfo, error) {
+	return r.changeStatus(ctx, serviceName, entity.SERVICE_STATUS_RETIRED, entity.AUDIT_ACTION_RETIRE_SERVICE, operator, reason, entity.SERVICE_STATUS_ACTIVE, entity.SERVICE_STATUS_FROZEN)
+}
+
+// changeStatus: change the status in db, then drop the handlers of the service on all instances,
+// so that the handlers are torn down and the registry of every instance is reloaded.
+func (r *ServiceRegistry) changeStatus(ctx context.Context, serviceName, toStatus, action, operator, reason string, fromStatuses ...string) (*entity.ServiceInfo, error) {
+	serviceInfo, err := r.store.GetServiceInfoFromDB(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	} else if serviceInfo == nil {
+		return nil, e.NewNotFoundError(e.WithMsg("service not found. service_name: " + serviceName))
+	}
+	fromStatus := serviceInfo.Status
+	allowed := false
+	for _, status := range fromStatuses {
+		allowed = allowed || status == fromStatus
+	}
+	if !allowed {
+		return nil, e.NewParamError(e.WithMsg("service status can not be changed from " + fromStatus + " to " + toStatus))
+	}
+	updated, err := r.store.UpdateServiceStatusToDB(ctx, serviceName, fromStatus, toStatus)
+	if err != nil {
+		return nil, err
+	} else if !updated {
+		return nil, e.NewBusinessError(e.WithMsg("service status is changed concurrently. service_name: " + serviceName))
+	}
+
+	r.notifyServiceChanged(ctx, serviceName)
+	r.writeServiceAuditLog(ctx, serviceName, action, operator, reason, fromStatus, toStatus)
+
+	serviceInfo.Status = toStatus
+	return serviceInfo, nil
+}
+
+// notifyServiceChanged: reload the service and drop its handlers on all instances.
+// The change has been saved in db, so the failures here are only logged and the registries catch up within refreshInterval.
+func (r *ServiceRegistry) notifyServiceChanged(ctx context.Context, serviceName string) {
+	if err := r.ReloadService(ctx, serviceName); err != nil {
+		log.WithContext(ctx).Warnw("ReloadServiceFailed", "serviceName", serviceName, "err", err)
+	}
+	r.allocHandler.InvalidateServiceAllocHandler(ctx, serviceName)
+	if err := r.store.RedisPublishInvalidateSegment(ctx, serviceName); err != nil {
+		log.WithContext(ctx).Warnw("PublishInvalidateSegmentFailed", "serviceName", serviceName, "err", err)
+	}
+}
+
+func (r *ServiceRegistry) writeServiceAuditLog(ctx context.Context, serviceName, action, operator, reason, fromStatus, toStatus string) {
+	detail, _ := json.Marshal(map[string]interface{}{
+		"fromStatus": fromStatus,
+		"toStatus":   toStatus,
+		"reason":     reason,
+	})
+	writeAuditLog(ctx, r.store, &entity.AuditLog{
+		ServiceName: serviceName,
+		Action:      action,
+		Operator:    operator,
+		Detail:      string(detail),
+	})
+}
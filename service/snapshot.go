@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/daemon-coder/idalloc/definition/entity"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+const (
+	SNAPSHOT_IMPORTED = "imported"
+	// SNAPSHOT_SKIPPED: the counter here is not behind the snapshot, nothing is changed
+	SNAPSHOT_SKIPPED = "skipped"
+	SNAPSHOT_FAILED  = "failed"
+)
+
+type SnapshotImportResult struct {
+	ServiceName string `json:"serviceName"`
+	Result      string `json:"result"`
+	Msg         string `json:"msg"`
+	// ServiceCreated: the service was unknown and has been registered with the status in the snapshot
+	ServiceCreated bool              `json:"serviceCreated"`
+	Before         *entity.AllocInfo `json:"before"`
+	After          *entity.AllocInfo `json:"after"`
+}
+
+// ExportSnapshot: the counters of all the services in the db or in redis, with the status of the services.
+// The db is read before redis and the higher version is exported, so every counter exported is not below
+// the one when the export started. The allocs during the export may be in the snapshot or not.
+func (a *AllocHandler) ExportSnapshot(ctx context.Context) (*entity.Snapshot, error) {
+	snapshot := &entity.Snapshot{
+		FormatVersion: entity.SNAPSHOT_FORMAT_VERSION,
+		ExportedAt:    time.Now().UnixMilli(),
+		Services:      make([]*entity.SnapshotService, 0),
+	}
+	serviceInfos, err := a.store.GetAllServiceInfoFromDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dbAllocInfos, err := a.store.GetAllFromDB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	redisServiceNames, err := a.store.RedisScanAllocInfoServiceNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statusMap := make(map[string]string, len(serviceInfos))
+	serviceNameSet := make(map[string]struct{})
+	for _, serviceInfo := range serviceInfos {
+		statusMap[serviceInfo.ServiceName] = serviceInfo.Status
+		serviceNameSet[serviceInfo.ServiceName] = struct{}{}
+	}
+	dbAllocInfoMap := make(map[string]*entity.AllocInfo, len(dbAllocInfos))
+	for _, allocInfo := range dbAllocInfos {
+		dbAllocInfoMap[*allocInfo.ServiceName] = allocInfo
+		serviceNameSet[*allocInfo.ServiceName] = struct{}{}
+	}
+	for _, serviceName := range redisServiceNames {
+		serviceNameSet[serviceName] = struct{}{}
+	}
+	sortedServiceNames := make([]string, 0, len(serviceNameSet))
+	for serviceName := range serviceNameSet {
+		sortedServiceNames = append(sortedServiceNames, serviceName)
+	}
+	sort.Strings(sortedServiceNames)
+
+	for _, serviceName := range sortedServiceNames {
+		// a dirty counter is not exported from the db silently, it may be far behind. Repair it and export again.
+		redisAllocInfo, err := a.store.RedisGet(ctx, serviceName)
+		if err != nil {
+			return nil, err
+		}
+		item := &entity.SnapshotService{ServiceName: serviceName, Status: statusMap[serviceName]}
+		allocInfo := dbAllocInfoMap[serviceName]
+		if redisAllocInfo != nil && (allocInfo == nil || *redisAllocInfo.DataVersion >= *allocInfo.DataVersion) {
+			allocInfo = redisAllocInfo
+		}
+		if allocInfo != nil {
+			item.LastAllocValue = *allocInfo.LastAllocValue
+			item.DataVersion = *allocInfo.DataVersion
+			item.IdType = allocInfo.IdType
+		}
+		snapshot.Services = append(snapshot.Services, item)
+	}
+	log.WithContext(ctx).Infow("ExportSnapshot", "serviceNum", len(snapshot.Services))
+	return snapshot, nil
+}
+
+// ImportSnapshot: the counters are only moved forward. A counter is set if it is missing or dirty here, or if both
+// its dataVersion and lastAllocValue are behind the snapshot, see RedisMoveForward. The unknown services are
+// registered with the status in the snapshot, the status of the known services is kept.
+// The snapshot is checked by the caller, a failure of a service does not stop the others.
+func (a *AllocHandler) ImportSnapshot(ctx context.Context, snapshot *entity.Snapshot, operator, reason string) []*SnapshotImportResult {
+	results := make([]*SnapshotImportResult, 0, len(snapshot.Services))
+	for _, item := range snapshot.Services {
+		result := a.importSnapshotService(ctx, item, operator, reason)
+		if result.Result == SNAPSHOT_FAILED {
+			log.WithContext(ctx).Errorw("ImportSnapshotServiceFailed", "item", item, "result", result)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (a *AllocHandler) importSnapshotService(ctx context.Context, item *entity.SnapshotService, operator, reason string) *SnapshotImportResult {
+	result := &SnapshotImportResult{ServiceName: item.ServiceName, Result: SNAPSHOT_SKIPPED}
+	fail := func(err error) *SnapshotImportResult {
+		result.Result = SNAPSHOT_FAILED
+		result.Msg = e.FromStdError(err).Msg
+		return result
+	}
+
+	if item.Status != "" {
+		created, err := a.registry.ImportService(ctx, item.ServiceName, item.Status)
+		if err != nil {
+			return fail(err)
+		}
+		result.ServiceCreated = created
+	}
+	if item.LastAllocValue == entity.ZeroValue(item.IdType) && item.DataVersion == 0 {
+		result.Msg = "no counter in the snapshot"
+		return result
+	}
+	// make sure redis is not behind the db before comparing
+	if err := a.redisAllocHandler.RecoverRedisFromDB(ctx, item.ServiceName); err != nil {
+		return fail(err)
+	}
+	// before is nil if the counter in redis is dirty
+	result.Before, _ = a.store.RedisGet(ctx, item.ServiceName)
+	curLastAllocValue, curDataVersion, updated, err := a.store.RedisMoveForward(ctx, item.ServiceName, item.LastAllocValue, item.DataVersion, item.IdType)
+	if err != nil {
+		return fail(err)
+	}
+	result.After = &entity.AllocInfo{
+		ServiceName:    &item.ServiceName,
+		LastAllocValue: &curLastAllocValue,
+		DataVersion:    &curDataVersion,
+		IdType:         item.IdType,
+	}
+	if !updated {
+		result.Msg = "the counter is not behind the snapshot"
+		return result
+	}
+	result.Result = SNAPSHOT_IMPORTED
+
+	// redis has been changed, so the segments are invalidated and the audit log is written even if the db write fails
+	writeDBErr := a.store.InsertOrUpdateAllocInfoToDB(ctx, result.After)
+	a.InvalidateServiceAllocHandler(ctx, item.ServiceName)
+	if err := a.store.RedisPublishInvalidateSegment(ctx, item.ServiceName); err != nil {
+		log.WithContext(ctx).Errorw("PublishInvalidateSegmentFailed", "serviceName", item.ServiceName, "err", err)
+	}
+	detail, _ := json.Marshal(map[string]interface{}{
+		"before": result.Before,
+		"after":  result.After,
+		"reason": reason,
+	})
+	writeAuditLog(ctx, a.store, &entity.AuditLog{
+		ServiceName: item.ServiceName,
+		Action:      entity.AUDIT_ACTION_IMPORT_SNAPSHOT,
+		Operator:    operator,
+		Detail:      string(detail),
+	})
+	if writeDBErr != nil {
+		result.Msg = "redis is set but the db write failed: " + e.FromStdError(writeDBErr).Msg
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"github.com/daemon-coder/idalloc/definition/entity"
+)
+
+const (
+	// VERIFY_ISSUED: the id is in a segment recorded in the ledger
+	VERIFY_ISSUED = "issued"
+	// VERIFY_NOT_ISSUED: the id is above the counter, it has never been issued
+	VERIFY_NOT_ISSUED = "not_issued"
+	// VERIFY_UNKNOWN: the id is below the counter but not in the ledger, the ledger may have been disabled
+	// or pruned when it was issued, its record may have been dropped or failed to be written,
+	// or the id was skipped by a counter change
+	VERIFY_UNKNOWN = "unknown"
+)
+
+type VerifyResult struct {
+	// Id: in the process form of the id type of the service
+	Id     int64  `json:"id"`
+	Status string `json:"status"`
+	// Segment: the segment containing the id, only set if it is VERIFY_ISSUED
+	Segment *entity.LedgerRecord `json:"segment"`
+}
+
+// VerifyIds: whether the ids of the service have been issued, by the ledger and the counter. The ids are in the
+// process form of the id type of the service, and the results are in their order. The ids in one segment are
+// looked up once.
+func (a *AllocHandler) VerifyIds(ctx context.Context, serviceName string, idType string, ids []int64) ([]*VerifyResult, error) {
+	lastAllocValue, err := a.getLastAllocValue(ctx, serviceName, idType)
+	if err != nil {
+		return nil, err
+	}
+
+	sortedIds := append([]int64(nil), ids...)
+	sort.Slice(sortedIds, func(i, j int) bool { return sortedIds[i] < sortedIds[j] })
+	segments := make(map[int64]*entity.LedgerRecord, len(sortedIds))
+	var last *entity.LedgerRecord
+	for _, id := range sortedIds {
+		if id > lastAllocValue {
+			break
+		}
+		if last == nil || id < last.StartValue || id > last.EndValue {
+			if last, err = a.store.GetLedgerRecordContainingFromDB(ctx, serviceName, idType, id); err != nil {
+				return nil, err
+			}
+		}
+		segments[id] = last
+	}
+
+	results := make([]*VerifyResult, 0, len(ids))
+	for _, id := range ids {
+		result := &VerifyResult{Id: id, Status: VERIFY_UNKNOWN, Segment: segments[id]}
+		if result.Segment != nil {
+			result.Status = VERIFY_ISSUED
+		} else if id > lastAllocValue {
+			result.Status = VERIFY_NOT_ISSUED
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// getLastAllocValue: the counter in redis, or in the db if redis does not have it. The zero value of the id type
+// if neither has.
+func (a *AllocHandler) getLastAllocValue(ctx context.Context, serviceName string, idType string) (int64, error) {
+	allocInfo, err := a.store.RedisGet(ctx, serviceName)
+	if err != nil {
+		return 0, err
+	}
+	dbAllocInfo, err := a.store.GetServiceAllocInfoFromDB(ctx, serviceName)
+	if err != nil {
+		return 0, err
+	}
+	if allocInfo == nil || (dbAllocInfo != nil && *dbAllocInfo.LastAllocValue > *allocInfo.LastAllocValue) {
+		allocInfo = dbAllocInfo
+	}
+	if allocInfo == nil {
+		return entity.ZeroValue(idType), nil
+	}
+	return *allocInfo.LastAllocValue, nil
+}
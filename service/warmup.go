@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	def "github.com/daemon-coder/idalloc/definition"
+	ctxInfra "github.com/daemon-coder/idalloc/infrastructure/context_infra"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"golang.org/x/time/rate"
+)
+
+type warmupStatus struct {
+	total     atomic.Int64
+	finished  atomic.Int64
+	failed    atomic.Int64
+	startTime atomic.Int64
+	endTime   atomic.Int64
+}
+
+// WarmupStatus: the progress of the warmup, times are unix milliseconds
+type WarmupStatus struct {
+	Mode      string `json:"mode"`
+	Total     int64  `json:"total"`
+	Finished  int64  `json:"finished"`
+	Failed    int64  `json:"failed"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+}
+
+func (a *AllocHandler) IsReady() bool {
+	select {
+	case <-a.Ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *AllocHandler) GetWarmupStatus() WarmupStatus {
+	return WarmupStatus{
+		Mode:      a.warmupMode,
+		Total:     a.warmupStatus.total.Load(),
+		Finished:  a.warmupStatus.finished.Load(),
+		Failed:    a.warmupStatus.failed.Load(),
+		StartTime: a.warmupStatus.startTime.Load(),
+		EndTime:   a.warmupStatus.endTime.Load(),
+	}
+}
+
+func (a *AllocHandler) StartWarmup() error {
+	ctx := ctxInfra.WithTraceId(a.ctx, "Warmup")
+	serviceNames, err := a.getWarmupServiceNames(ctx)
+	if err != nil {
+		return err
+	}
+	a.warmupStatus.total.Store(int64(len(serviceNames)))
+	a.warmupStatus.startTime.Store(time.Now().UnixMilli())
+	log.WithContext(ctx).Infow("WarmupStart", "mode", a.warmupMode, "serviceNum", len(serviceNames))
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.Warmup(ctx, serviceNames)
+	}()
+	return nil
+}
+
+// Warmup: create the handlers of the services with at most warmupConcurrency workers,
+// and at most warmupQps creations per second to avoid bursting redis
+func (a *AllocHandler) Warmup(ctx context.Context, serviceNames []string) {
+	start := time.Now()
+	var limiter *rate.Limiter
+	if a.warmupQps > 0 {
+		limiter = rate.NewLimiter(rate.Limit(a.warmupQps), 1)
+	}
+	workerChan := make(chan struct{}, a.warmupConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, serviceName := range serviceNames {
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case workerChan <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		serviceName := serviceName
+		wg.Add(1)
+		serviceCtx := ctxInfra.WithTraceId(ctx, "Warmup-"+serviceName)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workerChan }()
+			a.warmupService(serviceCtx, serviceName)
+		}()
+	}
+	wg.Wait()
+
+	a.warmupStatus.endTime.Store(time.Now().UnixMilli())
+	close(a.Ready)
+	log.WithContext(ctx).Infow(
+		"WarmupFinish",
+		"mode", a.warmupMode,
+		"serviceNum", len(serviceNames),
+		"finishedNum", a.warmupStatus.finished.Load(),
+		"failedNum", a.warmupStatus.failed.Load(),
+		"duration", time.Since(start).String(),
+	)
+}
+
+func (a *AllocHandler) warmupService(ctx context.Context, serviceName string) {
+	if _, err := a.GetServiceAllocHandler(ctx, serviceName); err != nil {
+		a.warmupStatus.failed.Add(1)
+		log.WithContext(ctx).Warnw("WarmupServiceFailed", "serviceName", serviceName, "err", err)
+		return
+	}
+	a.warmupStatus.finished.Add(1)
+}
+
+func (a *AllocHandler) getWarmupServiceNames(ctx context.Context) ([]string, error) {
+	serviceNames := make([]string, 0)
+	switch a.warmupMode {
+	case def.WARMUP_MODE_EAGER:
+		allocInfos, err := a.store.GetAllFromDB(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, allocInfo := range allocInfos {
+			serviceNames = append(serviceNames, *allocInfo.ServiceName)
+		}
+	case def.WARMUP_MODE_HOT:
+		for _, serviceName := range a.warmupServiceNames {
+			serviceNames = append(serviceNames, strings.ToLower(strings.TrimSpace(serviceName)))
+		}
+	}
+
+	result := make([]string, 0, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		if a.registry.IsActive(serviceName) {
+			result = append(result, serviceName)
+		}
+	}
+	// the handlers beyond maxHandlerNum would evict the ones just warmed up, the configured order is kept in
+	// WARMUP_MODE_HOT, and the most recently used services are kept in WARMUP_MODE_EAGER
+	if a.maxHandlerNum > 0 && len(result) > a.maxHandlerNum {
+		if a.warmupMode == def.WARMUP_MODE_EAGER {
+			a.sortByRecentUse(ctx, result)
+		}
+		log.WithContext(ctx).Warnw("WarmupServicesCapped", "serviceNum", len(result), "maxServiceHandlerNum", a.maxHandlerNum)
+		result = result[:a.maxHandlerNum]
+	}
+	return result, nil
+}
+
+// sortByRecentUse: the services whose counters in redis were touched most recently first. The ones without an idle
+// time go last, and all of them keep the order of the db if redis does not track the idle times.
+func (a *AllocHandler) sortByRecentUse(ctx context.Context, serviceNames []string) {
+	idleTimes, err := a.store.RedisGetIdleTimes(ctx, serviceNames)
+	if err != nil {
+		log.WithContext(ctx).Warnw("GetServiceIdleTimesFailed", "err", err)
+		return
+	}
+	sort.SliceStable(serviceNames, func(i, j int) bool {
+		idleTimeI, okI := idleTimes[serviceNames[i]]
+		idleTimeJ, okJ := idleTimes[serviceNames[j]]
+		if okI != okJ {
+			return okI
+		}
+		return idleTimeI < idleTimeJ
+	})
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+)
+
+const (
+	// WASTE_REASON_SHUTDOWN: the unused tail of the current segment and the prefetched segment dropped on shutdown
+	WASTE_REASON_SHUTDOWN = "shutdown"
+	// WASTE_REASON_EVICTED: the segments dropped with a handler evicted as idle or beyond MaxServiceHandlerNum
+	WASTE_REASON_EVICTED = "evicted"
+	// WASTE_REASON_INVALIDATED: the segments dropped with a handler invalidated as the counter or the status changed
+	WASTE_REASON_INVALIDATED = "invalidated"
+	// WASTE_REASON_RECOVERY: the ids skipped as the counter is moved forward on recovery, e.g. to the segment journal
+	WASTE_REASON_RECOVERY = "recovery"
+	// WASTE_REASON_ABANDONED: the ids fetched but not handed out after an error
+	WASTE_REASON_ABANDONED = "abandoned"
+)
+
+var WASTE_REASONS = []string{
+	WASTE_REASON_SHUTDOWN,
+	WASTE_REASON_EVICTED,
+	WASTE_REASON_INVALIDATED,
+	WASTE_REASON_RECOVERY,
+	WASTE_REASON_ABANDONED,
+}
+
+// ServiceWaste: the ids fetched from redis by this instance and the ids wasted, partitioned by reason
+type ServiceWaste struct {
+	ServiceName string           `json:"serviceName"`
+	SegmentNum  int64            `json:"segmentNum"`
+	FetchedIds  int64            `json:"fetchedIds"`
+	WastedIds   map[string]int64 `json:"wastedIds"`
+	TotalWasted int64            `json:"totalWasted"`
+}
+
+// WasteReport: the services with the most ids wasted first
+type WasteReport struct {
+	Since         int64           `json:"since"`
+	BatchAllocNum int64           `json:"batchAllocNum"`
+	Services      []*ServiceWaste `json:"services"`
+}
+
+// WasteTracker: the in-memory tally of the ids wasted by this instance since it started.
+// The ids wasted on shutdown are logged, they are gone from the report with the process.
+type WasteTracker struct {
+	sync.Mutex
+	since    time.Time
+	services map[string]*ServiceWaste
+}
+
+func NewWasteTracker() *WasteTracker {
+	return &WasteTracker{
+		since:    time.Now(),
+		services: make(map[string]*ServiceWaste),
+	}
+}
+
+func (w *WasteTracker) getLocked(serviceName string) *ServiceWaste {
+	result, ok := w.services[serviceName]
+	if !ok {
+		result = &ServiceWaste{
+			ServiceName: serviceName,
+			WastedIds:   make(map[string]int64, len(WASTE_REASONS)),
+		}
+		w.services[serviceName] = result
+	}
+	return result
+}
+
+func (w *WasteTracker) AddFetched(serviceName string, count int64) {
+	w.Lock()
+	defer w.Unlock()
+	service := w.getLocked(serviceName)
+	service.SegmentNum++
+	service.FetchedIds += count
+}
+
+func (w *WasteTracker) AddWasted(serviceName string, reason string, count int64) {
+	w.Lock()
+	defer w.Unlock()
+	service := w.getLocked(serviceName)
+	service.WastedIds[reason] += count
+	service.TotalWasted += count
+}
+
+// Report: every reason is present in WastedIds, so that the report has the same shape for all the services
+func (w *WasteTracker) Report() *WasteReport {
+	w.Lock()
+	result := &WasteReport{
+		Since:    w.since.UnixMilli(),
+		Services: make([]*ServiceWaste, 0, len(w.services)),
+	}
+	for _, service := range w.services {
+		item := *service
+		item.WastedIds = make(map[string]int64, len(WASTE_REASONS))
+		for _, reason := range WASTE_REASONS {
+			item.WastedIds[reason] = service.WastedIds[reason]
+		}
+		result.Services = append(result.Services, &item)
+	}
+	w.Unlock()
+
+	sort.Slice(result.Services, func(i, j int) bool {
+		if result.Services[i].TotalWasted != result.Services[j].TotalWasted {
+			return result.Services[i].TotalWasted > result.Services[j].TotalWasted
+		}
+		return result.Services[i].ServiceName < result.Services[j].ServiceName
+	})
+	return result
+}
+
+// recordWaste: nothing is recorded if count is not positive
+func (r *RedisAllocHandler) recordWaste(ctx context.Context, serviceName string, reason string, count int64) {
+	if count <= 0 {
+		return
+	}
+	r.waste.AddWasted(serviceName, reason, count)
+	r.metrics.AddWastedIds(serviceName, reason, count)
+	log.WithContext(ctx).Infow("WasteIds", "serviceName", serviceName, "reason", reason, "count", count)
+}
+
+// WasteReport: the ids wasted by this instance, partitioned by service and reason
+func (r *RedisAllocHandler) WasteReport() *WasteReport {
+	result := r.waste.Report()
+	result.BatchAllocNum = r.batchAllocNum.Load()
+	return result
+}
+
+func (a *AllocHandler) WasteReport() *WasteReport {
+	return a.redisAllocHandler.WasteReport()
+}
+
+// recordSegmentWaste: the ids of the segment not handed out
+func (a *ServiceAllocHandler) recordSegmentWaste(ctx context.Context, reason string, segment *AllocResult) {
+	if segment == nil {
+		return
+	}
+	a.redisAllocHandler.recordWaste(ctx, a.serviceName, reason, segment.MaxValue-segment.LastAllocValue)
+}
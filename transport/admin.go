@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"encoding/json"
+
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/kataras/iris/v12/context"
+)
+
+func (t *Transport) ListServices(ctx *context.Context) definition.Result {
+	respDto, err := t.endpoint.ListServices(ctx.Request().Context())
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) GetServiceState(ctx *context.Context) definition.Result {
+	reqDto := dto.GetServiceStateReqDto{
+		ServiceName: ctx.Params().Get("serviceName"),
+	}
+	respDto, err := t.endpoint.GetServiceState(ctx.Request().Context(), reqDto)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) AdvanceCounter(ctx *context.Context) definition.Result {
+	var reqDto dto.AdvanceCounterReqDto
+	if err := readJsonBody(ctx, &reqDto); err != nil {
+		return newResult(ctx, nil, err)
+	}
+	reqDto.ServiceName = ctx.Params().Get("serviceName")
+
+	respDto, err := t.endpoint.AdvanceCounter(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("AdvanceCounter", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) FindLedger(ctx *context.Context) definition.Result {
+	// the range of the id depends on the id type of the service, it is checked by the endpoint
+	id := ctx.URLParamTrim("id")
+	if id == "" {
+		return newResult(ctx, nil, e.NewParamError(e.WithMsg("id is required")))
+	}
+	reqDto := dto.FindLedgerReqDto{
+		ServiceName: ctx.Params().Get("serviceName"),
+		Id:          json.Number(id),
+	}
+	respDto, err := t.endpoint.FindLedger(ctx.Request().Context(), reqDto)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) RecoverService(ctx *context.Context) definition.Result {
+	reqDto := dto.RecoverServiceReqDto{
+		ServiceName: ctx.Params().Get("serviceName"),
+	}
+	respDto, err := t.endpoint.RecoverService(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("RecoverService", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) CreateService(ctx *context.Context) definition.Result {
+	var reqDto dto.ServiceStatusReqDto
+	if err := readJsonBody(ctx, &reqDto); err != nil {
+		return newResult(ctx, nil, err)
+	}
+
+	respDto, err := t.endpoint.CreateService(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("CreateService", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) FreezeService(ctx *context.Context) definition.Result {
+	reqDto, err := readServiceStatusReqDto(ctx)
+	if err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.FreezeService(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("FreezeService", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) ActivateService(ctx *context.Context) definition.Result {
+	reqDto, err := readServiceStatusReqDto(ctx)
+	if err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.ActivateService(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("ActivateService", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) RetireService(ctx *context.Context) definition.Result {
+	reqDto, err := readServiceStatusReqDto(ctx)
+	if err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.RetireService(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("RetireService", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) ReloadConfig(ctx *context.Context) definition.Result {
+	respDto, err := t.endpoint.ReloadConfig(ctx.Request().Context())
+	log.WithContext(ctx.Request().Context()).Infow("ReloadConfig", "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func readServiceStatusReqDto(ctx *context.Context) (reqDto dto.ServiceStatusReqDto, err error) {
+	err = readJsonBody(ctx, &reqDto)
+	reqDto.ServiceName = ctx.Params().Get("serviceName")
+	return
+}
@@ -1,34 +1,79 @@
 package transport
 
 import (
+	stdContext "context"
 	"encoding/json"
 	"io"
 
 	"github.com/daemon-coder/idalloc/definition"
 	"github.com/daemon-coder/idalloc/definition/dto"
 	e "github.com/daemon-coder/idalloc/definition/errors"
-	"github.com/daemon-coder/idalloc/endpoint"
 	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	traceInfra "github.com/daemon-coder/idalloc/infrastructure/trace_infra"
 	"github.com/kataras/iris/v12/context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func Alloc(ctx *context.Context) definition.Result {
+func (t *Transport) Alloc(ctx *context.Context) (result definition.Result) {
+	traceInfra.WithSpan(ctx.Request().Context(), "transport.Alloc", func(reqCtx stdContext.Context, span trace.Span) {
+		var reqDto dto.AllocReqDto
+		if err := readJsonBody(ctx, &reqDto); err != nil {
+			result = newResult(ctx, nil, err)
+			return
+		}
+		span.SetAttributes(attribute.String("idalloc.service", reqDto.ServiceName), attribute.Int64("idalloc.count", reqDto.Count))
+
+		respDto, err := t.endpoint.Alloc(reqCtx, reqDto)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		log.WithContext(reqCtx).Infow("Alloc", "request", reqDto, "response", respDto, "err", err)
+		result = newResult(ctx, respDto, err)
+	})
+	return
+}
+
+func (t *Transport) BatchAlloc(ctx *context.Context) (result definition.Result) {
+	traceInfra.WithSpan(ctx.Request().Context(), "transport.BatchAlloc", func(reqCtx stdContext.Context, span trace.Span) {
+		var reqDto dto.BatchAllocReqDto
+		if err := readJsonBody(ctx, &reqDto); err != nil {
+			result = newResult(ctx, nil, err)
+			return
+		}
+		span.SetAttributes(attribute.Int("idalloc.item_num", len(reqDto.Items)))
+
+		respDto, err := t.endpoint.BatchAlloc(reqCtx, reqDto)
+		log.WithContext(reqCtx).Infow("BatchAlloc", "request", reqDto, "response", respDto, "err", err)
+		result = newResult(ctx, respDto, err)
+	})
+	return
+}
+
+func readJsonBody(ctx *context.Context, reqDto interface{}) error {
 	body, err := io.ReadAll(ctx.Request().Body)
 	if err != nil {
-		log.GetLogger().Warn("ParamError", "error", err)
-		e.Panic(e.NewParamError())
+		log.WithContext(ctx.Request().Context()).Warnw("ParamError", "error", err)
+		return e.NewParamError()
 	}
 
-	var reqDto dto.AllocReqDto
-	err = json.Unmarshal(body, &reqDto)
+	err = json.Unmarshal(body, reqDto)
 	if err != nil {
-		log.GetLogger().Warn("ParamError", "error", err)
-		e.Panic(e.NewParamError())
+		log.WithContext(ctx.Request().Context()).Warnw("ParamError", "error", err)
+		return e.NewParamError()
 	}
+	return nil
+}
 
-	respDto := endpoint.Alloc(reqDto)
-	log.GetLogger().Infow("Alloc", "request", reqDto, "response", respDto)
-	return definition.NewResultOK(respDto)
+// newResult: the error is logged at the level of its type, like the errors recovered from panics
+func newResult(ctx *context.Context, data interface{}, err error) definition.Result {
+	if err != nil {
+		log.LogError(ctx.Request().Context(), err, "RequestFailed", "err", err)
+		return definition.NewResultFromError(ctx.Request().Context(), e.FromStdError(err))
+	}
+	return definition.NewResultOK(ctx.Request().Context(), data)
 }
 
 // TODO grpc and others
@@ -0,0 +1,23 @@
+package transport
+
+import (
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/kataras/iris/v12/context"
+)
+
+func (t *Transport) CheckConsistency(ctx *context.Context) definition.Result {
+	var reqDto dto.CheckConsistencyReqDto
+	if err := readJsonBody(ctx, &reqDto); err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.CheckConsistency(ctx.Request().Context(), reqDto)
+	log.WithContext(ctx.Request().Context()).Infow("CheckConsistency", "request", reqDto, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) GetConsistencyReport(ctx *context.Context) definition.Result {
+	respDto, err := t.endpoint.GetConsistencyReport(ctx.Request().Context())
+	return newResult(ctx, respDto, err)
+}
@@ -0,0 +1,26 @@
+package transport
+
+import (
+	"net/http"
+
+	"github.com/daemon-coder/idalloc/definition"
+	e "github.com/daemon-coder/idalloc/definition/errors"
+	"github.com/kataras/iris/v12/context"
+)
+
+// Healthz: liveness, the process is able to respond. The dependency checks are reported but never fail it,
+// because restarting the instance does not help when redis or db is down.
+func (t *Transport) Healthz(ctx *context.Context) definition.Result {
+	return definition.NewResultOK(ctx.Request().Context(), t.endpoint.Health(ctx.Request().Context()))
+}
+
+// Readyz: responds 503 when the instance should not receive traffic,
+// e.g. during warmup, after the shutdown begins or when redis is unreachable
+func (t *Transport) Readyz(ctx *context.Context) definition.Result {
+	respDto := t.endpoint.Health(ctx.Request().Context())
+	if !respDto.Ready {
+		ctx.StatusCode(http.StatusServiceUnavailable)
+		return definition.NewResultFromError(ctx.Request().Context(), e.NewServerError(e.WithMsg("NotReady"), e.WithData(respDto)))
+	}
+	return definition.NewResultOK(ctx.Request().Context(), respDto)
+}
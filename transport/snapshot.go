@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	log "github.com/daemon-coder/idalloc/infrastructure/log_infra"
+	"github.com/kataras/iris/v12/context"
+)
+
+func (t *Transport) ExportSnapshot(ctx *context.Context) definition.Result {
+	respDto, err := t.endpoint.ExportSnapshot(ctx.Request().Context())
+	return newResult(ctx, respDto, err)
+}
+
+func (t *Transport) ImportSnapshot(ctx *context.Context) definition.Result {
+	var reqDto dto.ImportSnapshotReqDto
+	if err := readJsonBody(ctx, &reqDto); err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.ImportSnapshot(ctx.Request().Context(), reqDto)
+	// the snapshot itself is not logged, the results have all the services
+	log.WithContext(ctx.Request().Context()).Infow("ImportSnapshot", "operator", reqDto.Operator, "reason", reqDto.Reason, "response", respDto, "err", err)
+	return newResult(ctx, respDto, err)
+}
@@ -0,0 +1,14 @@
+package transport
+
+import (
+	"github.com/daemon-coder/idalloc/endpoint"
+)
+
+// Transport: the http handlers of a server
+type Transport struct {
+	endpoint *endpoint.Endpoint
+}
+
+func NewTransport(endpoint *endpoint.Endpoint) *Transport {
+	return &Transport{endpoint: endpoint}
+}
@@ -0,0 +1,16 @@
+package transport
+
+import (
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/daemon-coder/idalloc/definition/dto"
+	"github.com/kataras/iris/v12/context"
+)
+
+func (t *Transport) Verify(ctx *context.Context) definition.Result {
+	var reqDto dto.VerifyReqDto
+	if err := readJsonBody(ctx, &reqDto); err != nil {
+		return newResult(ctx, nil, err)
+	}
+	respDto, err := t.endpoint.Verify(ctx.Request().Context(), reqDto)
+	return newResult(ctx, respDto, err)
+}
@@ -0,0 +1,11 @@
+package transport
+
+import (
+	"github.com/daemon-coder/idalloc/definition"
+	"github.com/kataras/iris/v12/context"
+)
+
+func (t *Transport) GetWasteReport(ctx *context.Context) definition.Result {
+	respDto, err := t.endpoint.GetWasteReport(ctx.Request().Context())
+	return newResult(ctx, respDto, err)
+}